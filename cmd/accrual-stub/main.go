@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/OlegMzhelskiy/gophermart/pkg/accrual/stub"
+)
+
+// accrual-stub serves scriptable answers of the accrual system.
+//
+// Script file example:
+//
+//	{
+//	  "orders": {
+//	    "12345678903": [{"status": "REGISTERED"}, {"status": "PROCESSING"}, {"status": "PROCESSED", "accrual": 500}],
+//	    "79927398713": [{"status": "INVALID"}]
+//	  },
+//	  "default": [{"status": "PROCESSING"}, {"status": "PROCESSED", "accrual": 100}]
+//	}
+func main() {
+	flagAddr := flag.String("a", "", "server address")
+	flagScript := flag.String("script", "", "JSON file with order scripts")
+	flagRateLimit := flag.Int("rate-limit", 0, "requests per minute, 0 is unlimited")
+	flagRetryAfter := flag.Duration("retry-after", 0, "Retry-After of 429 answer, by default until the end of the minute")
+	flagLatency := flag.Duration("latency", 0, "delay of every answer")
+	flagErrorRate := flag.Float64("error-rate", 0, "probability of 500 answer")
+	flag.Parse()
+
+	addr := *flagAddr
+	if addr == "" {
+		addr = os.Getenv("RUN_ADDRESS")
+	}
+	if addr == "" {
+		addr = "localhost:8080"
+	}
+
+	cfg := stub.Config{}
+	if *flagScript != "" {
+		data, err := os.ReadFile(*flagScript)
+		if err != nil {
+			log.Fatalf("read script failed: %s", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			log.Fatalf("parse script failed: %s", err)
+		}
+	}
+	if *flagRateLimit > 0 {
+		cfg.RateLimit = *flagRateLimit
+	}
+	if *flagErrorRate > 0 {
+		cfg.ErrorRate = *flagErrorRate
+	}
+	cfg.RetryAfter = *flagRetryAfter
+	cfg.Latency = *flagLatency
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           stub.New(cfg),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("accrual stub listens on %s", addr)
+	log.Fatal(srv.ListenAndServe())
+}
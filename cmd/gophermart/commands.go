@@ -0,0 +1,27 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/apiserver"
+)
+
+// commands are maintenance subcommands, without them the server is started
+var commands = map[string]func(args []string, out io.Writer) error{
+	"migrate":      runMigrate,
+	"ledger":       runLedger,
+	"jwt":          runJWT,
+	"user":         runUser,
+	"order-number": runOrderNumber,
+}
+
+func resolveDBDSN(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if dbDSN := os.Getenv("DATABASE_URI"); dbDSN != "" {
+		return dbDSN
+	}
+	return apiserver.DefaultDBDSN
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/usecase"
+)
+
+const jwtUsage = `usage: gophermart jwt rotate|list [flags]
+
+  rotate  add a new signing key to the keys file and drop the keys which are no longer active,
+          send SIGHUP to the running server to reload the file
+  list    print the keys of the keys file
+`
+
+// runJWT handles "gophermart jwt" command
+func runJWT(args []string, out io.Writer) error {
+	if len(args) == 0 || (args[0] != "rotate" && args[0] != "list") {
+		return errors.New(jwtUsage)
+	}
+
+	fs := flag.NewFlagSet("jwt "+args[0], flag.ContinueOnError)
+	flagFile := fs.String("f", "", "JSON file with signing keys")
+	flagTTL := fs.Duration("ttl", usecase.DefaultTokenTTL, "token lifetime, the previous key is active during it after rotation")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	path := *flagFile
+	if path == "" {
+		path = os.Getenv("JWT_KEYS_FILE")
+	}
+	if path == "" {
+		return errors.New("keys file is not set, use -f or JWT_KEYS_FILE")
+	}
+
+	keys, err := usecase.LoadSigningKeys(path)
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "rotate" {
+		if len(keys) == 0 {
+			key, err := usecase.GenerateSigningKey()
+			if err != nil {
+				return err
+			}
+			keys = []usecase.SigningKey{key}
+		} else {
+			ring, err := usecase.NewKeyring(*flagTTL, keys...)
+			if err != nil {
+				return err
+			}
+			if _, err := ring.Rotate(); err != nil {
+				return err
+			}
+			keys = ring.Keys(time.Now())
+		}
+		if err := usecase.SaveSigningKeys(path, keys); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "new signing key %s\n", keys[len(keys)-1].ID)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KID\tCREATED AT")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%s\n", key.ID, key.CreatedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
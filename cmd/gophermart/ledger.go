@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+)
+
+const ledgerUsage = `usage: gophermart ledger check [flags]
+
+  check   recompute balances from the journal and report mismatched accounts
+`
+
+var errLedgerInconsistent = errors.New("ledger is inconsistent")
+
+// runLedger handles "gophermart ledger" command
+func runLedger(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New(ledgerUsage)
+	}
+
+	fs := flag.NewFlagSet("ledger check", flag.ContinueOnError)
+	flagDBDSN := fs.String("d", "", "DB connection")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	store, err := storage.NewSQLStore(resolveDBDSN(*flagDBDSN))
+	if err != nil {
+		return fmt.Errorf("db connection error: %w", err)
+	}
+	defer store.Close()
+
+	list, err := store.CheckLedger(context.Background())
+	if err != nil {
+		return fmt.Errorf("check ledger failed: %w", err)
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(out, "ledger is consistent")
+		return nil
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tBALANCE\tJOURNAL BALANCE\tWITHDRAWN\tJOURNAL WITHDRAWN")
+	for _, d := range list {
+		fmt.Fprintf(w, "%s\t%v\t%v\t%v\t%v\n", d.UserID, d.Balance, d.JournalBalance, d.Withdrawn, d.JournalWithdrawn)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %d account(s) mismatched", errLedgerInconsistent, len(list))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/OlegMzhelskiy/gophermart/internal/apiserver"
 	"github.com/OlegMzhelskiy/gophermart/internal/storage"
@@ -22,6 +23,16 @@ import (
 // @name Authorization
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	cfg := apiserver.NewConfig()
 	err := run(cfg)
 	if err != nil {
@@ -30,24 +41,47 @@ func main() {
 }
 
 func run(cfg apiserver.Config) error {
-	store, err := storage.NewSQLStore(cfg.DBDSN)
+	store, err := storage.New(cfg.StorageType, cfg.DBDSN)
 	if err != nil {
 		return fmt.Errorf("db connection error: %w", err)
 	}
 	cfg.Store = store
-	srv := apiserver.NewServer(cfg)
+	srv, err := apiserver.NewServer(cfg)
+	if err != nil {
+		store.Close()
+		return err
+	}
 
+	runErr := make(chan error, 1)
 	go func() {
-		if err := srv.Run(); err != nil {
-			cfg.Logger.Fatal("http-server failed", err)
-			//return err
-		}
+		runErr <- srv.Run()
 	}()
 
+	//SIGHUP reloads the signing keys after gophermart jwt rotate
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 	signalChanel := make(chan os.Signal, 1)
 	signal.Notify(signalChanel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	<-signalChanel
+wait:
+	for {
+		select {
+		case <-reload:
+			if err := srv.ReloadSigningKeys(); err != nil {
+				cfg.Logger.Error("reload signing keys failed: ", err)
+			}
+		case <-signalChanel:
+			break wait
+		case err := <-runErr:
+			if err != nil {
+				//the server didn't start, but the workers are running
+				srv.Shutdown(context.Background())
+				return err
+			}
+		}
+	}
 
-	srv.Stop()
-	return nil
+	//the drain delay doesn't shorten the time to finish requests
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainDelay+cfg.ShutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+)
+
+const migrateUsage = `usage: gophermart migrate up|down|status [flags]
+
+  up      apply all pending migrations
+  down    roll back the last applied migrations (-n, default 1)
+  status  show applied and pending migrations
+`
+
+// runMigrate handles "gophermart migrate" command
+func runMigrate(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	command := args[0]
+
+	fs := flag.NewFlagSet("migrate "+command, flag.ContinueOnError)
+	flagDBDSN := fs.String("d", "", "DB connection")
+	flagSteps := fs.Int("n", 1, "number of migrations to roll back")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	m, err := storage.NewMigrator(resolveDBDSN(*flagDBDSN))
+	if err != nil {
+		return fmt.Errorf("db connection error: %w", err)
+	}
+	defer m.Close()
+
+	switch command {
+	case "up":
+		n, err := m.Up()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "applied %d migration(s)\n", n)
+	case "down":
+		if *flagSteps < 1 {
+			return errors.New("number of migrations must be positive")
+		}
+		n, err := m.Down(*flagSteps)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "rolled back %d migration(s)\n", n)
+	case "status":
+		list, err := m.Status()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, st := range list {
+			appliedAt := "pending"
+			if st.Applied {
+				appliedAt = st.AppliedAt.Format("2006-01-02 15:04:05 -0700")
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", st.Version, st.Name, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", command, migrateUsage)
+	}
+	return nil
+}
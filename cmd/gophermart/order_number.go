@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/OlegMzhelskiy/gophermart/pkg/validate"
+)
+
+var orderNumberUsage = `usage: gophermart order-number [-scheme <scheme>] <payload>...
+
+  appends the check digit of the scheme to every payload, e.g. for test data
+  schemes: ` + strings.Join(validate.DefaultRegistry.Schemes(), ", ") + `
+`
+
+// runOrderNumber handles "gophermart order-number" command
+func runOrderNumber(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("order-number", flag.ContinueOnError)
+	flagScheme := fs.String("scheme", validate.SchemeLuhn, "check digit scheme")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New(orderNumberUsage)
+	}
+	for _, payload := range fs.Args() {
+		number, err := validate.DefaultRegistry.CheckDigit(*flagScheme, payload)
+		if err != nil {
+			return fmt.Errorf("%s: %w", payload, err)
+		}
+		fmt.Fprintln(out, number)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+)
+
+const userUsage = `usage: gophermart user set-role -login <login> -role user|admin [flags]
+
+  set-role  grant the role to the user, tokens with the previous role stop working
+`
+
+// runUser handles "gophermart user" command
+func runUser(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "set-role" {
+		return errors.New(userUsage)
+	}
+
+	fs := flag.NewFlagSet("user set-role", flag.ContinueOnError)
+	flagDBDSN := fs.String("d", "", "DB connection")
+	flagLogin := fs.String("login", "", "user's login")
+	flagRole := fs.String("role", "", "role: user or admin")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	role := models.Role(*flagRole)
+	if *flagLogin == "" || !role.Valid() {
+		return errors.New(userUsage)
+	}
+
+	store, err := storage.NewSQLStore(resolveDBDSN(*flagDBDSN))
+	if err != nil {
+		return fmt.Errorf("db connection error: %w", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	user, err := store.GetUserByLogin(ctx, *flagLogin)
+	if err != nil {
+		return fmt.Errorf("get user failed: %w", err)
+	}
+	if err := store.SetUserRole(ctx, user.ID, role); err != nil {
+		return fmt.Errorf("set role failed: %w", err)
+	}
+	fmt.Fprintf(out, "user %s (id %s) has role %s\n", user.Login, user.ID, role)
+	return nil
+}
@@ -0,0 +1,270 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+	"github.com/OlegMzhelskiy/gophermart/internal/usecase"
+)
+
+var errForbidden = errors.New("access denied")
+
+//middleware allows the request if the authenticated user has one of the roles
+func (s *APIServer) requireRole(roles ...models.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role, _ := r.Context().Value(ctxKeyRole).(models.Role)
+			for _, allowed := range roles {
+				if role == allowed {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			s.error(w, r, http.StatusForbidden, errForbidden)
+		})
+	}
+}
+
+//middleware responds 404 if the user of the path doesn't exist
+func (s *APIServer) adminUserExists(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := s.useCase.User.GetUser(r.Context(), chi.URLParam(r, "userID")); err != nil {
+			if errors.Is(err, usecase.ErrUserNotFound) {
+				s.error(w, r, http.StatusNotFound, usecase.ErrUserNotFound)
+			} else {
+				s.errorLog(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminFindUser
+// @Summary      AdminFindUser
+// @Security ApiKeyAuth
+// @Description  Find user by login, admin only
+// @Tags         admin
+// @Produce      json
+// @Param        login query string true "user's login"
+// @Success      200  {object}  models.UserInfo
+// @Failure      400  {object}  string
+// @Failure      401  {object}  string
+// @Failure      403  {object}  string
+// @Failure      404  {object}  string
+// @Failure      500  {object}  string
+// @Router       /api/admin/users [get]
+func (s *APIServer) AdminFindUser(w http.ResponseWriter, r *http.Request) {
+	login := r.URL.Query().Get("login")
+	if login == "" {
+		s.error(w, r, http.StatusBadRequest, usecase.ErrLoginIsEmpty)
+		return
+	}
+	user, err := s.useCase.User.FindUser(r.Context(), login)
+	if err != nil {
+		if errors.Is(err, usecase.ErrUserNotFound) {
+			s.error(w, r, http.StatusNotFound, usecase.ErrUserNotFound)
+		} else {
+			s.errorLog(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	s.respondJSON(w, r, http.StatusOK, user)
+}
+
+// AdminGetUser
+// @Summary      AdminGetUser
+// @Security ApiKeyAuth
+// @Description  Return user, admin only
+// @Tags         admin
+// @Produce      json
+// @Param        userID path string true "user ID"
+// @Success      200  {object}  models.UserInfo
+// @Failure      401  {object}  string
+// @Failure      403  {object}  string
+// @Failure      404  {object}  string
+// @Failure      500  {object}  string
+// @Router       /api/admin/users/{userID} [get]
+func (s *APIServer) AdminGetUser(w http.ResponseWriter, r *http.Request) {
+	user, err := s.useCase.User.GetUser(r.Context(), chi.URLParam(r, "userID"))
+	if err != nil {
+		s.errorLog(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.respondJSON(w, r, http.StatusOK, user)
+}
+
+// AdminGetOrderList
+// @Summary      AdminGetOrderList
+// @Security ApiKeyAuth
+// @Description  Return order list of the user, admin only
+// @Tags         admin
+// @Produce      json
+// @Param        userID path string true "user ID"
+// @Success      200  {array}  models.Order
+// @Success      204  {array}	string{}
+// @Failure      401  {object}  string
+// @Failure      403  {object}  string
+// @Failure      404  {object}  string
+// @Failure      500  {object}  string
+// @Router       /api/admin/users/{userID}/orders [get]
+func (s *APIServer) AdminGetOrderList(w http.ResponseWriter, r *http.Request) {
+	list, err := s.useCase.Order.GetOrderList(r.Context(), chi.URLParam(r, "userID"))
+	if err != nil {
+		s.errorLog(w, r, http.StatusInternalServerError, fmt.Errorf("get list order failed: %w", err))
+	} else if len(list) == 0 {
+		s.respond(w, r, http.StatusNoContent, nil)
+	} else {
+		s.respondJSON(w, r, http.StatusOK, list)
+	}
+}
+
+// AdminGetWithdrawals
+// @Summary      AdminGetWithdrawals
+// @Security ApiKeyAuth
+// @Description  Return withdrawals of the user, admin only
+// @Tags         admin
+// @Produce      json
+// @Param        userID path string true "user ID"
+// @Success      200  {object}  []models.OrderWithdraw
+// @Success      204  {object} 	string
+// @Failure      401  {object}  string
+// @Failure      403  {object}  string
+// @Failure      404  {object}  string
+// @Failure      500  {object}  string
+// @Router       /api/admin/users/{userID}/withdrawals [get]
+func (s *APIServer) AdminGetWithdrawals(w http.ResponseWriter, r *http.Request) {
+	list, err := s.useCase.Order.GetWithdrawals(r.Context(), chi.URLParam(r, "userID"))
+	if err != nil {
+		s.errorLog(w, r, http.StatusInternalServerError, err)
+	} else if len(list) == 0 {
+		s.respond(w, r, http.StatusNoContent, nil)
+	} else {
+		s.respondJSON(w, r, http.StatusOK, list)
+	}
+}
+
+// AdminGetBalance
+// @Summary      AdminGetBalance
+// @Security ApiKeyAuth
+// @Description  Return balance of the user, admin only
+// @Tags         admin
+// @Produce      json
+// @Param        userID path string true "user ID"
+// @Success      200  {object}  models.UserBalance
+// @Failure      401  {object}  string
+// @Failure      403  {object}  string
+// @Failure      404  {object}  string
+// @Failure      500  {object}  string
+// @Router       /api/admin/users/{userID}/balance [get]
+func (s *APIServer) AdminGetBalance(w http.ResponseWriter, r *http.Request) {
+	userBal, err := s.useCase.User.GetUserBalanceAndWithdrawals(r.Context(), chi.URLParam(r, "userID"))
+	if err != nil {
+		s.errorLog(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.respondJSON(w, r, http.StatusOK, userBal)
+}
+
+// AdminAdjustBalance
+// @Summary      AdminAdjustBalance
+// @Security ApiKeyAuth
+// @Description  Credit or debit the user's balance, the authenticated admin is recorded as the operator. Admin only.
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        userID path string true "user ID"
+// @Param        adjustment body models.AdjustmentRequest true "credit or debit, sum, reason and note"
+// @Success      201  {object}  models.Adjustment
+// @Failure      400  {object}  string
+// @Failure      401  {object}  string
+// @Failure      402  {object}  string
+// @Failure      403  {object}  string
+// @Failure      404  {object}  string
+// @Failure      422  {object}  string
+// @Failure      500  {object}  string
+// @Router       /api/admin/users/{userID}/adjustments [post]
+func (s *APIServer) AdminAdjustBalance(w http.ResponseWriter, r *http.Request) {
+	operatorID, ok := r.Context().Value(ctxKeyUserID).(string)
+	if !ok {
+		s.errorLog(w, r, http.StatusInternalServerError, errors.New("invalid type user ID"))
+		return
+	}
+	req := models.AdjustmentRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.errorLog(w, r, http.StatusBadRequest, err)
+		return
+	}
+	adj, err := s.useCase.User.AdjustBalance(r.Context(), operatorID, chi.URLParam(r, "userID"), req)
+	if err != nil {
+		if errors.Is(err, usecase.ErrInvalidAdjustment) || errors.Is(err, usecase.ErrUnknownAdjustmentReason) {
+			s.error(w, r, http.StatusUnprocessableEntity, err)
+		} else if errors.Is(err, usecase.ErrNotEnoughFunds) {
+			s.error(w, r, http.StatusPaymentRequired, usecase.ErrNotEnoughFunds)
+		} else if errors.Is(err, usecase.ErrUserNotFound) {
+			s.error(w, r, http.StatusNotFound, usecase.ErrUserNotFound)
+		} else {
+			s.errorLog(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	s.respondJSON(w, r, http.StatusCreated, adj)
+}
+
+// AdminGetAdjustments
+// @Summary      AdminGetAdjustments
+// @Security ApiKeyAuth
+// @Description  Return audit history of manual adjustments of the user's balance, admin only
+// @Tags         admin
+// @Produce      json
+// @Param        userID path string true "user ID"
+// @Success      200  {array}  models.Adjustment
+// @Success      204  {object} 	string
+// @Failure      401  {object}  string
+// @Failure      403  {object}  string
+// @Failure      404  {object}  string
+// @Failure      500  {object}  string
+// @Router       /api/admin/users/{userID}/adjustments [get]
+func (s *APIServer) AdminGetAdjustments(w http.ResponseWriter, r *http.Request) {
+	list, err := s.useCase.User.GetAdjustments(r.Context(), chi.URLParam(r, "userID"))
+	if err != nil {
+		s.errorLog(w, r, http.StatusInternalServerError, err)
+	} else if len(list) == 0 {
+		s.respond(w, r, http.StatusNoContent, nil)
+	} else {
+		s.respondJSON(w, r, http.StatusOK, list)
+	}
+}
+
+// AdminRequeueOrder
+// @Summary      AdminRequeueOrder
+// @Security ApiKeyAuth
+// @Description  Request the order status from the accrual system again, admin only. Orders with final status PROCESSED or INVALID aren't requested.
+// @Tags         admin
+// @Param        number path string true "order number"
+// @Success      202
+// @Failure      401  {object}  string
+// @Failure      403  {object}  string
+// @Failure      404  {object}  string
+// @Failure      409  {object}  string
+// @Failure      500  {object}  string
+// @Router       /api/admin/orders/{number}/poll [post]
+func (s *APIServer) AdminRequeueOrder(w http.ResponseWriter, r *http.Request) {
+	err := s.useCase.Order.RequeueOrder(r.Context(), models.OrderNumber(chi.URLParam(r, "number")))
+	if err != nil {
+		if errors.Is(err, usecase.ErrOrderNotFound) {
+			s.error(w, r, http.StatusNotFound, usecase.ErrOrderNotFound)
+		} else if errors.Is(err, usecase.ErrOrderFinal) {
+			s.error(w, r, http.StatusConflict, usecase.ErrOrderFinal)
+		} else {
+			s.errorLog(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	s.respond(w, r, http.StatusAccepted, nil)
+}
@@ -0,0 +1,106 @@
+package apiserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+	"github.com/OlegMzhelskiy/gophermart/pkg/logging"
+)
+
+func TestAPIServer_Admin(t *testing.T) {
+	ctx := context.Background()
+	srv := NewTestServer()
+	defer srv.StopTestServer()
+
+	_, userSession := srv.registerTestUser(t, "user1")
+	userToken := userSession.AccessToken
+	require.Equal(t, http.StatusAccepted, srv.doRequest(http.MethodPost, "/api/user/orders", userToken, "12345678903").Code)
+	_, adminSession := srv.registerTestUser(t, "admin")
+	require.NoError(t, srv.useCase.User.SetUserRole(ctx, "admin", models.RoleAdmin))
+	//the token issued before the role was granted is rejected
+	assert.Equal(t, http.StatusUnauthorized, srv.doRequest(http.MethodGet, "/api/admin/users?login=user1", adminSession.AccessToken, nil).Code)
+	adminToken := srv.loginTestUser(t, "admin").AccessToken
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		body     string
+		code     int
+		contains string
+	}{
+		{"anonymous", http.MethodGet, "/api/admin/users?login=user1", "", "", http.StatusUnauthorized, ""},
+		{"not admin", http.MethodGet, "/api/admin/users?login=user1", userToken, "", http.StatusForbidden, ""},
+		{"find user", http.MethodGet, "/api/admin/users?login=user1", adminToken, "", http.StatusOK, `"role": "user"`},
+		{"find unknown user", http.MethodGet, "/api/admin/users?login=user2", adminToken, "", http.StatusNotFound, ""},
+		{"find without login", http.MethodGet, "/api/admin/users", adminToken, "", http.StatusBadRequest, ""},
+		{"get user", http.MethodGet, "/api/admin/users/1", adminToken, "", http.StatusOK, `"login": "user1"`},
+		{"get unknown user", http.MethodGet, "/api/admin/users/100500/orders", adminToken, "", http.StatusNotFound, ""},
+		{"non-numeric user id", http.MethodGet, "/api/admin/users/abc", adminToken, "", http.StatusNotFound, ""},
+		{"too big user id", http.MethodGet, "/api/admin/users/99999999999/balance", adminToken, "", http.StatusNotFound, ""},
+		{"user orders", http.MethodGet, "/api/admin/users/1/orders", adminToken, "", http.StatusOK, `"number": "12345678903"`},
+		{"user withdrawals", http.MethodGet, "/api/admin/users/1/withdrawals", adminToken, "", http.StatusNoContent, ""},
+		{"user balance", http.MethodGet, "/api/admin/users/1/balance", adminToken, "", http.StatusOK, `"current": 0`},
+		{"poll order", http.MethodPost, "/api/admin/orders/12345678903/poll", adminToken, "", http.StatusAccepted, ""},
+		{"poll unknown order", http.MethodPost, "/api/admin/orders/2377225624/poll", adminToken, "", http.StatusNotFound, ""},
+		{"not admin poll", http.MethodPost, "/api/admin/orders/12345678903/poll", userToken, "", http.StatusForbidden, ""},
+		{"credit", http.MethodPost, "/api/admin/users/1/adjustments", adminToken, `{"type":"credit","sum":300,"reason":"compensation","note":"lost order"}`, http.StatusCreated, `"operator_id": "2"`},
+		{"debit", http.MethodPost, "/api/admin/users/1/adjustments", adminToken, `{"type":"debit","sum":100,"reason":"fraud"}`, http.StatusCreated, `"amount": -100`},
+		{"debit exceeding balance", http.MethodPost, "/api/admin/users/1/adjustments", adminToken, `{"type":"debit","sum":1000,"reason":"fraud"}`, http.StatusPaymentRequired, ""},
+		{"unknown reason", http.MethodPost, "/api/admin/users/1/adjustments", adminToken, `{"type":"credit","sum":10,"reason":"gift"}`, http.StatusUnprocessableEntity, ""},
+		{"broken adjustment", http.MethodPost, "/api/admin/users/1/adjustments", adminToken, `{"type":`, http.StatusBadRequest, ""},
+		{"adjust unknown user", http.MethodPost, "/api/admin/users/100500/adjustments", adminToken, `{"type":"credit","sum":10,"reason":"goodwill"}`, http.StatusNotFound, ""},
+		{"not admin adjustment", http.MethodPost, "/api/admin/users/1/adjustments", userToken, `{"type":"credit","sum":10,"reason":"goodwill"}`, http.StatusForbidden, ""},
+		{"adjustments", http.MethodGet, "/api/admin/users/1/adjustments", adminToken, "", http.StatusOK, `"note": "lost order"`},
+		{"balance after adjustments", http.MethodGet, "/api/admin/users/1/balance", adminToken, "", http.StatusOK, `"current": 200`},
+		{"user balance after adjustments", http.MethodGet, "/api/user/balance", userToken, "", http.StatusOK, `"current": 200`},
+		//keys are rotated in the shared keys file only
+		{"rotate keys", http.MethodPost, "/api/admin/keys/rotate", adminToken, "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := srv.doRequest(tt.method, tt.path, tt.token, tt.body)
+			assert.Equal(t, tt.code, rec.Code, rec.Body.String())
+			assert.Contains(t, rec.Body.String(), tt.contains)
+		})
+	}
+
+	//tokens signed before the rotation stay valid
+	assert.Equal(t, http.StatusOK, srv.doRequest(http.MethodGet, "/api/user/orders", userToken, nil).Code)
+}
+
+func TestAPIServer_AdminRequeueFinalOrder(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemStore()
+	srv, err := NewServer(Config{Addr: DefaultHost, Store: store, Logger: logging.NewLogger(false), BcryptCost: bcrypt.MinCost})
+	require.NoError(t, err)
+	defer srv.StopTestServer()
+
+	admin := models.User{Login: "admin", Password: "qwerty123"}
+	require.NoError(t, srv.useCase.User.CreateUser(ctx, &admin))
+	require.NoError(t, srv.useCase.User.SetUserRole(ctx, "admin", models.RoleAdmin))
+	admin.Role = models.RoleAdmin
+	pair, err := srv.useCase.User.IssueTokens(ctx, admin)
+	require.NoError(t, err)
+	poll := func(number string) int {
+		return srv.doRequest(http.MethodPost, "/api/admin/orders/"+number+"/poll", pair.AccessToken, nil).Code
+	}
+
+	for _, number := range []models.OrderNumber{"12345678903", "2377225624"} {
+		require.NoError(t, store.CreateOrder(ctx, models.Order{Number: number, UserID: admin.ID, UploadedAt: time.Now()}))
+	}
+	require.NoError(t, store.UpdateOrder(ctx, models.Order{Number: "2377225624", Status: models.OrderStatusProcessed, Accrual: models.Points(10)}))
+
+	assert.Equal(t, http.StatusAccepted, poll("12345678903"))
+	//the final status never changes, so there is nothing to request
+	assert.Equal(t, http.StatusConflict, poll("2377225624"))
+}
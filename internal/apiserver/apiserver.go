@@ -7,8 +7,12 @@ import (
 	"fmt"
 	"io"
 	//"log"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/OlegMzhelskiy/gophermart/docs"
@@ -23,50 +27,175 @@ import (
 
 type ctxKey string
 
+var ErrNoSigningKeys = errors.New("signing keys are not configured, set -jwt-secret (JWT_SECRET) or -jwt-keys (JWT_KEYS_FILE)")
+
 var (
-	DefaultHost         = "localhost:8088"
-	DefaultDBDSN        = "host=localhost dbname=gophermart user=postgres password=123 sslmode=disable"
-	ctxKeyUserID ctxKey = "userID"
+	DefaultHost                   = "localhost:8088"
+	DefaultShutdownTimeout        = 10 * time.Second
+	DefaultDrainDelay             = 5 * time.Second
+	DefaultDBDSN                  = "host=localhost dbname=gophermart user=postgres password=123 sslmode=disable"
+	ctxKeyUserID           ctxKey = "userID"
+	ctxKeyToken            ctxKey = "token"
+	ctxKeyRole             ctxKey = "role"
 )
 
 type APIServer struct {
-	addr    string
-	router  *chi.Mux
-	useCase usecase.UseCases
-	done    chan struct{}
-	logger  logging.Loggerer
-	prod    bool
+	addr       string
+	router     *chi.Mux
+	httpServer *http.Server
+	useCase    usecase.UseCases
+	done       chan struct{}
+	ready      int32 //1 while the server accepts requests, flipped to 0 on shutdown
+	logger     logging.Loggerer
+	prod       bool
+	drainDelay time.Duration //time between the readiness flip and closing the listeners
+
+	compressMinSize int
+	maxBodySize     int          //largest decoded body of compressed request
+	trustedProxies  []*net.IPNet //proxies whose X-Forwarded-For and X-Real-IP are trusted
+	jwtSecret       string
+	jwtKeysFile     string
 }
 
-func NewServer(cfg Config) *APIServer {
+func NewServer(cfg Config) (*APIServer, error) {
+	trustedProxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := signingKeys(cfg.JWTSecret, cfg.JWTKeysFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		//the random key logs out all users on restart and isn't accepted by other replicas
+		if cfg.Prod {
+			return nil, ErrNoSigningKeys
+		}
+		cfg.Logger.Error("WARNING: ", ErrNoSigningKeys, ", tokens are signed with a random key valid until restart")
+	}
 	done := make(chan struct{})
-	uc := usecase.NewUseCases(cfg.Store, done, cfg.AcSysAddr)
+	uc, err := usecase.NewUseCases(cfg.Store, done, usecase.Config{
+		AccrualAddr:        cfg.AcSysAddr,
+		Workers:            cfg.AccrualWorkers,
+		PollInterval:       cfg.AccrualPollInterval,
+		SigningKeys:        keys,
+		TokenTTL:           cfg.TokenTTL,
+		RefreshTokenTTL:    cfg.RefreshTokenTTL,
+		BcryptCost:         cfg.BcryptCost,
+		IdempotencyTTL:     cfg.IdempotencyTTL,
+		OrderNumberSchemes: cfg.OrderNumberSchemes,
+	})
+	if err != nil {
+		return nil, err
+	}
 	srv := &APIServer{
-		addr:    cfg.Addr,
-		useCase: *uc,
-		done:    done,
-		logger:  cfg.Logger,
-		prod:    cfg.Prod,
+		addr:       cfg.Addr,
+		useCase:    *uc,
+		done:       done,
+		logger:     cfg.Logger,
+		prod:       cfg.Prod,
+		drainDelay: cfg.DrainDelay,
+
+		compressMinSize: cfg.CompressMinSize,
+		maxBodySize:     cfg.MaxBodySize,
+		trustedProxies:  trustedProxies,
+		jwtSecret:       cfg.JWTSecret,
+		jwtKeysFile:     cfg.JWTKeysFile,
+	}
+	if srv.compressMinSize <= 0 {
+		srv.compressMinSize = DefaultCompressMinSize
+	}
+	if srv.maxBodySize <= 0 {
+		srv.maxBodySize = DefaultMaxBodySize
 	}
 	srv.configureRouter()
-	return srv
+	srv.httpServer = &http.Server{Addr: cfg.Addr, Handler: srv.router}
+	return srv, nil
+}
+
+// signingKeys returns the keys from the file and the key made of the secret.
+// The secret key is the oldest one, so the newest key of the file signs tokens.
+func signingKeys(secret, keysFile string) ([]usecase.SigningKey, error) {
+	var keys []usecase.SigningKey
+	if secret != "" {
+		keys = append(keys, usecase.SigningKeyFromSecret(secret))
+	}
+	if keysFile != "" {
+		fileKeys, err := usecase.LoadSigningKeys(keysFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, fileKeys...)
+	}
+	return keys, nil
+}
+
+// ReloadSigningKeys rereads the keys file after the keys were rotated
+func (s *APIServer) ReloadSigningKeys() error {
+	if s.jwtKeysFile == "" {
+		return errors.New("keys file is not set")
+	}
+	keys, err := signingKeys(s.jwtSecret, s.jwtKeysFile)
+	if err != nil {
+		return err
+	}
+	if err := s.useCase.User.ReloadSigningKeys(keys); err != nil {
+		return err
+	}
+	s.logger.Info("signing keys reloaded")
+	return nil
 }
 
 func (s *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.router.ServeHTTP(w, r)
 }
 
-// Run starting api server
+// Run starting api server, it returns nil after Shutdown
 func (s *APIServer) Run() error {
 	s.logger.Info("Start server on ", s.addr)
-	return http.ListenAndServe(s.addr, s.router)
+	atomic.StoreInt32(&s.ready, 1)
+	err := s.httpServer.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
 
-func (s *APIServer) Stop() {
+// Shutdown stops the server in order: marks it not ready and keeps serving for the drain delay,
+// so load balancers see the failing readiness probe, stops accepting connections and drains
+// in-flight requests, stops the accrual workers and waits for them, then closes the repository.
+// When ctx expires the remaining steps are still done without waiting, but the repository
+// is left open if the workers haven't stopped.
+func (s *APIServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.ready, 0)
+	s.logger.Info("server is shutting down")
+
+	if s.drainDelay > 0 {
+		timer := time.NewTimer(s.drainDelay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+
+	var errs []string
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Sprintf("drain requests: %s", err))
+	}
 	close(s.done)
-	s.useCase.CloseRepo()
+	if err := s.useCase.WaitWorkers(ctx); err != nil {
+		//the workers may still use the repository
+		errs = append(errs, err.Error())
+	} else {
+		s.useCase.CloseRepo()
+	}
 	s.logger.Info("server stopped")
-	time.Sleep(2 * time.Second)
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
 }
 
 func (s *APIServer) ConfigurateServer() error {
@@ -78,14 +207,18 @@ func (s *APIServer) configureRouter() {
 	s.router = chi.NewRouter()
 
 	s.router.Use(middleware.RequestID)
-	s.router.Use(middleware.RealIP)
+	s.router.Use(s.realIP)
 	s.router.Use(middleware.Logger)
 	s.router.Use(middleware.Recoverer)
 	s.router.Use(middleware.Timeout(60 * time.Second))
+	s.router.Use(s.decompressRequest)
+	s.router.Use(s.compressResponse(s.compressMinSize, DefaultCompressTypes))
 
 	s.router.Get("/", s.handlerF) //test
+	s.router.Get("/ready", s.Readiness)
 	s.router.Post("/api/user/register", s.RegisterUser)
 	s.router.Post("/api/user/login", s.AuthUser)
+	s.router.Post("/api/user/token/refresh", s.RefreshToken)
 
 	if s.prod {
 		s.router.Get("/swagger/*", httpSwagger.Handler(
@@ -97,15 +230,35 @@ func (s *APIServer) configureRouter() {
 		//r.With(s.authenticateUser).Get("/id", s.getUserID)
 		r.Use(s.authenticateUser)
 		r.Get("/id", s.getUserID)
+		r.Post("/logout", s.Logout)
+		r.Put("/password", s.ChangePassword)
 		r.Route("/orders", func(ord chi.Router) {
-			ord.Post("/", s.UploadOrder)
+			ord.With(s.idempotent).Post("/", s.UploadOrder)
 			ord.Get("/", s.GetOrderList)
+			ord.Get("/{number}", s.GetOrder)
 		})
 		r.Get("/withdrawals", s.GetWithdrawals)
 		r.Route("/balance", func(bal chi.Router) {
 			bal.Get("/", s.GetBalance)
-			bal.Post("/withdraw", s.Withdraw)
+			bal.Get("/history", s.GetBalanceHistory)
+			bal.With(s.idempotent).Post("/withdraw", s.Withdraw)
+		})
+	})
+
+	s.router.Route("/api/admin", func(r chi.Router) {
+		r.Use(s.authenticateUser)
+		r.Use(s.requireRole(models.RoleAdmin))
+		r.Get("/users", s.AdminFindUser)
+		r.Route("/users/{userID}", func(usr chi.Router) {
+			usr.Use(s.adminUserExists)
+			usr.Get("/", s.AdminGetUser)
+			usr.Get("/orders", s.AdminGetOrderList)
+			usr.Get("/withdrawals", s.AdminGetWithdrawals)
+			usr.Get("/balance", s.AdminGetBalance)
+			usr.Post("/adjustments", s.AdminAdjustBalance)
+			usr.Get("/adjustments", s.AdminGetAdjustments)
 		})
+		r.Post("/orders/{number}/poll", s.AdminRequeueOrder)
 	})
 }
 
@@ -141,6 +294,11 @@ func (s *APIServer) error(w http.ResponseWriter, r *http.Request, code int, err
 
 func (s *APIServer) errorLog(w http.ResponseWriter, r *http.Request, code int, err error) {
 	s.error(w, r, code, err)
+	s.logError(r, err)
+}
+
+// logError logs the error of the request which can't be reported to the client
+func (s *APIServer) logError(r *http.Request, err error) {
 	reqID, _ := r.Context().Value(middleware.RequestIDKey).(string)
 	s.logger.LogWithFields(logging.ErrorLevel, "handler error:", logging.Fields{
 		"requestID":   reqID,
@@ -154,6 +312,22 @@ func (s *APIServer) handlerF(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "ok")
 }
 
+// Readiness
+// @Summary      Readiness
+// @Description  Readiness probe, the server isn't ready while it's shutting down
+// @Tags         health
+// @Success      200  {string}  string
+// @Failure      503  {string}  string
+// @Router       /ready [get]
+func (s *APIServer) Readiness(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "shutting down")
+		return
+	}
+	io.WriteString(w, "ok")
+}
+
 type requestAuth struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
@@ -179,7 +353,7 @@ func (s *APIServer) RegisterUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := models.User{Login: request.Login, Password: request.Password}
-	err := s.useCase.User.CreateUser(&user)
+	err := s.useCase.User.CreateUser(r.Context(), &user)
 	if err != nil {
 		if errors.Is(err, usecase.ErrLoginAlreadyExists) {
 			s.error(w, r, http.StatusConflict, usecase.ErrLoginAlreadyExists)
@@ -205,8 +379,10 @@ func (s *APIServer) RegisterUser(w http.ResponseWriter, r *http.Request) {
 // @Success      200  {object}  string
 // @Failure      400  {object}  string
 // @Failure      401  {object}  string
+// @Failure      429  {object}  string
 // @Failure      500  {object}  string
 // @Header       200  {string}  Authorization     "token"
+// @Header       429  {integer}  Retry-After     "seconds"
 // @Router       /api/user/login [post]
 func (s *APIServer) AuthUser(w http.ResponseWriter, r *http.Request) {
 	request := &requestAuth{}
@@ -215,9 +391,13 @@ func (s *APIServer) AuthUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := models.User{Login: request.Login, Password: request.Password}
-	err := s.useCase.User.AuthUser(&user)
+	err := s.useCase.User.AuthUser(r.Context(), &user, clientIP(r))
 	if err != nil {
-		if errors.Is(err, usecase.ErrInvalidLoginOrPassword) {
+		var throttled *usecase.LoginThrottledError
+		if errors.As(err, &throttled) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+			s.error(w, r, http.StatusTooManyRequests, usecase.ErrTooManyLoginAttempts)
+		} else if errors.Is(err, usecase.ErrInvalidLoginOrPassword) {
 			s.error(w, r, http.StatusUnauthorized, usecase.ErrInvalidLoginOrPassword)
 		} else {
 			s.errorLog(w, r, http.StatusInternalServerError, err)
@@ -230,14 +410,135 @@ func (s *APIServer) AuthUser(w http.ResponseWriter, r *http.Request) {
 
 //Generate token and set respond
 func (s *APIServer) respondGeneratedToken(w http.ResponseWriter, r *http.Request, user models.User) {
-	token, err := s.useCase.User.GenerateToken(user)
+	pair, err := s.useCase.User.IssueTokens(r.Context(), user)
 	if err != nil {
 		s.errorLog(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	w.Header().Set("Authorization", token)
-	respToken := map[string]string{"token": token}
-	s.respond(w, r, http.StatusOK, respToken)
+	w.Header().Set("Authorization", pair.AccessToken)
+	s.respond(w, r, http.StatusOK, pair)
+}
+
+type requestChangePassword struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+// ChangePassword
+// @Summary      ChangePassword
+// @Security ApiKeyAuth
+// @Description  Change password, all tokens of the user are invalidated and the new tokens are returned
+// @Tags         account
+// @Accept       json
+// @Produce      json
+// @Param        password body requestChangePassword true "old and new password"
+// @Success      200  {object}  usecase.TokenPair
+// @Failure      400  {object}  string
+// @Failure      401  {object}  string
+// @Failure      403  {object}  string
+// @Failure      429  {object}  string
+// @Failure      500  {object}  string
+// @Header       200  {string}  Authorization     "token"
+// @Router       /api/user/password [put]
+func (s *APIServer) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(ctxKeyUserID).(string)
+	if !ok {
+		s.errorLog(w, r, http.StatusInternalServerError, errors.New("invalid type user ID"))
+		return
+	}
+	request := &requestChangePassword{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		s.errorLog(w, r, http.StatusBadRequest, err)
+		return
+	}
+	err := s.useCase.User.ChangePassword(r.Context(), userID, request.OldPassword, request.NewPassword, clientIP(r))
+	if err != nil {
+		var throttled *usecase.LoginThrottledError
+		if errors.As(err, &throttled) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+			s.error(w, r, http.StatusTooManyRequests, usecase.ErrTooManyLoginAttempts)
+		} else if errors.Is(err, usecase.ErrWrongPassword) {
+			s.error(w, r, http.StatusForbidden, usecase.ErrWrongPassword)
+		} else if errors.Is(err, usecase.ErrPasswordTooShort) {
+			s.error(w, r, http.StatusBadRequest, usecase.ErrPasswordTooShort)
+		} else {
+			s.errorLog(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	role, _ := r.Context().Value(ctxKeyRole).(models.Role)
+	s.respondGeneratedToken(w, r, models.User{ID: userID, Role: role})
+}
+
+// clientIP returns address of the client, realIP middleware has already taken it from the headers of trusted proxies
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type requestRefresh struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshToken
+// @Summary      RefreshToken
+// @Description  Exchange refresh token for new access and refresh tokens, the refresh token can be used once
+// @Tags         account
+// @Accept       json
+// @Produce      json
+// @Param        token body requestRefresh true "refresh token"
+// @Success      200  {object}  usecase.TokenPair
+// @Failure      400  {string}  string
+// @Failure      401  {object}  string
+// @Failure      500  {object}  string
+// @Header       200  {string}  Authorization     "token"
+// @Router       /api/user/token/refresh [post]
+func (s *APIServer) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	request := &requestRefresh{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		s.errorLog(w, r, http.StatusBadRequest, err)
+		return
+	}
+	pair, err := s.useCase.User.RefreshTokens(r.Context(), request.RefreshToken)
+	if err != nil {
+		if errors.Is(err, usecase.ErrInvalidRefreshToken) {
+			s.error(w, r, http.StatusUnauthorized, usecase.ErrInvalidRefreshToken)
+		} else {
+			s.errorLog(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	w.Header().Set("Authorization", pair.AccessToken)
+	s.respond(w, r, http.StatusOK, pair)
+}
+
+// Logout
+// @Summary      Logout
+// @Security ApiKeyAuth
+// @Description  Revoke the access token and the refresh tokens of the session
+// @Tags         account
+// @Accept       json
+// @Param        token body requestRefresh false "refresh token of the session"
+// @Success      200
+// @Failure      400  {string}  string
+// @Failure      401  {object}  string
+// @Failure      500  {object}  string
+// @Router       /api/user/logout [post]
+func (s *APIServer) Logout(w http.ResponseWriter, r *http.Request) {
+	request := &requestRefresh{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil && err != io.EOF {
+		s.errorLog(w, r, http.StatusBadRequest, err)
+		return
+	}
+	token, _ := r.Context().Value(ctxKeyToken).(string)
+	if err := s.useCase.User.Logout(r.Context(), token, request.RefreshToken); err != nil {
+		s.errorLog(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.respond(w, r, http.StatusOK, nil)
 }
 
 //middleware for auth user
@@ -258,7 +559,17 @@ func (s *APIServer) authenticateUser(next http.Handler) http.Handler {
 			s.error(w, r, http.StatusUnauthorized, errors.New("invalid token"))
 			return
 		}
+		if err := s.useCase.User.CheckRevoked(r.Context(), claims); err != nil {
+			if errors.Is(err, usecase.ErrTokenRevoked) {
+				s.error(w, r, http.StatusUnauthorized, err)
+			} else {
+				s.errorLog(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
 		ctx := context.WithValue(r.Context(), ctxKeyUserID, claims.UserID)
+		ctx = context.WithValue(ctx, ctxKeyToken, token)
+		ctx = context.WithValue(ctx, ctxKeyRole, claims.UserRole())
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -276,6 +587,7 @@ func (s *APIServer) getUserID(w http.ResponseWriter, r *http.Request) {
 // @Accept       json
 // @Produce      json
 // @Param        order_number body string true "uploading order number"
+// @Param        Idempotency-Key header string false "retries with the key get the first response"
 // @Success      200  {object}  string
 // @Success      202  {object}  string
 // @Failure      400  {object}  string
@@ -305,13 +617,13 @@ func (s *APIServer) UploadOrder(w http.ResponseWriter, r *http.Request) {
 		Number:     models.OrderNumber(body),
 		UploadedAt: time.Now(),
 	}
-	if err := s.useCase.Order.UploadOrder(order); err != nil {
+	if err := s.useCase.Order.UploadOrder(r.Context(), order); err != nil {
 		if errors.Is(err, usecase.ErrOrderAlreadyUploadAnotherUser) {
 			s.error(w, r, http.StatusConflict, usecase.ErrOrderAlreadyUploadAnotherUser)
 		} else if errors.Is(err, usecase.ErrOrderAlreadyUploadThisUser) {
 			s.error(w, r, http.StatusOK, usecase.ErrOrderAlreadyUploadThisUser)
 		} else if errors.Is(err, usecase.ErrInvalidOrderNumber) {
-			s.error(w, r, http.StatusUnprocessableEntity, usecase.ErrInvalidOrderNumber)
+			s.error(w, r, http.StatusUnprocessableEntity, err)
 		} else {
 			s.errorLog(w, r, http.StatusInternalServerError, err)
 		}
@@ -323,14 +635,24 @@ func (s *APIServer) UploadOrder(w http.ResponseWriter, r *http.Request) {
 // GetOrderList
 // @Summary      GetOrderList
 // @Security ApiKeyAuth
-// @Description  Return order list
+// @Description  Return order list. Without parameters all orders are returned, the oldest first.
+// @Description  With any parameter the list is paginated, the next page is in Link and X-Next-Cursor headers.
 // @Tags         orders
 // @Accept       json
 // @Produce      json
+// @Param        status query string false "NEW, PROCESSING, INVALID or PROCESSED, comma separated or repeated"
+// @Param        from   query string false "uploaded from, RFC3339 or YYYY-MM-DD, inclusive"
+// @Param        to     query string false "uploaded before, RFC3339 or YYYY-MM-DD, exclusive"
+// @Param        sort   query string false "asc (default) or desc by uploaded_at"
+// @Param        cursor query string false "X-Next-Cursor of the previous page"
+// @Param        limit  query int    false "page size, 50 by default, 1000 at most"
 // @Success      200  {array}  models.Order
 // @Success      204  {array}	string{}
+// @Failure      400  {object}  string
 // @Failure      401  {object}  int
 // @Failure      500  {object}  int
+// @Header       200  {string}  Link     "next page"
+// @Header       200  {string}  X-Next-Cursor     "cursor of the next page"
 // @Router       /api/user/orders [get]
 func (s *APIServer) GetOrderList(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(ctxKeyUserID).(string)
@@ -338,7 +660,11 @@ func (s *APIServer) GetOrderList(w http.ResponseWriter, r *http.Request) {
 		s.errorLog(w, r, http.StatusInternalServerError, errors.New("invalid type user ID"))
 		return
 	}
-	list, err := s.useCase.Order.GetOrderList(userID)
+	if hasAnyParam(r, orderPageParams...) {
+		s.getOrderPage(w, r, userID)
+		return
+	}
+	list, err := s.useCase.Order.GetOrderList(r.Context(), userID)
 	if err != nil {
 		s.errorLog(w, r, http.StatusInternalServerError, fmt.Errorf("get list order failed: %w", err))
 	} else if len(list) == 0 {
@@ -348,6 +674,85 @@ func (s *APIServer) GetOrderList(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+var orderPageParams = []string{"status", "from", "to", "sort", "cursor", "limit"}
+
+func (s *APIServer) getOrderPage(w http.ResponseWriter, r *http.Request, userID string) {
+	query := models.OrderQuery{Cursor: r.URL.Query().Get("cursor")}
+	for _, status := range listParam(r, "status") {
+		query.Statuses = append(query.Statuses, models.OrderStatus(strings.ToUpper(status)))
+	}
+	switch r.URL.Query().Get("sort") {
+	case "", "asc":
+	case "desc":
+		query.Desc = true
+	default:
+		s.error(w, r, http.StatusBadRequest, errors.New("sort must be asc or desc"))
+		return
+	}
+	var err error
+	if query.From, err = timeParam(r, "from"); err != nil {
+		s.error(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if query.To, err = timeParam(r, "to"); err != nil {
+		s.error(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if query.Limit, err = intParam(r, "limit"); err != nil {
+		s.error(w, r, http.StatusBadRequest, err)
+		return
+	}
+	page, err := s.useCase.Order.GetOrderPage(r.Context(), userID, query)
+	if err != nil {
+		if errors.Is(err, usecase.ErrInvalidOrderStatus) || errors.Is(err, usecase.ErrInvalidCursor) ||
+			errors.Is(err, usecase.ErrInvalidPageLimit) || errors.Is(err, usecase.ErrInvalidPeriod) {
+			s.error(w, r, http.StatusBadRequest, err)
+		} else {
+			s.errorLog(w, r, http.StatusInternalServerError, fmt.Errorf("get order page failed: %w", err))
+		}
+		return
+	}
+	setNextPageHeaders(w, r, page.NextCursor)
+	if len(page.Orders) == 0 {
+		s.respond(w, r, http.StatusNoContent, nil)
+		return
+	}
+	s.respondJSON(w, r, http.StatusOK, page.Orders)
+}
+
+// GetOrder
+// @Summary      GetOrder
+// @Security ApiKeyAuth
+// @Description  Return the user's order with the history of its statuses, the oldest first
+// @Tags         orders
+// @Produce      json
+// @Param        number path string true "order number"
+// @Success      200  {object}  models.OrderDetails
+// @Failure      401  {object}  string
+// @Failure      404  {object}  string
+// @Failure      422  {object}  string
+// @Failure      500  {object}  string
+// @Router       /api/user/orders/{number} [get]
+func (s *APIServer) GetOrder(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(ctxKeyUserID).(string)
+	if !ok {
+		s.errorLog(w, r, http.StatusInternalServerError, errors.New("invalid type user ID"))
+		return
+	}
+	order, err := s.useCase.Order.GetOrder(r.Context(), userID, models.OrderNumber(chi.URLParam(r, "number")))
+	if err != nil {
+		if errors.Is(err, usecase.ErrOrderNotFound) {
+			s.error(w, r, http.StatusNotFound, usecase.ErrOrderNotFound)
+		} else if errors.Is(err, usecase.ErrInvalidOrderNumber) {
+			s.error(w, r, http.StatusUnprocessableEntity, err)
+		} else {
+			s.errorLog(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	s.respondJSON(w, r, http.StatusOK, order)
+}
+
 // GetBalance
 // @Summary      GetBalance
 // @Security ApiKeyAuth
@@ -366,7 +771,7 @@ func (s *APIServer) GetBalance(w http.ResponseWriter, r *http.Request) {
 		s.errorLog(w, r, http.StatusBadRequest, errors.New("invalid type user ID"))
 		return
 	}
-	userBal, err := s.useCase.User.GetUserBalanceAndWithdrawals(userID)
+	userBal, err := s.useCase.User.GetUserBalanceAndWithdrawals(ctx, userID)
 	if err != nil {
 		s.errorLog(w, r, http.StatusInternalServerError, errors.New("internal server error"))
 	} else {
@@ -374,17 +779,83 @@ func (s *APIServer) GetBalance(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GetBalanceHistory
+// @Summary      GetBalanceHistory
+// @Security ApiKeyAuth
+// @Description  Return accruals, withdrawals and adjustments with the balance after each of them, the oldest first.
+// @Description  The next page is requested with next_cursor of the previous one.
+// @Tags         balance
+// @Produce      json
+// @Param        from   query string false "beginning of the period, RFC3339 or YYYY-MM-DD, inclusive"
+// @Param        to     query string false "end of the period, RFC3339 or YYYY-MM-DD, exclusive"
+// @Param        cursor query string false "next_cursor of the previous page"
+// @Param        limit  query int    false "page size, 50 by default, 1000 at most"
+// @Success      200  {object}  models.Statement
+// @Success      204  {object}  string
+// @Failure      400  {object}  string
+// @Failure      401  {object}  string
+// @Failure      500  {object}  string
+// @Router       /api/user/balance/history [get]
+func (s *APIServer) GetBalanceHistory(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(ctxKeyUserID).(string)
+	if !ok {
+		s.errorLog(w, r, http.StatusInternalServerError, errors.New("invalid type user ID"))
+		return
+	}
+	query := models.StatementQuery{Cursor: r.URL.Query().Get("cursor")}
+	var err error
+	if query.From, err = timeParam(r, "from"); err != nil {
+		s.error(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if query.To, err = timeParam(r, "to"); err != nil {
+		s.error(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if query.Limit, err = intParam(r, "limit"); err != nil {
+		s.error(w, r, http.StatusBadRequest, err)
+		return
+	}
+	st, err := s.useCase.User.GetBalanceHistory(r.Context(), userID, query)
+	if err != nil {
+		if errors.Is(err, usecase.ErrInvalidCursor) || errors.Is(err, usecase.ErrInvalidPageLimit) ||
+			errors.Is(err, usecase.ErrInvalidPeriod) {
+			s.error(w, r, http.StatusBadRequest, err)
+		} else {
+			s.errorLog(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	if len(st.Entries) == 0 {
+		s.respond(w, r, http.StatusNoContent, nil)
+		return
+	}
+	s.respondJSON(w, r, http.StatusOK, st)
+}
+
 // GetWithdrawals
 // @Summary      GetWithdrawals
 // @Security ApiKeyAuth
-// @Description  Getting information about withdrawal of funds
+// @Description  Getting information about withdrawal of funds. Without parameters all withdrawals are returned,
+// @Description  with any parameter the list is paginated, the next page is in Link and X-Next-Cursor headers.
+// @Description  With Accept: text/csv the list is returned as CSV.
 // @Tags         orders
 // @Accept       json
 // @Produce      json
+// @Produce      text/csv
+// @Param        from    query string false "processed from, RFC3339 or YYYY-MM-DD, inclusive"
+// @Param        to      query string false "processed before, RFC3339 or YYYY-MM-DD, exclusive"
+// @Param        min_sum query number false "minimum sum"
+// @Param        max_sum query number false "maximum sum"
+// @Param        cursor  query string false "X-Next-Cursor of the previous page"
+// @Param        limit   query int    false "page size, 50 by default, 1000 at most"
 // @Success      200  {object}  []models.OrderWithdraw
-// @Success      204  {object} 	string
+// @Success      204
+// @Failure      400  {object}  string
 // @Failure      401  {object}  string
 // @Failure      500  {object}  string
+// @Header       200  {string}  Link     "next page"
+// @Header       200  {string}  X-Next-Cursor     "cursor of the next page"
 // @Router       /api/user/withdrawals [get]
 func (s *APIServer) GetWithdrawals(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(ctxKeyUserID).(string)
@@ -392,16 +863,61 @@ func (s *APIServer) GetWithdrawals(w http.ResponseWriter, r *http.Request) {
 		s.errorLog(w, r, http.StatusInternalServerError, errors.New("invalid type user ID"))
 		return
 	}
-	userWith, err := s.useCase.Order.GetWithdrawals(userID)
-	if err != nil {
-		s.errorLog(w, r, http.StatusInternalServerError, errors.New("internal server error"))
+	var userWith []models.OrderWithdraw
+	if hasAnyParam(r, withdrawalPageParams...) {
+		query, err := withdrawalQuery(r)
+		if err != nil {
+			s.error(w, r, http.StatusBadRequest, err)
+			return
+		}
+		page, err := s.useCase.Order.GetWithdrawalPage(r.Context(), userID, query)
+		if err != nil {
+			if errors.Is(err, usecase.ErrInvalidSumRange) || errors.Is(err, usecase.ErrInvalidCursor) ||
+				errors.Is(err, usecase.ErrInvalidPageLimit) || errors.Is(err, usecase.ErrInvalidPeriod) {
+				s.error(w, r, http.StatusBadRequest, err)
+			} else {
+				s.errorLog(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+		setNextPageHeaders(w, r, page.NextCursor)
+		userWith = page.Withdrawals
 	} else {
-		if len(userWith) == 0 {
-			s.respond(w, r, http.StatusNoContent, "there are no withdrawals")
-		} else {
-			s.respondJSON(w, r, http.StatusOK, userWith)
+		var err error
+		userWith, err = s.useCase.Order.GetWithdrawals(r.Context(), userID)
+		if err != nil {
+			s.errorLog(w, r, http.StatusInternalServerError, errors.New("internal server error"))
+			return
 		}
 	}
+	if len(userWith) == 0 {
+		s.respond(w, r, http.StatusNoContent, nil)
+	} else if acceptsCSV(r) {
+		s.respondWithdrawalsCSV(w, r, userWith)
+	} else {
+		s.respondJSON(w, r, http.StatusOK, userWith)
+	}
+}
+
+var withdrawalPageParams = []string{"from", "to", "min_sum", "max_sum", "cursor", "limit"}
+
+func withdrawalQuery(r *http.Request) (models.WithdrawalQuery, error) {
+	query := models.WithdrawalQuery{Cursor: r.URL.Query().Get("cursor")}
+	var err error
+	if query.From, err = timeParam(r, "from"); err != nil {
+		return query, err
+	}
+	if query.To, err = timeParam(r, "to"); err != nil {
+		return query, err
+	}
+	if query.MinSum, err = sumParam(r, "min_sum"); err != nil {
+		return query, err
+	}
+	if query.MaxSum, err = sumParam(r, "max_sum"); err != nil {
+		return query, err
+	}
+	query.Limit, err = intParam(r, "limit")
+	return query, err
 }
 
 // Withdraw
@@ -412,8 +928,11 @@ func (s *APIServer) GetWithdrawals(w http.ResponseWriter, r *http.Request) {
 // @Accept       json
 // @Produce      json
 // @Param    	param body models.WithdrawRequest true "order number and sum"
+// @Param        Idempotency-Key header string false "retries with the key get the first response"
 // @Success      200  {object}  string
+// @Failure      400  {object}  string
 // @Failure      401  {object}  string
+// @Failure      409  {object}  string
 // @Failure      402  {object}  string
 // @Failure      422  {object}  string
 // @Failure      500  {object}  string
@@ -429,10 +948,12 @@ func (s *APIServer) Withdraw(w http.ResponseWriter, r *http.Request) {
 		s.errorLog(w, r, http.StatusBadRequest, err) //errors.New("bad request"))
 		return
 	}
-	err := s.useCase.Order.Withdraw(userID, wReq)
+	err := s.useCase.Order.Withdraw(r.Context(), userID, wReq)
 	if err != nil {
 		if errors.Is(err, usecase.ErrInvalidOrderNumber) {
-			s.error(w, r, http.StatusUnprocessableEntity, usecase.ErrInvalidOrderNumber)
+			s.error(w, r, http.StatusUnprocessableEntity, err)
+		} else if errors.Is(err, usecase.ErrInvalidWithdrawSum) {
+			s.error(w, r, http.StatusUnprocessableEntity, usecase.ErrInvalidWithdrawSum)
 		} else if errors.Is(err, usecase.ErrNotEnoughFunds) {
 			s.error(w, r, http.StatusPaymentRequired, usecase.ErrNotEnoughFunds)
 		} else if errors.Is(err, usecase.ErrWithdrawAlreadyExist) {
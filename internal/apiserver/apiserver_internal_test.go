@@ -2,19 +2,32 @@ package apiserver
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
 	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+	"github.com/OlegMzhelskiy/gophermart/internal/usecase"
+	"github.com/OlegMzhelskiy/gophermart/pkg/logging"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var (
 	baseURL         = "http://" + DefaultHost
 	DatabaseTestURL = ""
+	testPostgres    bool //the test database is reachable, otherwise tests run on in-memory store
 )
 
 type args struct {
@@ -35,10 +48,7 @@ type testCase struct {
 }
 
 func TestMain(m *testing.M) {
-	DatabaseTestURL = os.Getenv("databaseTestURL")
-	if DatabaseTestURL == "" {
-		DatabaseTestURL = "host=localhost dbname=gophermart_test user=postgres password=123 sslmode=disable"
-	}
+	DatabaseTestURL, testPostgres = storage.TestDatabaseURL()
 	os.Exit(m.Run())
 }
 
@@ -47,15 +57,23 @@ func NewTestServer() *APIServer {
 	//s, teardown := storage.TestStore(t)
 	//defer teardown
 
-	store, err := storage.NewSQLStore(DatabaseTestURL)
-	if err != nil {
-		log.Fatal(err)
+	store := storage.NewMemStore()
+	if testPostgres {
+		var err error
+		if store, err = storage.NewTestSQLStore(DatabaseTestURL); err != nil {
+			log.Fatal(err)
+		}
 	}
 	cfg := Config{
-		Addr:  DefaultHost,
-		Store: store,
+		Addr:       DefaultHost,
+		Store:      store,
+		Logger:     logging.NewLogger(false),
+		BcryptCost: bcrypt.MinCost,
+	}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		log.Fatal(err)
 	}
-	srv := NewServer(cfg)
 	//srv.ConfigurateServer()
 	return srv
 }
@@ -64,6 +82,58 @@ func (s *APIServer) StopTestServer() {
 	defer s.useCase.CloseRepo()
 }
 
+// newTestRequest returns the request to the API, the string body is sent as is and other bodies as JSON.
+// The token is sent in Authorization header if it's set.
+func newTestRequest(method, path, token string, body interface{}) *http.Request {
+	b := &bytes.Buffer{}
+	switch v := body.(type) {
+	case nil:
+	case string:
+		b.WriteString(v)
+	default:
+		json.NewEncoder(b).Encode(v)
+	}
+	request := httptest.NewRequest(method, baseURL+path, b)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return request
+}
+
+func (s *APIServer) serveRequest(request *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, request)
+	return rec
+}
+
+func (s *APIServer) doRequest(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	return s.serveRequest(newTestRequest(method, path, token, body))
+}
+
+// registerTestUser registers the user with password qwerty123 and returns the user and the tokens of the session
+func (s *APIServer) registerTestUser(t *testing.T, login string) (models.UserInfo, usecase.TokenPair) {
+	rec := s.doRequest(http.MethodPost, "/api/user/register", "", map[string]string{"login": login, "password": "qwerty123"})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	user, err := s.useCase.User.FindUser(context.Background(), login)
+	require.NoError(t, err)
+	return user, decodeTokenPair(t, rec)
+}
+
+// loginTestUser logs in the user registered by registerTestUser
+func (s *APIServer) loginTestUser(t *testing.T, login string) usecase.TokenPair {
+	rec := s.doRequest(http.MethodPost, "/api/user/login", "", map[string]string{"login": login, "password": "qwerty123"})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	return decodeTokenPair(t, rec)
+}
+
+func decodeTokenPair(t *testing.T, rec *httptest.ResponseRecorder) usecase.TokenPair {
+	pair := usecase.TokenPair{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &pair))
+	require.NotEmpty(t, pair.AccessToken)
+	require.NotEmpty(t, pair.RefreshToken)
+	return pair
+}
+
 func TestAPIServer_registerUser(t *testing.T) {
 	srv := NewTestServer()
 	defer srv.StopTestServer()
@@ -108,3 +178,507 @@ func TestAPIServer_registerUser(t *testing.T) {
 		})
 	}
 }
+
+// closeCountingStore counts closing of the repository and may hold the accrual workers
+type closeCountingStore struct {
+	storage.Repository
+	closed int32
+	hold   chan struct{} //ClaimAccrualJobs waits for it ignoring the context if it's set
+}
+
+func (s *closeCountingStore) Close() {
+	atomic.AddInt32(&s.closed, 1)
+	s.Repository.Close()
+}
+
+func (s *closeCountingStore) ClaimAccrualJobs(ctx context.Context, limit int, lease time.Duration) ([]models.AccrualJob, error) {
+	if s.hold != nil {
+		<-s.hold
+	}
+	return s.Repository.ClaimAccrualJobs(ctx, limit, lease)
+}
+
+func TestAPIServer_Shutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	store := &closeCountingStore{Repository: storage.NewMemStore()}
+	srv, err := NewServer(Config{
+		Addr:       addr,
+		Store:      store,
+		Logger:     logging.NewLogger(false),
+		DrainDelay: 300 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	//a handler which holds the request until it's released
+	started, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.Handle("/", srv.router)
+	srv.httpServer.Handler = mux
+
+	//connections opened by the transport in advance stay new and delay the shutdown for 5s
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	runErr := make(chan error, 1)
+	go func() { runErr <- srv.Run() }()
+	require.Eventually(t, func() bool {
+		res, err := client.Get("http://" + addr + "/ready")
+		if err != nil {
+			return false
+		}
+		res.Body.Close()
+		return res.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	slowCode := make(chan int, 1)
+	go func() {
+		res, err := client.Get("http://" + addr + "/slow")
+		if err != nil {
+			slowCode <- 0
+			return
+		}
+		res.Body.Close()
+		slowCode <- res.StatusCode
+	}()
+	<-started
+
+	shutErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutErr <- srv.Shutdown(ctx)
+	}()
+
+	//the probe sees the server isn't ready before the listener is closed
+	assert.Eventually(t, func() bool {
+		res, err := client.Get("http://" + addr + "/ready")
+		if err != nil {
+			return false
+		}
+		res.Body.Close()
+		return res.StatusCode == http.StatusServiceUnavailable
+	}, 200*time.Millisecond, 10*time.Millisecond)
+	//then new connections are refused while the in-flight request is drained
+	assert.Eventually(t, func() bool {
+		res, err := client.Get("http://" + addr + "/ready")
+		if err != nil {
+			return true
+		}
+		res.Body.Close()
+		return false
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case <-shutErr:
+		t.Fatal("shutdown finished before in-flight request")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-slowCode)
+	assert.NoError(t, <-shutErr)
+	assert.NoError(t, <-runErr)
+
+	//workers are already stopped
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, srv.useCase.WaitWorkers(ctx))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&store.closed))
+}
+
+func TestGetDelayValue(t *testing.T) {
+	assert.Equal(t, time.Duration(0), getDelayValue("0", "TEST_DELAY", DefaultDrainDelay))
+	assert.Equal(t, time.Second, getDelayValue("1s", "TEST_DELAY", DefaultDrainDelay))
+	assert.Equal(t, DefaultDrainDelay, getDelayValue("-1s", "TEST_DELAY", DefaultDrainDelay))
+	assert.Equal(t, DefaultDrainDelay, getDelayValue("soon", "TEST_DELAY", DefaultDrainDelay))
+	assert.Equal(t, DefaultDrainDelay, getDelayValue("", "TEST_DELAY", DefaultDrainDelay))
+	t.Setenv("TEST_DELAY", "0")
+	assert.Equal(t, time.Duration(0), getDelayValue("", "TEST_DELAY", DefaultDrainDelay))
+}
+
+func TestAPIServer_ShutdownWorkersTimeout(t *testing.T) {
+	store := &closeCountingStore{Repository: storage.NewMemStore(), hold: make(chan struct{})}
+	srv, err := NewServer(Config{
+		Addr:   "127.0.0.1:0",
+		Store:  store,
+		Logger: logging.NewLogger(false),
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "waiting for accrual workers")
+	//the worker is still running, so the repository stays open
+	assert.Equal(t, int32(0), atomic.LoadInt32(&store.closed))
+
+	close(store.hold)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, srv.useCase.WaitWorkers(ctx))
+}
+
+func TestAPIServer_RefreshAndLogout(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.StopTestServer()
+
+	_, first := srv.registerTestUser(t, "user1")
+
+	rec := srv.doRequest(http.MethodPost, "/api/user/token/refresh", "", map[string]string{"refresh_token": first.RefreshToken})
+	require.Equal(t, http.StatusOK, rec.Code)
+	second := decodeTokenPair(t, rec)
+	assert.Equal(t, second.AccessToken, rec.Header().Get("Authorization"))
+	assert.Equal(t, http.StatusOK, srv.doRequest(http.MethodGet, "/api/user/id", second.AccessToken, nil).Code)
+
+	rec = srv.doRequest(http.MethodPost, "/api/user/token/refresh", "", map[string]string{"refresh_token": "unknown"})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = srv.doRequest(http.MethodPost, "/api/user/logout", second.AccessToken, map[string]string{"refresh_token": second.RefreshToken})
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, http.StatusUnauthorized, srv.doRequest(http.MethodGet, "/api/user/id", second.AccessToken, nil).Code)
+	rec = srv.doRequest(http.MethodPost, "/api/user/token/refresh", "", map[string]string{"refresh_token": second.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	//the first access token isn't revoked, logout without body is allowed
+	assert.Equal(t, http.StatusOK, srv.doRequest(http.MethodPost, "/api/user/logout", first.AccessToken, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, srv.doRequest(http.MethodGet, "/api/user/id", first.AccessToken, nil).Code)
+}
+
+func TestAPIServer_LoginThrottling(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.StopTestServer()
+
+	login := func(password string) *httptest.ResponseRecorder {
+		return srv.doRequest(http.MethodPost, "/api/user/login", "", map[string]string{"login": "user1", "password": password})
+	}
+	srv.registerTestUser(t, "user1")
+
+	for i := 0; i <= usecase.DefaultLoginPolicy.FreeAttempts; i++ {
+		require.Equal(t, http.StatusUnauthorized, login("wrong").Code)
+	}
+	rec := login("qwerty123")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+}
+
+func TestAPIServer_ChangePassword(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.StopTestServer()
+
+	_, session := srv.registerTestUser(t, "user1")
+
+	tests := []struct {
+		name string
+		body map[string]string
+		code int
+	}{
+		{name: "wrong old password", body: map[string]string{"old_password": "wrong", "new_password": "newpassword"}, code: http.StatusForbidden},
+		{name: "short new password", body: map[string]string{"old_password": "qwerty123", "new_password": "123"}, code: http.StatusBadRequest},
+		{name: "changed", body: map[string]string{"old_password": "qwerty123", "new_password": "newpassword"}, code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := srv.doRequest(http.MethodPut, "/api/user/password", session.AccessToken, tt.body)
+			assert.Equal(t, tt.code, rec.Code)
+			if tt.code == http.StatusOK {
+				assert.NotEmpty(t, rec.Header().Get("Authorization"))
+			}
+		})
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, srv.doRequest(http.MethodPost, "/api/user/token/refresh", "",
+		map[string]string{"refresh_token": session.RefreshToken}).Code)
+	assert.Equal(t, http.StatusUnauthorized, srv.doRequest(http.MethodPost, "/api/user/login", "",
+		map[string]string{"login": "user1", "password": "qwerty123"}).Code)
+	assert.Equal(t, http.StatusOK, srv.doRequest(http.MethodPost, "/api/user/login", "",
+		map[string]string{"login": "user1", "password": "newpassword"}).Code)
+}
+
+func TestAPIServer_BalanceHistory(t *testing.T) {
+	ctx := context.Background()
+	srv := NewTestServer()
+	defer srv.StopTestServer()
+
+	user, session := srv.registerTestUser(t, "user1")
+	token := session.AccessToken
+
+	assert.Equal(t, http.StatusNoContent, srv.doRequest(http.MethodGet, "/api/user/balance/history", token, "").Code)
+	_, err := srv.useCase.User.AdjustBalance(ctx, "2", user.ID, models.AdjustmentRequest{Type: "credit", Sum: models.Points(500), Reason: "compensation"})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, srv.doRequest(http.MethodPost, "/api/user/balance/withdraw", token, `{"order":"2377225624","sum":100}`).Code)
+	require.Equal(t, http.StatusOK, srv.doRequest(http.MethodPost, "/api/user/balance/withdraw", token, `{"order":"12345678903","sum":50}`).Code)
+	rec := srv.doRequest(http.MethodPost, "/api/user/balance/withdraw", token, `{"order":"12345678904","sum":50}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), "check digit")
+	for _, sum := range []string{"0", "-1000", "-0.01"} {
+		rec = srv.doRequest(http.MethodPost, "/api/user/balance/withdraw", token, `{"order":"4561261212345467","sum":`+sum+`}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code, sum)
+	}
+
+	rec = srv.doRequest(http.MethodGet, "/api/user/balance/history?limit=2", token, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	page := models.Statement{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	require.Len(t, page.Entries, 2)
+	assert.Equal(t, models.EntryKindAdjustment, page.Entries[0].Kind)
+	assert.Equal(t, models.EntryKindWithdrawal, page.Entries[1].Kind)
+	assert.Equal(t, models.Points(400), page.Entries[1].BalanceAfter)
+	require.NotEmpty(t, page.NextCursor)
+
+	rec = srv.doRequest(http.MethodGet, "/api/user/balance/history?limit=2&cursor="+page.NextCursor, token, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	page = models.Statement{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	require.Len(t, page.Entries, 1)
+	assert.Equal(t, "12345678903", page.Entries[0].Reference)
+	assert.Equal(t, models.Points(350), page.Entries[0].BalanceAfter)
+	assert.Empty(t, page.NextCursor)
+
+	today := time.Now().UTC().Format("2006-01-02")
+	tomorrow := time.Now().UTC().Add(24 * time.Hour).Format("2006-01-02")
+	tests := []struct {
+		name  string
+		query string
+		code  int
+	}{
+		{name: "period", query: "?from=" + today + "&to=" + tomorrow, code: http.StatusOK},
+		{name: "empty period", query: "?from=" + tomorrow, code: http.StatusNoContent},
+		{name: "rfc3339", query: "?to=" + time.Now().Add(-time.Hour).UTC().Format(time.RFC3339), code: http.StatusNoContent},
+		{name: "broken date", query: "?from=yesterday", code: http.StatusBadRequest},
+		{name: "inverted period", query: "?from=" + tomorrow + "&to=" + today, code: http.StatusBadRequest},
+		{name: "broken limit", query: "?limit=ten", code: http.StatusBadRequest},
+		{name: "too big limit", query: "?limit=100000", code: http.StatusBadRequest},
+		{name: "broken cursor", query: "?cursor=abc", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.code, srv.doRequest(http.MethodGet, "/api/user/balance/history"+tt.query, token, "").Code)
+		})
+	}
+}
+
+func TestAPIServer_OrderPage(t *testing.T) {
+	srv := NewTestServer()
+	defer srv.StopTestServer()
+
+	orders := func(rec *httptest.ResponseRecorder) []string {
+		list := []models.Order{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+		numbers := []string{}
+		for _, o := range list {
+			numbers = append(numbers, string(o.Number))
+		}
+		return numbers
+	}
+	_, session := srv.registerTestUser(t, "user1")
+	token := session.AccessToken
+	for _, number := range []string{"12345678903", "2377225624", "49927398716"} {
+		require.Equal(t, http.StatusAccepted, srv.doRequest(http.MethodPost, "/api/user/orders", token, number).Code)
+	}
+
+	//the legacy response has all orders
+	rec := srv.doRequest(http.MethodGet, "/api/user/orders", token, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"12345678903", "2377225624", "49927398716"}, orders(rec))
+	assert.Empty(t, rec.Header().Get("Link"))
+
+	rec = srv.doRequest(http.MethodGet, "/api/user/orders?limit=2&status=new", token, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"12345678903", "2377225624"}, orders(rec))
+	cursor := rec.Header().Get("X-Next-Cursor")
+	require.NotEmpty(t, cursor)
+	link := rec.Header().Get("Link")
+	assert.Contains(t, link, `rel="next"`)
+	assert.Contains(t, link, "cursor="+cursor)
+	assert.Contains(t, link, "status=new")
+
+	rec = srv.doRequest(http.MethodGet, strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`), token, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"49927398716"}, orders(rec))
+	assert.Empty(t, rec.Header().Get("X-Next-Cursor"))
+
+	rec = srv.doRequest(http.MethodGet, "/api/user/orders?sort=desc&limit=1", token, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"49927398716"}, orders(rec))
+
+	tests := []struct {
+		name  string
+		query string
+		code  int
+	}{
+		{name: "other status", query: "?status=PROCESSED,INVALID", code: http.StatusNoContent},
+		{name: "future", query: "?from=" + time.Now().UTC().Add(24*time.Hour).Format("2006-01-02"), code: http.StatusNoContent},
+		{name: "unknown status", query: "?status=DONE", code: http.StatusBadRequest},
+		{name: "unknown sort", query: "?sort=up", code: http.StatusBadRequest},
+		{name: "broken limit", query: "?limit=-1", code: http.StatusBadRequest},
+		{name: "broken cursor", query: "?cursor=abc", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.code, srv.doRequest(http.MethodGet, "/api/user/orders"+tt.query, token, "").Code)
+		})
+	}
+}
+
+func TestAPIServer_Withdrawals(t *testing.T) {
+	ctx := context.Background()
+	srv := NewTestServer()
+	defer srv.StopTestServer()
+
+	do := func(path, token, accept string) *httptest.ResponseRecorder {
+		request := newTestRequest(http.MethodGet, path, token, nil)
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+		return srv.serveRequest(request)
+	}
+	user, session := srv.registerTestUser(t, "user1")
+	token := session.AccessToken
+
+	//there are no withdrawals yet
+	rec := do("/api/user/withdrawals", token, "")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, rec.Body.String())
+
+	_, err := srv.useCase.User.AdjustBalance(ctx, "2", user.ID, models.AdjustmentRequest{Type: "credit", Sum: models.Points(1000), Reason: "goodwill"})
+	require.NoError(t, err)
+	for i, number := range []string{"12345678903", "2377225624", "49927398716"} {
+		wReq := models.WithdrawRequest{OrderNumber: number, Sum: models.Points(int64(100 * (i + 1)))}
+		require.NoError(t, srv.useCase.Order.Withdraw(ctx, user.ID, wReq))
+	}
+
+	rec = do("/api/user/withdrawals", token, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	list := []models.OrderWithdraw{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	assert.Len(t, list, 3)
+
+	rec = do("/api/user/withdrawals?limit=2", token, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	list = []models.OrderWithdraw{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	assert.Len(t, list, 2)
+	cursor := rec.Header().Get("X-Next-Cursor")
+	require.NotEmpty(t, cursor)
+	assert.Contains(t, rec.Header().Get("Link"), "cursor="+cursor)
+
+	rec = do("/api/user/withdrawals?limit=2&cursor="+cursor, token, "text/csv")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", rec.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, "order,sum,processed_at", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "49927398716,300,"), lines[1])
+
+	rec = do("/api/user/withdrawals?min_sum=150&max_sum=250", token, "application/json, text/csv;q=0")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"order": "2377225624"`)
+	assert.NotContains(t, rec.Body.String(), "12345678903")
+
+	tests := []struct {
+		name  string
+		query string
+		code  int
+	}{
+		{name: "no matches", query: "?min_sum=1000", code: http.StatusNoContent},
+		{name: "before", query: "?to=2000-01-01", code: http.StatusNoContent},
+		{name: "inverted sum range", query: "?min_sum=300&max_sum=100", code: http.StatusBadRequest},
+		{name: "broken sum", query: "?max_sum=many", code: http.StatusBadRequest},
+		{name: "broken date", query: "?from=today", code: http.StatusBadRequest},
+		{name: "broken cursor", query: "?cursor=abc", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do("/api/user/withdrawals"+tt.query, token, "")
+			assert.Equal(t, tt.code, rec.Code)
+			if tt.code == http.StatusNoContent {
+				assert.Empty(t, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAPIServer_GetOrder(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemStore()
+	srv, err := NewServer(Config{
+		Addr:       DefaultHost,
+		Store:      store,
+		Logger:     logging.NewLogger(false),
+		BcryptCost: bcrypt.MinCost,
+	})
+	require.NoError(t, err)
+	defer srv.StopTestServer()
+
+	tokens := make([]string, 2)
+	users := make([]models.UserInfo, 2)
+	for i := range users {
+		var session usecase.TokenPair
+		users[i], session = srv.registerTestUser(t, fmt.Sprintf("user%d", i+1))
+		tokens[i] = session.AccessToken
+	}
+	require.NoError(t, srv.useCase.Order.UploadOrder(ctx, models.Order{Number: "12345678903", UserID: users[0].ID, UploadedAt: time.Now()}))
+	require.NoError(t, store.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.OrderStatusProcessing}))
+	require.NoError(t, store.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.OrderStatusProcessed, Accrual: models.Points(500)}))
+	//the final status doesn't change
+	err = store.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.OrderStatusInvalid})
+	require.ErrorIs(t, err, storage.ErrOrderStatusConflict)
+
+	rec := srv.doRequest(http.MethodGet, "/api/user/orders/12345678903", tokens[0], nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var order struct {
+		Number  string  `json:"number"`
+		Status  string  `json:"status"`
+		Accrual float64 `json:"accrual"`
+		History []struct {
+			Status    string    `json:"status"`
+			ChangedAt time.Time `json:"changed_at"`
+		} `json:"history"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &order))
+	assert.Equal(t, "12345678903", order.Number)
+	assert.Equal(t, "PROCESSED", order.Status)
+	assert.Equal(t, 500.0, order.Accrual)
+	statuses := []string{}
+	for _, change := range order.History {
+		statuses = append(statuses, change.Status)
+		assert.False(t, change.ChangedAt.IsZero())
+	}
+	assert.Equal(t, []string{"NEW", "PROCESSING", "PROCESSED"}, statuses)
+
+	//the number is normalized as on upload
+	rec = srv.doRequest(http.MethodGet, "/api/user/orders/1234-5678-903", tokens[0], nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &order))
+	assert.Equal(t, "12345678903", order.Number)
+	assert.Equal(t, http.StatusUnprocessableEntity, srv.doRequest(http.MethodGet, "/api/user/orders/12345678904", tokens[0], nil).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, srv.doRequest(http.MethodGet, "/api/user/orders/abc", tokens[0], nil).Code)
+
+	//the order of another user and the unknown order aren't found
+	assert.Equal(t, http.StatusNotFound, srv.doRequest(http.MethodGet, "/api/user/orders/12345678903", tokens[1], nil).Code)
+	assert.Equal(t, http.StatusNotFound, srv.doRequest(http.MethodGet, "/api/user/orders/79927398713", tokens[0], nil).Code)
+}
+
+func TestNewServer_SigningKeys(t *testing.T) {
+	//production server doesn't start with a random key
+	_, err := NewServer(Config{Addr: DefaultHost, Store: storage.NewMemStore(), Logger: logging.NewLogger(false), Prod: true})
+	assert.ErrorIs(t, err, ErrNoSigningKeys)
+	_, err = NewServer(Config{Addr: DefaultHost, Store: storage.NewMemStore(), Logger: logging.NewLogger(false), Prod: true,
+		JWTKeysFile: filepath.Join(t.TempDir(), "missing.json")})
+	assert.ErrorIs(t, err, ErrNoSigningKeys)
+
+	srv, err := NewServer(Config{Addr: DefaultHost, Store: storage.NewMemStore(), Logger: logging.NewLogger(false), Prod: true, JWTSecret: "secret"})
+	require.NoError(t, err)
+	srv.StopTestServer()
+
+	srv, err = NewServer(Config{Addr: DefaultHost, Store: storage.NewMemStore(), Logger: logging.NewLogger(false)})
+	require.NoError(t, err)
+	srv.StopTestServer()
+}
@@ -0,0 +1,271 @@
+package apiserver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+)
+
+var (
+	// DefaultCompressMinSize is the smallest response body which is compressed
+	DefaultCompressMinSize = 1024
+	// DefaultMaxBodySize is the largest decoded body of compressed request
+	DefaultMaxBodySize = 1 << 20
+	// DefaultCompressTypes are content types of compressible responses
+	DefaultCompressTypes = []string{"application/json", "text/plain", "text/html", "text/csv"}
+)
+
+// decompressRequest replaces the body of request sent with Content-Encoding gzip or deflate by the decoded one.
+// The body is decoded up front, so a body larger than maxBodySize is rejected with 413 before the handler reads it.
+func (s *APIServer) decompressRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		var body io.ReadCloser
+		switch encoding {
+		case "", "identity":
+			next.ServeHTTP(w, r)
+			return
+		case encodingGzip, "x-gzip":
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				s.error(w, r, http.StatusBadRequest, fmt.Errorf("decode gzip body failed: %w", err))
+				return
+			}
+			body = zr
+		case encodingDeflate:
+			body = flate.NewReader(r.Body)
+		default:
+			s.error(w, r, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content encoding %q", encoding))
+			return
+		}
+		defer body.Close()
+
+		//a few kilobytes of gzip may decode into gigabytes
+		decoded, err := io.ReadAll(io.LimitReader(body, int64(s.maxBodySize)+1))
+		if err != nil {
+			s.error(w, r, http.StatusBadRequest, fmt.Errorf("decode %s body failed: %w", encoding, err))
+			return
+		}
+		if len(decoded) > s.maxBodySize {
+			s.error(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("decoded body is larger than %d bytes", s.maxBodySize))
+			return
+		}
+		r.Body = &decodedBody{Reader: bytes.NewReader(decoded), orig: r.Body}
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = int64(len(decoded))
+		next.ServeHTTP(w, r)
+	})
+}
+
+type decodedBody struct {
+	io.Reader
+	orig io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	return b.orig.Close()
+}
+
+// compressResponse compresses responses of allowed content types which are not smaller than minSize,
+// encoding is chosen by Accept-Encoding of the request
+func (s *APIServer) compressResponse(minSize int, types []string) func(http.Handler) http.Handler {
+	allowed := make(map[string]struct{}, len(types))
+	for _, t := range types {
+		allowed[strings.ToLower(t)] = struct{}{}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+			if encoding == "" || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize, allowed: allowed}
+			defer cw.Close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// negotiateEncoding returns gzip or deflate accepted by the client, gzip is preferred at equal quality
+func negotiateEncoding(header string) string {
+	quality := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		if name, q := parseCoding(part); name != "" {
+			quality[name] = q
+		}
+	}
+	var best string
+	var bestQ float64
+	for _, name := range []string{encodingGzip, encodingDeflate} {
+		q, ok := quality[name]
+		if !ok {
+			q = quality["*"]
+		}
+		if q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// parseCoding parses "gzip;q=0.8" and returns the coding with its quality
+func parseCoding(part string) (string, float64) {
+	fields := strings.Split(part, ";")
+	name := strings.ToLower(strings.TrimSpace(fields[0]))
+	q := 1.0
+	for _, param := range fields[1:] {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "q=") {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+		if err != nil {
+			return name, 0
+		}
+		q = v
+	}
+	return name, q
+}
+
+// compressWriter buffers the beginning of the body until it's known whether it's worth compressing
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	allowed  map[string]struct{}
+
+	code    int
+	buf     []byte
+	decided bool
+	zw      io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.code != 0 {
+		return
+	}
+	w.code = code
+	//there is no body to compress, the headers may be sent right now
+	if !bodyAllowed(code) {
+		w.decided = true
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	if w.decided {
+		if w.zw != nil {
+			return w.zw.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.minSize {
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide sends the headers and the buffered body, compressed or not
+func (w *compressWriter) decide() error {
+	w.decided = true
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if len(w.buf) >= w.minSize && h.Get("Content-Encoding") == "" && w.compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		if w.encoding == encodingGzip {
+			w.zw = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			zw, err := flate.NewWriter(w.ResponseWriter, flate.DefaultCompression)
+			if err != nil {
+				return err
+			}
+			w.zw = zw
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	buf := w.buf
+	w.buf = nil
+	if w.zw != nil {
+		_, err := w.zw.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+func (w *compressWriter) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	_, ok := w.allowed[mediaType]
+	return ok
+}
+
+// Close flushes the rest of the body, it's called when the handler returns
+func (w *compressWriter) Close() error {
+	if !w.decided {
+		if w.code == 0 {
+			return nil //nothing was written, net/http answers 200 itself
+		}
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
+	if w.zw != nil {
+		return w.zw.Close()
+	}
+	return nil
+}
+
+func (w *compressWriter) Flush() {
+	if !w.decided && w.code != 0 {
+		w.decide()
+	}
+	if f, ok := w.zw.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("response writer doesn't support hijacking")
+}
+
+func bodyAllowed(code int) bool {
+	return (code < 100 || code > 199) && code != http.StatusNoContent && code != http.StatusNotModified
+}
@@ -0,0 +1,221 @@
+package apiserver
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+	"github.com/OlegMzhelskiy/gophermart/pkg/logging"
+)
+
+func encodeBody(t *testing.T, encoding string, body []byte) []byte {
+	b := &bytes.Buffer{}
+	var zw io.WriteCloser
+	switch encoding {
+	case encodingGzip:
+		zw = gzip.NewWriter(b)
+	case encodingDeflate:
+		var err error
+		zw, err = flate.NewWriter(b, flate.DefaultCompression)
+		require.NoError(t, err)
+	default:
+		return body
+	}
+	_, err := zw.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return b.Bytes()
+}
+
+func decodeBody(t *testing.T, rec *httptest.ResponseRecorder) []byte {
+	var r io.Reader = rec.Body
+	switch rec.Header().Get("Content-Encoding") {
+	case encodingGzip:
+		zr, err := gzip.NewReader(rec.Body)
+		require.NoError(t, err)
+		r = zr
+	case encodingDeflate:
+		r = flate.NewReader(rec.Body)
+	}
+	body, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return body
+}
+
+// every /api/user endpoint accepts compressed requests and answers compressed responses
+func TestAPIServer_Compression(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemStore()
+	srv, err := NewServer(Config{
+		Addr:            DefaultHost,
+		Store:           store,
+		Logger:          logging.NewLogger(false),
+		CompressMinSize: 1,
+		BcryptCost:      bcrypt.MinCost,
+	})
+	require.NoError(t, err)
+	defer srv.StopTestServer()
+
+	var token string
+	do := func(t *testing.T, method, path, encoding string, body string) *httptest.ResponseRecorder {
+		request := newTestRequest(method, path, token, string(encodeBody(t, encoding, []byte(body))))
+		if body != "" && encoding != "" {
+			request.Header.Set("Content-Encoding", encoding)
+		}
+		request.Header.Set("Accept-Encoding", encoding)
+		rec := srv.serveRequest(request)
+		if rec.Body.Len() > 0 {
+			assert.Equal(t, encoding, rec.Header().Get("Content-Encoding"))
+		}
+		return rec
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		encoding string
+		body     string
+		code     int
+		contains string
+	}{
+		{"register", http.MethodPost, "/api/user/register", encodingGzip, `{"login":"user1","password":"qwerty123"}`, http.StatusOK, `"token"`},
+		{"login", http.MethodPost, "/api/user/login", encodingDeflate, `{"login":"user1","password":"qwerty123"}`, http.StatusOK, `"token"`},
+		{"user id", http.MethodGet, "/api/user/id", encodingGzip, "", http.StatusOK, `"1"`},
+		{"upload order", http.MethodPost, "/api/user/orders", encodingGzip, "12345678903", http.StatusAccepted, ""},
+		{"order list", http.MethodGet, "/api/user/orders", encodingDeflate, "", http.StatusOK, `"number": "12345678903"`},
+		{"withdraw", http.MethodPost, "/api/user/balance/withdraw", encodingDeflate, `{"order":"2377225624","sum":100}`, http.StatusOK, ""},
+		{"balance", http.MethodGet, "/api/user/balance", encodingGzip, "", http.StatusOK, `"current": 400`},
+		{"withdrawals", http.MethodGet, "/api/user/withdrawals", encodingGzip, "", http.StatusOK, `"order": "2377225624"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(t, tt.method, tt.path, tt.encoding, tt.body)
+			require.Equal(t, tt.code, rec.Code, rec.Body.String())
+			body := decodeBody(t, rec)
+			assert.Contains(t, string(body), tt.contains)
+
+			switch tt.name {
+			case "register":
+				resp := map[string]string{}
+				require.NoError(t, json.Unmarshal(body, &resp))
+				token = resp["token"]
+			case "upload order":
+				//the accrual system has calculated the order
+				err := store.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.OrderStatusProcessed, Accrual: models.Points(500)})
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAPIServer_CompressResponse(t *testing.T) {
+	srv := &APIServer{}
+	body := strings.Repeat(`{"status":"PROCESSED"}`, 100)
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		body           string
+		encoding       string
+	}{
+		{name: "gzip", acceptEncoding: "gzip", contentType: "application/json", body: body, encoding: "gzip"},
+		{name: "deflate", acceptEncoding: "deflate", contentType: "application/json; charset=utf-8", body: body, encoding: "deflate"},
+		{name: "not accepted", acceptEncoding: "", contentType: "application/json", body: body},
+		{name: "too small", acceptEncoding: "gzip", contentType: "application/json", body: `{"status":"NEW"}`},
+		{name: "not allowed type", acceptEncoding: "gzip", contentType: "image/png", body: body},
+		{name: "detected type", acceptEncoding: "gzip", body: strings.Repeat("ok ", 500), encoding: "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := srv.compressResponse(512, DefaultCompressTypes)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				//the body is written in parts
+				io.WriteString(w, tt.body[:len(tt.body)/2])
+				io.WriteString(w, tt.body[len(tt.body)/2:])
+			}))
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, request)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, tt.encoding, rec.Header().Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+			assert.Equal(t, tt.body, string(decodeBody(t, rec)))
+		})
+	}
+}
+
+func TestAPIServer_DecompressRequest(t *testing.T) {
+	srv := &APIServer{logger: logging.NewLogger(false), maxBodySize: 1024}
+	h := srv.decompressRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write(body)
+	}))
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		code     int
+	}{
+		{name: "plain", body: []byte("12345678903"), code: http.StatusOK},
+		{name: "gzip", encoding: "gzip", body: encodeBody(t, encodingGzip, []byte("12345678903")), code: http.StatusOK},
+		{name: "deflate", encoding: "deflate", body: encodeBody(t, encodingDeflate, []byte("12345678903")), code: http.StatusOK},
+		{name: "broken gzip", encoding: "gzip", body: []byte("12345678903"), code: http.StatusBadRequest},
+		{name: "unsupported", encoding: "br", body: []byte("12345678903"), code: http.StatusUnsupportedMediaType},
+		{name: "gzip bomb", encoding: "gzip", body: encodeBody(t, encodingGzip, make([]byte, 10<<20)), code: http.StatusRequestEntityTooLarge},
+		{name: "deflate bomb", encoding: "deflate", body: encodeBody(t, encodingDeflate, make([]byte, 1025)), code: http.StatusRequestEntityTooLarge},
+		{name: "largest", encoding: "gzip", body: encodeBody(t, encodingGzip, []byte("12345678903"+strings.Repeat(" ", 1024-11))), code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tt.body))
+			request.Header.Set("Content-Encoding", tt.encoding)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, request)
+
+			assert.Equal(t, tt.code, rec.Code)
+			if tt.code == http.StatusOK {
+				assert.Equal(t, "12345678903", strings.TrimSpace(rec.Body.String()))
+			}
+		})
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                        "",
+		"identity":                "",
+		"gzip":                    "gzip",
+		"deflate":                 "deflate",
+		"gzip, deflate, br":       "gzip",
+		"deflate;q=1, gzip;q=0.5": "deflate",
+		"gzip;q=0, deflate":       "deflate",
+		"*":                       "gzip",
+		"gzip;q=0, *;q=0.1":       "deflate",
+		"br;q=1.0":                "",
+	}
+	for header, want := range tests {
+		assert.Equal(t, want, negotiateEncoding(header), header)
+	}
+}
@@ -4,24 +4,57 @@ import (
 	"flag"
 	"github.com/OlegMzhelskiy/gophermart/pkg/logging"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+	"github.com/OlegMzhelskiy/gophermart/internal/usecase"
 )
 
 type Config struct {
-	Addr      string
-	DBDSN     string
-	AcSysAddr string
-	Store     storage.Repository
-	Logger    logging.Loggerer
-	Prod      bool
+	Addr                string
+	DBDSN               string
+	StorageType         string
+	AcSysAddr           string
+	AccrualWorkers      int
+	AccrualPollInterval time.Duration
+	ShutdownTimeout     time.Duration //time to drain requests and stop workers
+	DrainDelay          time.Duration //time the server keeps serving after it's marked not ready on shutdown
+	CompressMinSize     int           //smallest response body which is compressed
+	MaxBodySize         int           //largest decoded body of compressed request
+	TrustedProxies      []string      //CIDRs of proxies whose X-Forwarded-For and X-Real-IP are trusted
+	JWTSecret           string        //secret for signing tokens
+	JWTKeysFile         string        //JSON file with rotated signing keys
+	TokenTTL            time.Duration //lifetime of access token
+	RefreshTokenTTL     time.Duration
+	BcryptCost          int           //cost of password hashes
+	IdempotencyTTL      time.Duration //how long responses to requests with Idempotency-Key are replayed
+	OrderNumberSchemes  []string      //accepted check digit schemes of order numbers
+	Store               storage.Repository
+	Logger              logging.Loggerer
+	Prod                bool
 }
 
 func NewConfig() Config {
 	flagHost := flag.String("a", "", "server address")
 	flagDBDSN := flag.String("d", "", "DB connection")
 	flagASAddr := flag.String("r", "", "accrual system address")
+	flagStorage := flag.String("s", "", "storage type: postgres or memory")
+	flagWorkers := flag.String("workers", "", "number of workers requesting accrual system")
+	flagPollInterval := flag.String("poll-interval", "", "interval of checking orders in accrual system, e.g. 5s")
+	flagShutdownTimeout := flag.String("shutdown-timeout", "", "time to finish requests and workers on shutdown, e.g. 10s")
+	flagDrainDelay := flag.String("drain-delay", "", "time to serve requests after readiness probe fails on shutdown, e.g. 5s, 0 closes listeners at once")
+	flagCompressMinSize := flag.String("compress-min-size", "", "smallest response body in bytes which is compressed")
+	flagMaxBodySize := flag.String("max-body-size", "", "largest decoded body of compressed request in bytes")
+	flagTrustedProxies := flag.String("trusted-proxies", "", "comma separated CIDRs of proxies setting X-Forwarded-For, e.g. 10.0.0.0/8")
+	flagJWTSecret := flag.String("jwt-secret", "", "secret for signing tokens")
+	flagJWTKeysFile := flag.String("jwt-keys", "", "JSON file with signing keys, see gophermart jwt rotate")
+	flagTokenTTL := flag.String("token-ttl", "", "access token lifetime, e.g. 15m")
+	flagRefreshTokenTTL := flag.String("refresh-token-ttl", "", "refresh token lifetime, e.g. 720h")
+	flagBcryptCost := flag.String("bcrypt-cost", "", "cost of password hashes")
+	flagIdempotencyTTL := flag.String("idempotency-ttl", "", "how long responses to requests with Idempotency-Key are replayed, e.g. 24h")
+	flagOrderSchemes := flag.String("order-schemes", "", "comma separated check digit schemes of order numbers: luhn, verhoeff, damm, ean")
 	flagProd := flag.Bool("prod", false, "product logging mode")
 	flag.Parse()
 
@@ -39,16 +72,46 @@ func NewConfig() Config {
 	addr := getVarValue(*flagHost, "RUN_ADDRESS", DefaultHost)
 	dbDSN := getVarValue(*flagDBDSN, "DATABASE_URI", DefaultDBDSN)
 	asAddr := getVarValue(*flagASAddr, "ACCRUAL_SYSTEM_ADDRESS", "http://localhost:8080")
+	storageType := getVarValue(*flagStorage, "STORAGE_TYPE", storage.TypePostgres)
+	workers := getIntValue(*flagWorkers, "ACCRUAL_WORKERS", usecase.DefaultWorkers)
+	pollInterval := getDurationValue(*flagPollInterval, "ACCRUAL_POLL_INTERVAL", usecase.DefaultPollInterval)
+	shutdownTimeout := getDurationValue(*flagShutdownTimeout, "SHUTDOWN_TIMEOUT", DefaultShutdownTimeout)
+	drainDelay := getDelayValue(*flagDrainDelay, "SHUTDOWN_DRAIN_DELAY", DefaultDrainDelay)
+	compressMinSize := getIntValue(*flagCompressMinSize, "COMPRESS_MIN_SIZE", DefaultCompressMinSize)
+	maxBodySize := getIntValue(*flagMaxBodySize, "MAX_BODY_SIZE", DefaultMaxBodySize)
+	trustedProxies := getListValue(*flagTrustedProxies, "TRUSTED_PROXIES")
+	jwtSecret := getVarValue(*flagJWTSecret, "JWT_SECRET", "")
+	jwtKeysFile := getVarValue(*flagJWTKeysFile, "JWT_KEYS_FILE", "")
+	tokenTTL := getDurationValue(*flagTokenTTL, "TOKEN_TTL", usecase.DefaultTokenTTL)
+	bcryptCost := getIntValue(*flagBcryptCost, "BCRYPT_COST", usecase.DefaultBcryptCost)
+	refreshTokenTTL := getDurationValue(*flagRefreshTokenTTL, "REFRESH_TOKEN_TTL", usecase.DefaultRefreshTokenTTL)
+	idempotencyTTL := getDurationValue(*flagIdempotencyTTL, "IDEMPOTENCY_TTL", usecase.DefaultIdempotencyTTL)
+	orderSchemes := getListValue(*flagOrderSchemes, "ORDER_NUMBER_SCHEMES")
 
 	log := logging.NewLogger(*flagProd)
 
 	cfg := Config{
-		Addr:      addr,
-		DBDSN:     dbDSN,
-		AcSysAddr: asAddr,
+		Addr:        addr,
+		DBDSN:       dbDSN,
+		StorageType: storageType,
+		AcSysAddr:   asAddr,
 		//Store: store,
-		Logger: log,
-		Prod:   *flagProd,
+		AccrualWorkers:      workers,
+		AccrualPollInterval: pollInterval,
+		ShutdownTimeout:     shutdownTimeout,
+		DrainDelay:          drainDelay,
+		CompressMinSize:     compressMinSize,
+		MaxBodySize:         maxBodySize,
+		TrustedProxies:      trustedProxies,
+		JWTSecret:           jwtSecret,
+		JWTKeysFile:         jwtKeysFile,
+		TokenTTL:            tokenTTL,
+		RefreshTokenTTL:     refreshTokenTTL,
+		BcryptCost:          bcryptCost,
+		IdempotencyTTL:      idempotencyTTL,
+		OrderNumberSchemes:  orderSchemes,
+		Logger:              log,
+		Prod:                *flagProd,
 	}
 	return cfg
 }
@@ -64,3 +127,41 @@ func getVarValue(flagValue, envVarName, defValue string) string {
 	}
 	return varVal
 }
+
+// getListValue splits the comma separated value, it's nil if the value is not set
+func getListValue(flagValue, envVarName string) []string {
+	var list []string
+	for _, item := range strings.Split(getVarValue(flagValue, envVarName, ""), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getIntValue returns defValue if the value is not set or isn't a positive number
+func getIntValue(flagValue, envVarName string, defValue int) int {
+	n, err := strconv.Atoi(getVarValue(flagValue, envVarName, strconv.Itoa(defValue)))
+	if err != nil || n < 1 {
+		return defValue
+	}
+	return n
+}
+
+// getDurationValue returns defValue if the value is not set or isn't a positive duration
+func getDurationValue(flagValue, envVarName string, defValue time.Duration) time.Duration {
+	d, err := time.ParseDuration(getVarValue(flagValue, envVarName, defValue.String()))
+	if err != nil || d <= 0 {
+		return defValue
+	}
+	return d
+}
+
+// getDelayValue returns defValue if the value is not set or isn't a duration, 0 means no delay
+func getDelayValue(flagValue, envVarName string, defValue time.Duration) time.Duration {
+	d, err := time.ParseDuration(getVarValue(flagValue, envVarName, defValue.String()))
+	if err != nil || d < 0 {
+		return defValue
+	}
+	return d
+}
@@ -0,0 +1,48 @@
+package apiserver
+
+import (
+	"encoding/csv"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+)
+
+const contentTypeCSV = "text/csv"
+
+// acceptsCSV reports whether the client asked for CSV explicitly, wildcards keep JSON
+func acceptsCSV(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil || mediaType != contentTypeCSV {
+				continue
+			}
+			if q, ok := params["q"]; ok {
+				if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (s *APIServer) respondWithdrawalsCSV(w http.ResponseWriter, r *http.Request, list []models.OrderWithdraw) {
+	w.Header().Set("Content-Type", contentTypeCSV+"; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="withdrawals.csv"`)
+	w.WriteHeader(http.StatusOK)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"order", "sum", "processed_at"})
+	for _, wd := range list {
+		cw.Write([]string{wd.OrderNumber, wd.Sum.String(), wd.ProcessedAt.Format(time.RFC3339)})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		s.logger.Error(err)
+	}
+}
@@ -0,0 +1,148 @@
+package apiserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+	"github.com/OlegMzhelskiy/gophermart/internal/usecase"
+)
+
+const (
+	headerIdempotencyKey     = "Idempotency-Key"
+	headerIdempotentReplayed = "Idempotent-Replayed"
+	idempotencyStoreTimeout  = 5 * time.Second
+)
+
+// headers set by other middlewares, they aren't replayed
+var skippedReplayHeaders = map[string]struct{}{
+	"Content-Encoding": {},
+	"Content-Length":   {},
+	"Vary":             {},
+}
+
+// middleware replays the first response to the user's request with the same Idempotency-Key,
+// requests without the header are passed as is
+func (s *APIServer) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(headerIdempotencyKey)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		userID, ok := r.Context().Value(ctxKeyUserID).(string)
+		if !ok {
+			s.errorLog(w, r, http.StatusInternalServerError, errors.New("invalid type user ID"))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.errorLog(w, r, http.StatusBadRequest, fmt.Errorf("read body failed: %w", err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		reservation, err := s.useCase.Idempotency.Begin(r.Context(), userID, key, requestHash(r, body))
+		if err != nil {
+			switch {
+			case errors.Is(err, usecase.ErrInvalidIdempotencyKey):
+				s.error(w, r, http.StatusBadRequest, err)
+			case errors.Is(err, usecase.ErrIdempotencyKeyReused):
+				s.error(w, r, http.StatusUnprocessableEntity, err)
+			case errors.Is(err, usecase.ErrIdempotencyKeyInProgress):
+				s.error(w, r, http.StatusConflict, err)
+			default:
+				s.errorLog(w, r, http.StatusInternalServerError, err)
+			}
+			return
+		}
+		if reservation.Done() {
+			replayResponse(w, reservation)
+			return
+		}
+
+		//the response is stored even if the client has gone, so the context of the request isn't used
+		ctx, cancel := context.WithTimeout(context.Background(), idempotencyStoreTimeout)
+		defer cancel()
+		rec := &recordingWriter{ResponseWriter: w}
+		defer func() {
+			if p := recover(); p != nil {
+				s.releaseIdempotencyKey(ctx, r, reservation)
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+			//the request failed, the client may repeat it
+			s.releaseIdempotencyKey(ctx, r, reservation)
+			return
+		}
+		resp := reservation
+		resp.Status, resp.Header, resp.Body = rec.status, rec.header, rec.body.Bytes()
+		if err := s.useCase.Idempotency.Complete(ctx, resp); err != nil {
+			//the response isn't stored, so the key is released and the client may repeat the request
+			s.logError(r, err)
+			s.releaseIdempotencyKey(ctx, r, reservation)
+		}
+	})
+}
+
+func (s *APIServer) releaseIdempotencyKey(ctx context.Context, r *http.Request, reservation models.IdempotentResponse) {
+	if err := s.useCase.Idempotency.Abort(ctx, reservation); err != nil {
+		s.logError(r, err)
+	}
+}
+
+// requestHash is the fingerprint of the request, the key reused with another request is rejected
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func replayResponse(w http.ResponseWriter, resp models.IdempotentResponse) {
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(headerIdempotentReplayed, "true")
+	w.WriteHeader(resp.Status)
+	w.Write(resp.Body)
+}
+
+// recordingWriter copies the response of the handler
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	header models.ResponseHeader
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		w.header = models.ResponseHeader{}
+		for name, values := range w.ResponseWriter.Header() {
+			if _, ok := skippedReplayHeaders[name]; !ok {
+				w.header[name] = append([]string(nil), values...)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
@@ -0,0 +1,122 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+	"github.com/OlegMzhelskiy/gophermart/pkg/logging"
+)
+
+func TestAPIServer_Idempotency(t *testing.T) {
+	ctx := context.Background()
+	srv := NewTestServer()
+	defer srv.StopTestServer()
+
+	do := func(path, token, key, body string) *httptest.ResponseRecorder {
+		request := newTestRequest(http.MethodPost, path, token, body)
+		if key != "" {
+			request.Header.Set("Idempotency-Key", key)
+		}
+		return srv.serveRequest(request)
+	}
+	user, session := srv.registerTestUser(t, "user1")
+	token := session.AccessToken
+	_, session2 := srv.registerTestUser(t, "user2")
+	token2 := session2.AccessToken
+	_, err := srv.useCase.User.AdjustBalance(ctx, "2", user.ID, models.AdjustmentRequest{Type: "credit", Sum: models.Points(1000), Reason: "goodwill"})
+	require.NoError(t, err)
+
+	const withdraw = `{"order":"2377225624","sum":100}`
+	rec := do("/api/user/balance/withdraw", token, "key1", withdraw)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Idempotent-Replayed"))
+
+	//the retry gets the first response, the balance is debited once
+	rec = do("/api/user/balance/withdraw", token, "key1", withdraw)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+	bal, err := srv.useCase.User.GetUserBalanceAndWithdrawals(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Points(900), bal.Balance)
+
+	//the retry without the key repeats the request
+	assert.Equal(t, http.StatusBadRequest, do("/api/user/balance/withdraw", token, "", withdraw).Code)
+
+	//the key is reused with another request
+	assert.Equal(t, http.StatusUnprocessableEntity, do("/api/user/balance/withdraw", token, "key1", `{"order":"2377225624","sum":200}`).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, do("/api/user/orders", token, "key1", withdraw).Code)
+
+	//errors are replayed too
+	rec = do("/api/user/balance/withdraw", token, "key2", `{"order":"12345678903","sum":5000}`)
+	require.Equal(t, http.StatusPaymentRequired, rec.Code)
+	first := rec.Body.String()
+	rec = do("/api/user/balance/withdraw", token, "key2", `{"order":"12345678903","sum":5000}`)
+	assert.Equal(t, http.StatusPaymentRequired, rec.Code)
+	assert.Equal(t, first, rec.Body.String())
+	assert.Equal(t, "application/json; charset=utf-8", rec.Header().Get("Content-Type"))
+
+	rec = do("/api/user/orders", token, "key3", "79927398713")
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	rec = do("/api/user/orders", token, "key3", "79927398713")
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, "true", rec.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, http.StatusOK, do("/api/user/orders", token, "", "79927398713").Code)
+
+	//keys of another user don't clash
+	rec = do("/api/user/balance/withdraw", token2, "key1", withdraw)
+	assert.Equal(t, http.StatusPaymentRequired, rec.Code)
+	assert.Empty(t, rec.Header().Get("Idempotent-Replayed"))
+
+	//the first request is still in progress
+	hash := requestHash(httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", nil), []byte(withdraw))
+	_, err = srv.useCase.Idempotency.Begin(ctx, user.ID, "key4", hash)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, do("/api/user/balance/withdraw", token, "key4", withdraw).Code)
+
+	assert.Equal(t, http.StatusBadRequest, do("/api/user/balance/withdraw", token, strings.Repeat("k", 256), withdraw).Code)
+}
+
+// failingSaveStore can't store idempotent responses
+type failingSaveStore struct {
+	storage.Repository
+}
+
+func (s failingSaveStore) SaveIdempotentResponse(ctx context.Context, resp models.IdempotentResponse) error {
+	return errors.New("connection lost")
+}
+
+func TestAPIServer_IdempotencyCompleteFailed(t *testing.T) {
+	srv, err := NewServer(Config{
+		Addr:   "127.0.0.1:0",
+		Store:  failingSaveStore{Repository: storage.NewMemStore()},
+		Logger: logging.NewLogger(false),
+	})
+	require.NoError(t, err)
+	var calls int
+	h := srv.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	do := func() int {
+		request := httptest.NewRequest(http.MethodPost, "/api/user/orders", strings.NewReader("12345678903"))
+		request = request.WithContext(context.WithValue(request.Context(), ctxKeyUserID, "1"))
+		request.Header.Set("Idempotency-Key", "key1")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, request)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusAccepted, do())
+	//the response isn't stored, so the key is released instead of blocking retries
+	assert.Equal(t, http.StatusAccepted, do())
+	assert.Equal(t, 2, calls)
+}
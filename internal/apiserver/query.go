@@ -0,0 +1,92 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+)
+
+const dateLayout = "2006-01-02"
+
+// timeParam parses the query parameter in RFC3339 or as a date, missing parameter is zero time
+func timeParam(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(dateLayout, value)
+	if err != nil {
+		return t, fmt.Errorf("%s must be RFC3339 time or date YYYY-MM-DD", name)
+	}
+	return t, nil
+}
+
+// intParam parses the query parameter, missing parameter is zero
+func intParam(r *http.Request, name string) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be integer", name)
+	}
+	return n, nil
+}
+
+// sumParam parses the query parameter with amount, missing parameter is zero
+func sumParam(r *http.Request, name string) (models.SumScore, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	sum, err := models.ParseSumScore(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be number with at most two decimal places", name)
+	}
+	return sum, nil
+}
+
+// hasAnyParam reports whether the request has one of the query parameters
+func hasAnyParam(r *http.Request, names ...string) bool {
+	query := r.URL.Query()
+	for _, name := range names {
+		if _, ok := query[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// listParam returns values of the repeated or comma separated query parameter
+func listParam(r *http.Request, name string) []string {
+	var list []string
+	for _, value := range r.URL.Query()[name] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// setNextPageHeaders points the client to the next page, the last page has no headers
+func setNextPageHeaders(w http.ResponseWriter, r *http.Request, cursor string) {
+	if cursor == "" {
+		return
+	}
+	query := r.URL.Query()
+	query.Set("cursor", cursor)
+	next := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+	w.Header().Set("X-Next-Cursor", cursor)
+}
@@ -0,0 +1,67 @@
+package apiserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "::1", "fd00::/8"})
+	require.NoError(t, err)
+	require.Len(t, nets, 4)
+	assert.Equal(t, "192.168.1.1/32", nets[1].String())
+	assert.Equal(t, "::1/128", nets[2].String())
+
+	for _, invalid := range []string{"10.0.0.0/33", "proxy", "10.0.0"} {
+		_, err := parseTrustedProxies([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestAPIServer_RealIP(t *testing.T) {
+	nets, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	srv := &APIServer{trustedProxies: nets}
+	h := srv.realIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(clientIP(r)))
+	}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "203.0.113.7:5555", want: "203.0.113.7"},
+		{name: "spoofed forwarded", remoteAddr: "203.0.113.7:5555", forwarded: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "spoofed real ip", remoteAddr: "203.0.113.7:5555", realIP: "198.51.100.1", want: "203.0.113.7"},
+		{name: "trusted proxy", remoteAddr: "10.0.0.2:5555", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "chain of proxies", remoteAddr: "10.0.0.2:5555", forwarded: []string{"198.51.100.1, 10.1.1.1"}, want: "198.51.100.1"},
+		{name: "spoofed by client behind proxy", remoteAddr: "10.0.0.2:5555", forwarded: []string{"1.2.3.4, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "several headers", remoteAddr: "10.0.0.2:5555", forwarded: []string{"1.2.3.4", "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "only proxies", remoteAddr: "10.0.0.2:5555", forwarded: []string{"10.2.2.2, 10.1.1.1"}, want: "10.2.2.2"},
+		{name: "real ip of trusted proxy", remoteAddr: "10.0.0.2:5555", realIP: "198.51.100.1", want: "198.51.100.1"},
+		{name: "broken forwarded", remoteAddr: "10.0.0.2:5555", forwarded: []string{"unknown"}, want: "10.0.0.2"},
+		{name: "proxy without headers", remoteAddr: "10.0.0.2:5555", want: "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwarded {
+				request.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				request.Header.Set("X-Real-IP", tt.realIP)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, request)
+			assert.Equal(t, tt.want, rec.Body.String())
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// IdempotentResponse is the first response to the request with Idempotency-Key, it's replayed on retries.
+// Status is zero while the first request is in progress, the request holds the key until LockedUntil,
+// then a retry may take the key over, e.g. the instance serving the first request has crashed.
+type IdempotentResponse struct {
+	UserID      string         `db:"user_id"`
+	Key         string         `db:"key"`
+	RequestHash string         `db:"request_hash"` //fingerprint of method, path and body of the request
+	Status      int            `db:"status"`
+	Header      ResponseHeader `db:"header"`
+	Body        []byte         `db:"body"`
+	CreatedAt   time.Time      `db:"created_at"` //identifies the reservation of the key
+	LockedUntil time.Time      `db:"locked_until"`
+	ExpiresAt   time.Time      `db:"expires_at"`
+}
+
+// Done reports whether the response is stored
+func (r IdempotentResponse) Done() bool {
+	return r.Status != 0
+}
+
+// ResponseHeader is stored as JSON object
+type ResponseHeader map[string][]string
+
+func (h *ResponseHeader) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*h = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, h)
+	case string:
+		return json.Unmarshal([]byte(v), h)
+	default:
+		return fmt.Errorf("can't scan %T to response header", src)
+	}
+}
+
+func (h ResponseHeader) Value() (driver.Value, error) {
+	if h == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(h)
+	return string(data), err
+}
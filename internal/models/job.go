@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// AccrualJob is a pending request of the order status to the accrual system
+type AccrualJob struct {
+	OrderNumber   OrderNumber `db:"order_number"`
+	Attempts      int         `db:"attempts"`
+	NextAttemptAt time.Time   `db:"next_attempt_at"`
+	LastError     string      `db:"last_error"`
+	CreatedAt     time.Time   `db:"created_at"`
+}
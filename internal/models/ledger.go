@@ -0,0 +1,95 @@
+package models
+
+import "time"
+
+type EntryKind string
+
+const (
+	EntryKindAccrual    EntryKind = "accrual"
+	EntryKindWithdrawal EntryKind = "withdrawal"
+	EntryKindAdjustment EntryKind = "adjustment"
+)
+
+// JournalEntry is an immutable ledger record. Amount is positive for credit and negative for debit.
+type JournalEntry struct {
+	ID           int64     `json:"id" db:"id"`
+	UserID       string    `json:"-" db:"user_id"`
+	Kind         EntryKind `json:"kind" db:"kind"`
+	Reference    string    `json:"reference" db:"reference"`
+	Amount       SumScore  `json:"amount" db:"amount"`
+	BalanceAfter SumScore  `json:"balance_after" db:"balance_after"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+// LedgerDiscrepancy describes the account whose maintained balance doesn't match its journal
+type LedgerDiscrepancy struct {
+	UserID           string   `db:"user_id"`
+	Balance          SumScore `db:"balance"`
+	JournalBalance   SumScore `db:"journal_balance"`
+	Withdrawn        SumScore `db:"withdrawn"`
+	JournalWithdrawn SumScore `db:"journal_withdrawn"`
+}
+
+// AdjustmentReason explains why the operator changed the balance
+type AdjustmentReason string
+
+const (
+	AdjustmentReasonCompensation AdjustmentReason = "compensation"
+	AdjustmentReasonGoodwill     AdjustmentReason = "goodwill"
+	AdjustmentReasonFraud        AdjustmentReason = "fraud"
+	AdjustmentReasonCorrection   AdjustmentReason = "correction"
+)
+
+// Valid reports whether the reason is known
+func (r AdjustmentReason) Valid() bool {
+	switch r {
+	case AdjustmentReasonCompensation, AdjustmentReasonGoodwill, AdjustmentReasonFraud, AdjustmentReasonCorrection:
+		return true
+	}
+	return false
+}
+
+const (
+	AdjustmentTypeCredit = "credit"
+	AdjustmentTypeDebit  = "debit"
+)
+
+// Adjustment is a manual change of the balance made by the operator. Amount is positive for credit and negative for debit.
+type Adjustment struct {
+	ID         int64            `json:"id" db:"id" example:"1"`
+	UserID     string           `json:"user_id" db:"user_id" example:"1"`
+	Amount     SumScore         `json:"amount" db:"amount" example:"-50"`
+	Reason     AdjustmentReason `json:"reason" db:"reason" example:"fraud"`
+	OperatorID string           `json:"operator_id" db:"operator_id" example:"2"`
+	Note       string           `json:"note" db:"note" example:"points of the cancelled order"`
+	CreatedAt  time.Time        `json:"created_at" db:"created_at" example:"2020-12-10T15:15:45+03:00"`
+}
+
+type AdjustmentRequest struct {
+	Type   string           `json:"type" example:"debit"`
+	Sum    SumScore         `json:"sum" example:"50"`
+	Reason AdjustmentReason `json:"reason" example:"fraud"`
+	Note   string           `json:"note" example:"points of the cancelled order"`
+}
+
+// JournalFilter selects a page of the user's journal, zero values don't restrict it
+type JournalFilter struct {
+	From    time.Time //created_at >= From
+	To      time.Time //created_at < To
+	AfterID int64     //entries with greater ID
+	Limit   int
+}
+
+// StatementQuery is a request of the balance history page
+type StatementQuery struct {
+	From   time.Time
+	To     time.Time
+	Cursor string //next_cursor of the previous page
+	Limit  int
+}
+
+// Statement is a page of the balance history, the oldest entries first
+type Statement struct {
+	Entries    []JournalEntry `json:"entries"`
+	NextCursor string         `json:"next_cursor,omitempty" example:"eyJpZCI6NDJ9"`
+}
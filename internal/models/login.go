@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// LoginAttempts counts failed logins of the login or the IP address
+type LoginAttempts struct {
+	Key           string    `db:"key"`
+	Failures      int       `db:"failures"`
+	LastFailureAt time.Time `db:"last_failure_at"`
+	BlockedUntil  time.Time `db:"blocked_until"`
+}
@@ -0,0 +1,145 @@
+package models
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// SumScoreScale is the number of minor units in a point
+const SumScoreScale = 100
+
+var ErrInvalidSumScore = errors.New("invalid amount")
+
+// SumScore is an exact amount of points kept in minor units (hundredths).
+// It's marshalled to JSON as a decimal number and stored in NUMERIC columns.
+type SumScore int64
+
+// Points returns the amount of whole points
+func Points(n int64) SumScore {
+	return SumScore(n * SumScoreScale)
+}
+
+// ParseSumScore parses decimal number with at most two decimal places, e.g. "729.98" or "5e2"
+func ParseSumScore(s string) (SumScore, error) {
+	r, err := parseMinorUnits(s)
+	if err != nil {
+		return 0, err
+	}
+	if !r.IsInt() {
+		return 0, fmt.Errorf("%w: %q has more than two decimal places", ErrInvalidSumScore, strings.TrimSpace(s))
+	}
+	return minorUnits(r.Num(), s)
+}
+
+// RoundSumScore parses decimal number like ParseSumScore, but rounds extra decimal places half to even.
+// It's for amounts of external systems which send floats, e.g. "729.985" is 729.98.
+func RoundSumScore(s string) (SumScore, error) {
+	r, err := parseMinorUnits(s)
+	if err != nil {
+		return 0, err
+	}
+	q, rem := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	//compare the remainder with the half of the denominator
+	switch new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(r.Denom()) {
+	case 1:
+		q.Add(q, big.NewInt(int64(rem.Sign())))
+	case 0:
+		if q.Bit(0) == 1 {
+			q.Add(q, big.NewInt(int64(rem.Sign())))
+		}
+	}
+	return minorUnits(q, s)
+}
+
+// parseMinorUnits parses decimal number and returns it in minor units
+func parseMinorUnits(s string) (*big.Rat, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= '0' && r <= '9' || r == '.' || r == '-' || r == '+' || r == 'e' || r == 'E')
+	}) >= 0 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidSumScore, s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidSumScore, s)
+	}
+	return r.Mul(r, big.NewRat(SumScoreScale, 1)), nil
+}
+
+func minorUnits(n *big.Int, s string) (SumScore, error) {
+	if !n.IsInt64() {
+		return 0, fmt.Errorf("%w: %q is too big", ErrInvalidSumScore, strings.TrimSpace(s))
+	}
+	return SumScore(n.Int64()), nil
+}
+
+// String returns the amount as decimal number without trailing zeros
+func (s SumScore) String() string {
+	sign := ""
+	minor := uint64(s)
+	if s < 0 {
+		sign = "-"
+		minor = uint64(-s)
+	}
+	whole := strconv.FormatUint(minor/SumScoreScale, 10)
+	frac := minor % SumScoreScale
+	if frac == 0 {
+		return sign + whole
+	}
+	return sign + whole + "." + strings.TrimRight(fmt.Sprintf("%02d", frac), "0")
+}
+
+func (s SumScore) MarshalJSON() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalJSON accepts JSON number or string with number
+func (s *SumScore) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var str string
+		if err := json.Unmarshal(data, &str); err != nil {
+			return err
+		}
+		data = []byte(str)
+	}
+	v, err := ParseSumScore(string(data))
+	if err != nil {
+		return err
+	}
+	*s = v
+	return nil
+}
+
+// Scan reads NUMERIC column
+func (s *SumScore) Scan(src interface{}) error {
+	var err error
+	switch v := src.(type) {
+	case nil:
+		*s = 0
+	case []byte:
+		*s, err = ParseSumScore(string(v))
+	case string:
+		*s, err = ParseSumScore(v)
+	case int64:
+		*s = Points(v)
+	case float64:
+		*s, err = ParseSumScore(strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		err = fmt.Errorf("%w: can't scan %T", ErrInvalidSumScore, src)
+	}
+	return err
+}
+
+// Value writes the amount as decimal text, so NUMERIC keeps it exactly
+func (s SumScore) Value() (driver.Value, error) {
+	return s.String(), nil
+}
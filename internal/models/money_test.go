@@ -0,0 +1,132 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSumScore(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    SumScore
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"500", Points(500), false},
+		{"729.98", 72998, false},
+		{"0.1", 10, false},
+		{" 0.30 ", 30, false},
+		{"-42.5", -4250, false},
+		{"5e2", Points(500), false},
+		{"1.005", 0, true},
+		{"", 0, true},
+		{"abc", 0, true},
+		{"0x10", 0, true},
+		{"1/2", 0, true},
+		{"100000000000000000000", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseSumScore(tt.in)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidSumScore)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRoundSumScore(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    SumScore
+		wantErr bool
+	}{
+		{"729.98", 72998, false},
+		{"729.985", 72998, false},
+		{"729.975", 72998, false},
+		{"729.9851", 72999, false},
+		{"0.004", 0, false},
+		{"0.006", 1, false},
+		{"-0.015", -2, false},
+		{"-0.025", -2, false},
+		{"1e-3", 0, false},
+		{"5e2", Points(500), false},
+		{"", 0, true},
+		{"NaN", 0, true},
+		{"100000000000000000000", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := RoundSumScore(tt.in)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidSumScore)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSumScore_String(t *testing.T) {
+	assert.Equal(t, "0", SumScore(0).String())
+	assert.Equal(t, "500", Points(500).String())
+	assert.Equal(t, "729.98", SumScore(72998).String())
+	assert.Equal(t, "0.3", SumScore(30).String())
+	assert.Equal(t, "0.05", SumScore(5).String())
+	assert.Equal(t, "-1.5", SumScore(-150).String())
+}
+
+func TestSumScore_Exact(t *testing.T) {
+	a, err := ParseSumScore("0.1")
+	require.NoError(t, err)
+	b, err := ParseSumScore("0.2")
+	require.NoError(t, err)
+	assert.Equal(t, "0.3", (a + b).String())
+}
+
+func TestSumScore_JSON(t *testing.T) {
+	data, err := json.Marshal(OrderWithdraw{OrderNumber: "2377225624", Sum: SumScore(72998)})
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"sum":729.98`)
+
+	var req WithdrawRequest
+	require.NoError(t, json.Unmarshal([]byte(`{"order":"2377225624","sum":751.5}`), &req))
+	assert.Equal(t, SumScore(75150), req.Sum)
+	require.NoError(t, json.Unmarshal([]byte(`{"order":"2377225624","sum":"0.01"}`), &req))
+	assert.Equal(t, SumScore(1), req.Sum)
+	assert.Error(t, json.Unmarshal([]byte(`{"order":"2377225624","sum":0.001}`), &req))
+}
+
+func TestSumScore_Scan(t *testing.T) {
+	tests := []struct {
+		name string
+		src  interface{}
+		want SumScore
+	}{
+		{"nil", nil, 0},
+		{"numeric", []byte("729.98"), 72998},
+		{"string", "0.50", 50},
+		{"int", int64(7), Points(7)},
+		{"float", 0.3, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s SumScore
+			require.NoError(t, s.Scan(tt.src))
+			assert.Equal(t, tt.want, s)
+		})
+	}
+	var s SumScore
+	assert.ErrorIs(t, s.Scan(true), ErrInvalidSumScore)
+
+	v, err := SumScore(72998).Value()
+	require.NoError(t, err)
+	assert.Equal(t, "729.98", v)
+}
@@ -43,7 +43,7 @@ func (o Order) MarshalJSON() ([]byte, error) {
 
 type OrderWithdraw struct {
 	OrderNumber string    `json:"order" db:"order_number"`
-	Sum         float64   `json:"sum" db:"sum"`
+	Sum         SumScore  `json:"sum" db:"sum"`
 	ProcessedAt time.Time `json:"processed_at" db:"processed_at"`
 }
 
@@ -51,3 +51,74 @@ type WithdrawRequest struct {
 	OrderNumber string   `json:"order" example:"9278923470"`
 	Sum         SumScore `json:"sum" example:"125"`
 }
+
+// Valid reports whether the status is known
+func (s OrderStatus) Valid() bool {
+	switch s {
+	case OrderStatusNew, OrderStatusProcessing, OrderStatusInvalid, OrderStatusProcessed:
+		return true
+	}
+	return false
+}
+
+// OrderPosition is the place of the order in the list sorted by uploaded_at and number
+type OrderPosition struct {
+	UploadedAt time.Time   `json:"uploaded_at"`
+	Number     OrderNumber `json:"number"`
+}
+
+// OrderFilter selects a page of the user's orders, zero values don't restrict it
+type OrderFilter struct {
+	Statuses []OrderStatus
+	From     time.Time //uploaded_at >= From
+	To       time.Time //uploaded_at < To
+	Desc     bool      //the newest first
+	After    *OrderPosition
+	Limit    int
+}
+
+// OrderQuery is a request of the order list page
+type OrderQuery struct {
+	Statuses []OrderStatus
+	From     time.Time
+	To       time.Time
+	Desc     bool
+	Cursor   string //next cursor of the previous page
+	Limit    int
+}
+
+type OrderPage struct {
+	Orders     []Order
+	NextCursor string
+}
+
+// WithdrawalPosition is the place of the withdrawal in the list sorted by processed_at and order number
+type WithdrawalPosition struct {
+	ProcessedAt time.Time `json:"processed_at"`
+	OrderNumber string    `json:"order"`
+}
+
+// WithdrawalFilter selects a page of the user's withdrawals, zero values don't restrict it
+type WithdrawalFilter struct {
+	From   time.Time //processed_at >= From
+	To     time.Time //processed_at < To
+	MinSum SumScore  //sum >= MinSum
+	MaxSum SumScore  //sum <= MaxSum
+	After  *WithdrawalPosition
+	Limit  int
+}
+
+// WithdrawalQuery is a request of the withdrawal list page
+type WithdrawalQuery struct {
+	From   time.Time
+	To     time.Time
+	MinSum SumScore
+	MaxSum SumScore
+	Cursor string //next cursor of the previous page
+	Limit  int
+}
+
+type WithdrawalPage struct {
+	Withdrawals []OrderWithdraw
+	NextCursor  string
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// orderTransitions are the statuses the order may change to. The order skips PROCESSING
+// if the accrual system has calculated it before the first poll. PROCESSED and INVALID are final.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderStatusNew:        {OrderStatusProcessing, OrderStatusProcessed, OrderStatusInvalid},
+	OrderStatusProcessing: {OrderStatusProcessed, OrderStatusInvalid},
+}
+
+// Final reports whether the status never changes
+func (s OrderStatus) Final() bool {
+	return s == OrderStatusProcessed || s == OrderStatusInvalid
+}
+
+// CanTransitionTo reports whether the order of the status may change to next
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, status := range orderTransitions[s] {
+		if status == next {
+			return true
+		}
+	}
+	return false
+}
+
+// PreviousStatuses returns the statuses which may change to s
+func (s OrderStatus) PreviousStatuses() []OrderStatus {
+	var list []OrderStatus
+	for _, prev := range []OrderStatus{OrderStatusNew, OrderStatusProcessing, OrderStatusProcessed, OrderStatusInvalid} {
+		if prev.CanTransitionTo(s) {
+			list = append(list, prev)
+		}
+	}
+	return list
+}
+
+// OrderStatusChange is a record of the order status history
+type OrderStatusChange struct {
+	Status    OrderStatus `json:"status" db:"status" example:"PROCESSING"`
+	ChangedAt time.Time   `json:"changed_at" db:"changed_at" example:"2021-12-10T15:15:45+03:00"`
+}
+
+// OrderDetails is the order with its status history, the oldest change first
+type OrderDetails struct {
+	Order
+	History []OrderStatusChange `json:"history"`
+}
+
+func (o OrderDetails) MarshalJSON() ([]byte, error) {
+	type OrderAlias Order
+	history := make([]struct {
+		Status    OrderStatus `json:"status"`
+		ChangedAt string      `json:"changed_at"`
+	}, len(o.History))
+	for i, change := range o.History {
+		history[i].Status = change.Status
+		history[i].ChangedAt = change.ChangedAt.Format(time.RFC3339)
+	}
+	return json.Marshal(struct {
+		OrderAlias
+		UplAt   string      `json:"uploaded_at"`
+		History interface{} `json:"history"`
+	}{
+		OrderAlias: OrderAlias(o.Order),
+		UplAt:      o.UploadedAt.Format(time.RFC3339),
+		History:    history,
+	})
+}
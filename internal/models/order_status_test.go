@@ -0,0 +1,45 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrderStatus_CanTransitionTo(t *testing.T) {
+	statuses := []OrderStatus{OrderStatusNew, OrderStatusProcessing, OrderStatusProcessed, OrderStatusInvalid}
+	allowed := map[[2]OrderStatus]bool{
+		{OrderStatusNew, OrderStatusProcessing}:       true,
+		{OrderStatusNew, OrderStatusProcessed}:        true,
+		{OrderStatusNew, OrderStatusInvalid}:          true,
+		{OrderStatusProcessing, OrderStatusProcessed}: true,
+		{OrderStatusProcessing, OrderStatusInvalid}:   true,
+	}
+	for _, from := range statuses {
+		for _, to := range statuses {
+			assert.Equal(t, allowed[[2]OrderStatus{from, to}], from.CanTransitionTo(to), "%s to %s", from, to)
+		}
+		assert.False(t, from.CanTransitionTo("DONE"))
+	}
+	assert.True(t, OrderStatusProcessed.Final())
+	assert.True(t, OrderStatusInvalid.Final())
+	assert.False(t, OrderStatusProcessing.Final())
+
+	assert.Empty(t, OrderStatusNew.PreviousStatuses())
+	assert.Equal(t, []OrderStatus{OrderStatusNew}, OrderStatusProcessing.PreviousStatuses())
+	assert.Equal(t, []OrderStatus{OrderStatusNew, OrderStatusProcessing}, OrderStatusProcessed.PreviousStatuses())
+}
+
+func TestOrderDetails_MarshalJSON(t *testing.T) {
+	at := time.Date(2021, 12, 10, 15, 15, 45, 0, time.UTC)
+	data, err := json.Marshal(OrderDetails{
+		Order:   Order{Number: "12345678903", Status: OrderStatusProcessed, Accrual: Points(500), UploadedAt: at},
+		History: []OrderStatusChange{{Status: OrderStatusNew, ChangedAt: at}, {Status: OrderStatusProcessed, ChangedAt: at.Add(time.Minute)}},
+	})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"number":"12345678903","status":"PROCESSED","accrual":500,"uploaded_at":"2021-12-10T15:15:45Z",
+		"history":[{"status":"NEW","changed_at":"2021-12-10T15:15:45Z"},{"status":"PROCESSED","changed_at":"2021-12-10T15:16:45Z"}]}`, string(data))
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// RefreshToken is a stored refresh token, only hash of the token is kept.
+// Tokens rotated from the same login belong to one family.
+type RefreshToken struct {
+	TokenHash string     `db:"token_hash"`
+	UserID    string     `db:"user_id"`
+	FamilyID  string     `db:"family_id"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	CreatedAt time.Time  `db:"created_at"`
+	UsedAt    *time.Time `db:"used_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+}
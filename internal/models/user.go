@@ -1,13 +1,35 @@
 package models
 
+import "time"
+
+// Role grants access to the API, users have RoleUser by default
+type Role string
+
+const (
+	RoleUser  Role = "user"
+	RoleAdmin Role = "admin"
+)
+
+// Valid reports whether the role is known
+func (r Role) Valid() bool {
+	return r == RoleUser || r == RoleAdmin
+}
+
 type User struct {
-	ID                string `db:"id" swaggerignore:"true"`
-	Login             string `db:"login" validate:"required" example:"user777"`
-	Password          string `validate:"required" example:"qwerty12345"`
-	EncryptedPassword string `db:"encrypted_password" swaggerignore:"true"`
+	ID                string    `db:"id" swaggerignore:"true"`
+	Login             string    `db:"login" validate:"required" example:"user777"`
+	Password          string    `validate:"required" example:"qwerty12345"`
+	EncryptedPassword string    `db:"encrypted_password" swaggerignore:"true"`
+	TokensValidAfter  time.Time `json:"-" db:"tokens_valid_after" swaggerignore:"true"` //tokens issued before are invalid
+	Role              Role      `json:"-" db:"role" swaggerignore:"true"`
 }
 
-type SumScore float64
+// UserInfo is the user shown to operators
+type UserInfo struct {
+	ID    string `json:"id" example:"1"`
+	Login string `json:"login" example:"user777"`
+	Role  Role   `json:"role" example:"user"`
+}
 
 type UserBalance struct {
 	User      User     `json:"-"`
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+)
+
+// ReserveIdempotencyKey saves the request if the user's key isn't stored, has expired or the same request
+// holding it has been locked for too long, and returns true. Otherwise the stored request is returned.
+// Expired keys are purged.
+func (s *Store) ReserveIdempotencyKey(ctx context.Context, req models.IdempotentResponse) (models.IdempotentResponse, bool, error) {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at < $1", req.CreatedAt); err != nil {
+		return req, false, err
+	}
+	//the stored row may be deleted by the failed request between insert and select, then insert again
+	for i := 0; i < 2; i++ {
+		res, err := s.db.ExecContext(ctx, `INSERT INTO idempotency_keys (user_id, key, request_hash, status, header, body, created_at, locked_until, expires_at)
+			VALUES ($1, $2, $3, 0, '{}', NULL, $4, $5, $6)
+			ON CONFLICT (user_id, key) DO UPDATE SET request_hash=EXCLUDED.request_hash, status=0, header='{}', body=NULL,
+				created_at=EXCLUDED.created_at, locked_until=EXCLUDED.locked_until, expires_at=EXCLUDED.expires_at
+			WHERE idempotency_keys.expires_at <= EXCLUDED.created_at
+				OR idempotency_keys.status=0 AND idempotency_keys.locked_until <= EXCLUDED.created_at
+					AND idempotency_keys.request_hash=EXCLUDED.request_hash`,
+			req.UserID, req.Key, req.RequestHash, req.CreatedAt, req.LockedUntil, req.ExpiresAt)
+		if err != nil {
+			return req, false, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return req, false, err
+		} else if n > 0 {
+			return req, true, nil
+		}
+		stored := models.IdempotentResponse{}
+		err = s.db.GetContext(ctx, &stored, "SELECT * FROM idempotency_keys WHERE user_id=$1 AND key=$2", req.UserID, req.Key)
+		if err == nil {
+			return stored, false, nil
+		}
+		if err != sql.ErrNoRows {
+			return req, false, err
+		}
+	}
+	return req, false, fmt.Errorf("reserve idempotency key %q failed: key is being released", req.Key)
+}
+
+func (s *Store) SaveIdempotentResponse(ctx context.Context, resp models.IdempotentResponse) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE idempotency_keys SET status=$1, header=$2, body=$3
+		WHERE user_id=$4 AND key=$5 AND created_at=$6 AND status=0`,
+		resp.Status, resp.Header, resp.Body, resp.UserID, resp.Key, resp.CreatedAt)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrIdempotencyKeyLost
+	}
+	return nil
+}
+
+func (s *Store) DeleteIdempotencyKey(ctx context.Context, req models.IdempotentResponse) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE user_id=$1 AND key=$2 AND created_at=$3 AND status=0",
+		req.UserID, req.Key, req.CreatedAt)
+	return err
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+)
+
+// ClaimAccrualJobs returns due jobs and hides them from other workers for the lease time.
+// If the worker dies, the job becomes due again when the lease expires.
+func (s *Store) ClaimAccrualJobs(ctx context.Context, limit int, lease time.Duration) ([]models.AccrualJob, error) {
+	jobs := []models.AccrualJob{}
+	now := time.Now()
+	err := s.db.SelectContext(ctx, &jobs, `UPDATE accrual_jobs SET next_attempt_at=$1
+		WHERE order_number IN (
+			SELECT order_number FROM accrual_jobs
+			WHERE next_attempt_at <= $2
+			ORDER BY next_attempt_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED)
+		RETURNING order_number, attempts, next_attempt_at, last_error, created_at`,
+		now.Add(lease), now, limit)
+	if err != nil && err != sql.ErrNoRows {
+		return jobs, err
+	}
+	return jobs, nil
+}
+
+func (s *Store) CompleteAccrualJob(ctx context.Context, number models.OrderNumber) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM accrual_jobs WHERE order_number=$1", number)
+	return err
+}
+
+func (s *Store) RetryAccrualJob(ctx context.Context, number models.OrderNumber, nextAttemptAt time.Time, lastErr string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE accrual_jobs SET attempts=attempts+1, next_attempt_at=$1, last_error=$2
+		WHERE order_number=$3`, nextAttemptAt, lastErr, number)
+	return err
+}
+
+func (s *Store) PostponeAccrualJob(ctx context.Context, number models.OrderNumber, nextAttemptAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE accrual_jobs SET attempts=0, next_attempt_at=$1, last_error=''
+		WHERE order_number=$2`, nextAttemptAt, number)
+	return err
+}
+
+func (s *Store) RequeueAccrualJob(ctx context.Context, number models.OrderNumber) error {
+	res, err := s.db.ExecContext(ctx, `INSERT INTO accrual_jobs (order_number, next_attempt_at)
+		SELECT number, $2 FROM orders WHERE number=$1
+		ON CONFLICT (order_number) DO UPDATE SET attempts=0, next_attempt_at=EXCLUDED.next_attempt_at, last_error=''`,
+		number, time.Now())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err != nil {
+			return err
+		}
+		return ErrOrderNotFound
+	}
+	return nil
+}
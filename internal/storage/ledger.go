@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+)
+
+// lockAccount locks the user's account row until the end of transaction and returns its balance
+func lockAccount(ctx context.Context, tx *sqlx.Tx, userID string) (models.SumScore, error) {
+	var bal models.SumScore
+	err := tx.GetContext(ctx, &bal, "SELECT balance FROM accounts WHERE user_id=$1 FOR UPDATE", userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrUserNotFound
+		}
+		return 0, err
+	}
+	return bal, nil
+}
+
+// postEntry writes journal entry and updates the account balance.
+// The entry with the same kind and reference is posted only once, posted reports whether it was written.
+func postEntry(ctx context.Context, tx *sqlx.Tx, userID string, kind models.EntryKind, reference string, amount models.SumScore) (posted bool, err error) {
+	if _, err := tx.ExecContext(ctx, "INSERT INTO accounts (user_id) VALUES ($1) ON CONFLICT DO NOTHING", userID); err != nil {
+		return false, err
+	}
+	bal, err := lockAccount(ctx, tx, userID)
+	if err != nil {
+		return false, err
+	}
+	bal += amount
+	res, err := tx.ExecContext(ctx, `INSERT INTO journal_entries (user_id, kind, reference, amount, balance_after, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (kind, reference) DO NOTHING`,
+		userID, kind, reference, amount, bal, time.Now())
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	var withdrawn models.SumScore
+	if kind == models.EntryKindWithdrawal {
+		withdrawn = -amount
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE accounts SET balance=$1, withdrawn=withdrawn+$2, updated_at=$3 WHERE user_id=$4",
+		bal, withdrawn, time.Now(), userID)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) GetJournalByUserID(ctx context.Context, userID string) ([]models.JournalEntry, error) {
+	entries := []models.JournalEntry{}
+	err := s.db.SelectContext(ctx, &entries, "SELECT * FROM journal_entries WHERE user_id=$1 ORDER BY id ASC", userID)
+	if err != nil && err != sql.ErrNoRows {
+		return entries, err
+	}
+	return entries, nil
+}
+
+func (s *Store) GetJournalPage(ctx context.Context, userID string, filter models.JournalFilter) ([]models.JournalEntry, error) {
+	entries := []models.JournalEntry{}
+	query := "SELECT * FROM journal_entries WHERE user_id=$1 AND id>$2"
+	args := []interface{}{userID, filter.AfterID}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		query += fmt.Sprintf(" AND created_at>=$%d", len(args))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		query += fmt.Sprintf(" AND created_at<$%d", len(args))
+	}
+	query += " ORDER BY id ASC"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	err := s.db.SelectContext(ctx, &entries, query, args...)
+	if err != nil && err != sql.ErrNoRows {
+		return entries, err
+	}
+	return entries, nil
+}
+
+func (s *Store) CreateAdjustment(ctx context.Context, adj models.Adjustment) (models.Adjustment, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return adj, err
+	}
+	defer tx.Rollback()
+
+	bal, err := lockAccount(ctx, tx, adj.UserID)
+	if err != nil {
+		return adj, err
+	}
+	if adj.Amount < 0 && bal+adj.Amount < 0 {
+		return adj, ErrNotEnoughFunds
+	}
+	adj.CreatedAt = time.Now()
+	err = tx.GetContext(ctx, &adj.ID, `INSERT INTO balance_adjustments (user_id, amount, reason, operator_id, note, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		adj.UserID, adj.Amount, adj.Reason, adj.OperatorID, adj.Note, adj.CreatedAt)
+	if err != nil {
+		return adj, err
+	}
+	if _, err := postEntry(ctx, tx, adj.UserID, models.EntryKindAdjustment, fmt.Sprint(adj.ID), adj.Amount); err != nil {
+		return adj, err
+	}
+	return adj, tx.Commit()
+}
+
+func (s *Store) GetAdjustmentsByUserID(ctx context.Context, userID string) ([]models.Adjustment, error) {
+	list := []models.Adjustment{}
+	err := s.db.SelectContext(ctx, &list, "SELECT * FROM balance_adjustments WHERE user_id=$1 ORDER BY id ASC", userID)
+	if err != nil && err != sql.ErrNoRows {
+		return list, err
+	}
+	return list, nil
+}
+
+// CheckLedger recomputes balances from the journal and returns accounts that don't match
+func (s *Store) CheckLedger(ctx context.Context) ([]models.LedgerDiscrepancy, error) {
+	list := []models.LedgerDiscrepancy{}
+	err := s.db.SelectContext(ctx, &list, `SELECT coalesce(a.user_id, j.user_id) AS user_id,
+			coalesce(a.balance, 0) AS balance,
+			coalesce(a.withdrawn, 0) AS withdrawn,
+			coalesce(j.balance, 0) AS journal_balance,
+			coalesce(j.withdrawn, 0) AS journal_withdrawn
+		FROM accounts a
+		FULL JOIN (
+			SELECT user_id, SUM(amount) AS balance,
+				coalesce(-SUM(amount) FILTER (WHERE kind = 'withdrawal'), 0) AS withdrawn
+			FROM journal_entries GROUP BY user_id
+			) AS j ON j.user_id = a.user_id
+		WHERE a.user_id IS NULL
+			OR a.balance <> coalesce(j.balance, 0)
+			OR a.withdrawn <> coalesce(j.withdrawn, 0)
+		ORDER BY 1`)
+	if err != nil && err != sql.ErrNoRows {
+		return list, err
+	}
+	return list, nil
+}
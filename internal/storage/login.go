@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+)
+
+func (s *Store) GetLoginAttempts(ctx context.Context, key string) (models.LoginAttempts, error) {
+	attempts := models.LoginAttempts{Key: key}
+	err := s.db.GetContext(ctx, &attempts, "SELECT * FROM login_attempts WHERE key=$1", key)
+	if err != nil && err != sql.ErrNoRows {
+		return attempts, err
+	}
+	return attempts, nil
+}
+
+// CountLoginAttempt counts the attempt as a failure before the password is checked.
+// The row is locked, so concurrent attempts of replicas are all counted and can't pass the check together.
+// Forgotten rows of keys of the same kind are purged.
+func (s *Store) CountLoginAttempt(ctx context.Context, key string, window time.Duration,
+	block func(failures int) time.Duration) (models.LoginAttempts, error) {
+	attempts := models.LoginAttempts{Key: key}
+	now := time.Now()
+	_, err := s.db.ExecContext(ctx, "DELETE FROM login_attempts WHERE last_failure_at < $1 AND blocked_until < $2 AND starts_with(key, $3)",
+		now.Add(-window), now, loginKeyKind(key))
+	if err != nil {
+		return attempts, err
+	}
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return attempts, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO login_attempts (key) VALUES ($1) ON CONFLICT DO NOTHING", key); err != nil {
+		return attempts, err
+	}
+	if err := tx.GetContext(ctx, &attempts, "SELECT * FROM login_attempts WHERE key=$1 FOR UPDATE", key); err != nil {
+		return attempts, err
+	}
+	now = time.Now()
+	if now.Before(attempts.BlockedUntil) {
+		return attempts, ErrLoginBlocked
+	}
+	nextFailure(&attempts, now, window, block)
+	_, err = tx.ExecContext(ctx, "UPDATE login_attempts SET failures=$1, last_failure_at=$2, blocked_until=$3 WHERE key=$4",
+		attempts.Failures, attempts.LastFailureAt, attempts.BlockedUntil, key)
+	if err != nil {
+		return attempts, err
+	}
+	return attempts, tx.Commit()
+}
+
+func (s *Store) ReleaseLoginAttempt(ctx context.Context, key string, block func(failures int) time.Duration) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	attempts := models.LoginAttempts{Key: key}
+	err = tx.GetContext(ctx, &attempts, "SELECT * FROM login_attempts WHERE key=$1 FOR UPDATE", key)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	releaseAttempt(&attempts, block)
+	_, err = tx.ExecContext(ctx, "UPDATE login_attempts SET failures=$1, blocked_until=$2 WHERE key=$3",
+		attempts.Failures, attempts.BlockedUntil, key)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) ResetLoginAttempts(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM login_attempts WHERE key=$1", key)
+	return err
+}
+
+// loginKeyKind returns the prefix of the key, e.g. "ip:" of "ip:10.0.0.1", keys of one kind share the window
+func loginKeyKind(key string) string {
+	if i := strings.IndexByte(key, ':'); i >= 0 {
+		return key[:i+1]
+	}
+	return key
+}
+
+// forgottenAttempts reports whether the failures are older than window and don't block the key,
+// then the counter would restart anyway and the row may be purged
+func forgottenAttempts(attempts models.LoginAttempts, now time.Time, window time.Duration) bool {
+	return attempts.LastFailureAt.Before(now.Add(-window)) && attempts.BlockedUntil.Before(now)
+}
+
+// nextFailure adds the failure to the counter
+func nextFailure(attempts *models.LoginAttempts, now time.Time, window time.Duration, block func(failures int) time.Duration) {
+	if now.Sub(attempts.LastFailureAt) > window && now.After(attempts.BlockedUntil) {
+		attempts.Failures = 0
+	}
+	attempts.Failures++
+	attempts.LastFailureAt = now
+	if d := block(attempts.Failures); d > 0 {
+		attempts.BlockedUntil = now.Add(d)
+	}
+}
+
+// releaseAttempt removes the counted attempt, the block is lifted if the remaining failures don't cause it
+func releaseAttempt(attempts *models.LoginAttempts, block func(failures int) time.Duration) {
+	if attempts.Failures > 0 {
+		attempts.Failures--
+	}
+	if block(attempts.Failures) == 0 {
+		attempts.BlockedUntil = time.Time{}
+	}
+}
@@ -0,0 +1,1001 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+)
+
+// MemStore keeps all data in memory. It's used for tests and local runs without Postgres.
+type MemStore struct {
+	mu          sync.RWMutex
+	lastUserID  int
+	users       map[string]models.User //by login
+	userLogins  map[string]string      //login by user ID
+	orders      []models.Order
+	orderIdx    map[models.OrderNumber]int
+	history     map[models.OrderNumber][]models.OrderStatusChange
+	withdrawals []memWithdraw
+	withdrawIdx map[string]int
+	accounts    map[string]*memAccount
+	journal     []models.JournalEntry
+	journalKeys map[string]struct{} //kind and reference of posted entries
+	adjustments []models.Adjustment
+	jobs        map[models.OrderNumber]*models.AccrualJob
+	refresh     map[string]*models.RefreshToken //by hash
+	revoked     map[string]time.Time            //expiration of revoked access tokens by jti
+	attempts    map[string]models.LoginAttempts
+	idempotency map[idempotencyKey]models.IdempotentResponse
+}
+
+type idempotencyKey struct {
+	userID string
+	key    string
+}
+
+type memAccount struct {
+	balance   models.SumScore
+	withdrawn models.SumScore
+}
+
+type memWithdraw struct {
+	userID string
+	models.OrderWithdraw
+}
+
+func NewMemStore() Repository {
+	return newMemStore()
+}
+
+func newMemStore() *MemStore {
+	return &MemStore{
+		users:       make(map[string]models.User),
+		userLogins:  make(map[string]string),
+		orderIdx:    make(map[models.OrderNumber]int),
+		history:     make(map[models.OrderNumber][]models.OrderStatusChange),
+		withdrawIdx: make(map[string]int),
+		accounts:    make(map[string]*memAccount),
+		journalKeys: make(map[string]struct{}),
+		jobs:        make(map[models.OrderNumber]*models.AccrualJob),
+		refresh:     make(map[string]*models.RefreshToken),
+		revoked:     make(map[string]time.Time),
+		attempts:    make(map[string]models.LoginAttempts),
+		idempotency: make(map[idempotencyKey]models.IdempotentResponse),
+	}
+}
+
+func (s *MemStore) Open() error {
+	return nil
+}
+
+func (s *MemStore) Close() {}
+
+func (s *MemStore) CreateUser(ctx context.Context, login, encryptedPas string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "-1", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[login]; ok {
+		return "-1", ErrUserAlreadyExist
+	}
+	s.lastUserID++
+	user := models.User{
+		ID:                fmt.Sprint(s.lastUserID),
+		Login:             login,
+		EncryptedPassword: encryptedPas,
+		Role:              models.RoleUser,
+	}
+	s.users[login] = user
+	s.userLogins[user.ID] = login
+	s.accounts[user.ID] = &memAccount{}
+	return user.ID, nil
+}
+
+func (s *MemStore) GetUserByLogin(ctx context.Context, login string) (models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return models.User{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[login]
+	if !ok {
+		return models.User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *MemStore) GetUserByID(ctx context.Context, userID string) (models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return models.User{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	login, ok := s.userLogins[userID]
+	if !ok {
+		return models.User{}, ErrUserNotFound
+	}
+	return s.users[login], nil
+}
+
+func (s *MemStore) UpdateUserPassword(ctx context.Context, userID, encryptedPas string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	login, ok := s.userLogins[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	user := s.users[login]
+	user.EncryptedPassword = encryptedPas
+	s.users[login] = user
+	return nil
+}
+
+func (s *MemStore) ChangeUserPassword(ctx context.Context, userID, encryptedPas string, validAfter time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	login, ok := s.userLogins[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	user := s.users[login]
+	user.EncryptedPassword = encryptedPas
+	user.TokensValidAfter = validAfter
+	s.users[login] = user
+
+	now := time.Now()
+	for _, token := range s.refresh {
+		if token.UserID == userID && token.RevokedAt == nil {
+			revokedAt := now
+			token.RevokedAt = &revokedAt
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) SetUserRole(ctx context.Context, userID string, role models.Role) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	login, ok := s.userLogins[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	user := s.users[login]
+	user.Role = role
+	s.users[login] = user
+	return nil
+}
+
+func (s *MemStore) GetOrderByNumber(ctx context.Context, number models.OrderNumber) (models.Order, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Order{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i, ok := s.orderIdx[number]
+	if !ok {
+		return models.Order{}, ErrOrderNotFound
+	}
+	return s.orders[i], nil
+}
+
+func (s *MemStore) CreateOrder(ctx context.Context, order models.Order) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orderIdx[order.Number]; ok {
+		return ErrOrderAlreadyExist
+	}
+	order.Status = models.OrderStatusNew
+	order.Accrual = 0
+	order.UpdatedAt = time.Time{}
+	s.orderIdx[order.Number] = len(s.orders)
+	s.orders = append(s.orders, order)
+	s.history[order.Number] = []models.OrderStatusChange{{Status: models.OrderStatusNew, ChangedAt: order.UploadedAt}}
+	s.jobs[order.Number] = &models.AccrualJob{
+		OrderNumber:   order.Number,
+		NextAttemptAt: time.Now(),
+		CreatedAt:     time.Now(),
+	}
+	return nil
+}
+
+func (s *MemStore) GetOrderListByUserID(ctx context.Context, userID string) ([]models.Order, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orderList := []models.Order{}
+	for _, ord := range s.orders {
+		if ord.UserID == userID {
+			orderList = append(orderList, ord)
+		}
+	}
+	sort.SliceStable(orderList, func(i, j int) bool {
+		return orderList[i].UploadedAt.Before(orderList[j].UploadedAt)
+	})
+	return orderList, nil
+}
+
+func (s *MemStore) GetOrderPage(ctx context.Context, userID string, filter models.OrderFilter) ([]models.Order, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	statuses := make(map[models.OrderStatus]bool, len(filter.Statuses))
+	for _, status := range filter.Statuses {
+		statuses[status] = true
+	}
+	//before reports whether a goes before b in the requested order
+	before := func(a, b models.OrderPosition) bool {
+		if filter.Desc {
+			a, b = b, a
+		}
+		if !a.UploadedAt.Equal(b.UploadedAt) {
+			return a.UploadedAt.Before(b.UploadedAt)
+		}
+		return a.Number < b.Number
+	}
+	orderList := []models.Order{}
+	for _, ord := range s.orders {
+		if ord.UserID != userID {
+			continue
+		}
+		if len(statuses) > 0 && !statuses[ord.Status] {
+			continue
+		}
+		if !filter.From.IsZero() && ord.UploadedAt.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && !ord.UploadedAt.Before(filter.To) {
+			continue
+		}
+		if filter.After != nil && !before(*filter.After, models.OrderPosition{UploadedAt: ord.UploadedAt, Number: ord.Number}) {
+			continue
+		}
+		orderList = append(orderList, ord)
+	}
+	sort.Slice(orderList, func(i, j int) bool {
+		return before(models.OrderPosition{UploadedAt: orderList[i].UploadedAt, Number: orderList[i].Number},
+			models.OrderPosition{UploadedAt: orderList[j].UploadedAt, Number: orderList[j].Number})
+	})
+	if filter.Limit > 0 && len(orderList) > filter.Limit {
+		orderList = orderList[:filter.Limit]
+	}
+	return orderList, nil
+}
+
+func (s *MemStore) GetBalanceByUserID(ctx context.Context, userID string) (models.SumScore, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if acc, ok := s.accounts[userID]; ok {
+		return acc.balance, nil
+	}
+	return 0, nil
+}
+
+func (s *MemStore) GetWithdrawalsByUserID(ctx context.Context, userID string) (models.SumScore, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if acc, ok := s.accounts[userID]; ok {
+		return acc.withdrawn, nil
+	}
+	return 0, nil
+}
+
+func (s *MemStore) WithdrawTx(ctx context.Context, userID string, withdraw models.WithdrawRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if withdraw.Sum <= 0 {
+		return ErrInvalidSum
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if acc.balance < withdraw.Sum {
+		return ErrNotEnoughFunds
+	}
+	if _, ok := s.withdrawIdx[withdraw.OrderNumber]; ok {
+		return ErrWithdrawAlreadyExist
+	}
+	s.withdrawIdx[withdraw.OrderNumber] = len(s.withdrawals)
+	s.withdrawals = append(s.withdrawals, memWithdraw{
+		userID: userID,
+		OrderWithdraw: models.OrderWithdraw{
+			OrderNumber: withdraw.OrderNumber,
+			Sum:         withdraw.Sum,
+			ProcessedAt: time.Now(),
+		},
+	})
+	s.postEntry(userID, models.EntryKindWithdrawal, withdraw.OrderNumber, -withdraw.Sum)
+	return nil
+}
+
+func (s *MemStore) GetWithdrawalsListByUserID(ctx context.Context, userID string) ([]models.OrderWithdraw, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	withdrawList := []models.OrderWithdraw{}
+	for _, wd := range s.withdrawals {
+		if wd.userID == userID {
+			withdrawList = append(withdrawList, wd.OrderWithdraw)
+		}
+	}
+	sort.SliceStable(withdrawList, func(i, j int) bool {
+		return withdrawList[i].ProcessedAt.Before(withdrawList[j].ProcessedAt)
+	})
+	return withdrawList, nil
+}
+
+func (s *MemStore) GetWithdrawalPage(ctx context.Context, userID string, filter models.WithdrawalFilter) ([]models.OrderWithdraw, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	before := func(a, b models.WithdrawalPosition) bool {
+		if !a.ProcessedAt.Equal(b.ProcessedAt) {
+			return a.ProcessedAt.Before(b.ProcessedAt)
+		}
+		return a.OrderNumber < b.OrderNumber
+	}
+	withdrawList := []models.OrderWithdraw{}
+	for _, wd := range s.withdrawals {
+		if wd.userID != userID {
+			continue
+		}
+		if !filter.From.IsZero() && wd.ProcessedAt.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && !wd.ProcessedAt.Before(filter.To) {
+			continue
+		}
+		if filter.MinSum != 0 && wd.Sum < filter.MinSum {
+			continue
+		}
+		if filter.MaxSum != 0 && wd.Sum > filter.MaxSum {
+			continue
+		}
+		if filter.After != nil && !before(*filter.After, models.WithdrawalPosition{ProcessedAt: wd.ProcessedAt, OrderNumber: wd.OrderNumber}) {
+			continue
+		}
+		withdrawList = append(withdrawList, wd.OrderWithdraw)
+	}
+	sort.Slice(withdrawList, func(i, j int) bool {
+		return before(models.WithdrawalPosition{ProcessedAt: withdrawList[i].ProcessedAt, OrderNumber: withdrawList[i].OrderNumber},
+			models.WithdrawalPosition{ProcessedAt: withdrawList[j].ProcessedAt, OrderNumber: withdrawList[j].OrderNumber})
+	})
+	if filter.Limit > 0 && len(withdrawList) > filter.Limit {
+		withdrawList = withdrawList[:filter.Limit]
+	}
+	return withdrawList, nil
+}
+
+func (s *MemStore) GetOrdersWithStatus(ctx context.Context, status ...models.OrderStatus) ([]models.OrderNumber, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	orderNumbers := []models.OrderNumber{}
+	if len(status) == 0 {
+		return orderNumbers, errors.New("there is no status")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orderList := make([]models.Order, 0)
+	for _, ord := range s.orders {
+		for _, st := range status {
+			if ord.Status == st {
+				orderList = append(orderList, ord)
+				break
+			}
+		}
+	}
+	sort.SliceStable(orderList, func(i, j int) bool {
+		return orderList[i].UploadedAt.Before(orderList[j].UploadedAt)
+	})
+	for _, ord := range orderList {
+		orderNumbers = append(orderNumbers, ord.Number)
+	}
+	return orderNumbers, nil
+}
+
+func (s *MemStore) UpdateOrder(ctx context.Context, ord models.Order) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.orderIdx[ord.Number]
+	if !ok {
+		return nil //like UPDATE without affected rows
+	}
+	cur := s.orders[i]
+	if cur.Status == ord.Status && cur.Accrual == ord.Accrual {
+		return nil
+	}
+	if !cur.Status.CanTransitionTo(ord.Status) {
+		return fmt.Errorf("%w: %s to %s", ErrOrderStatusConflict, cur.Status, ord.Status)
+	}
+	now := time.Now()
+	s.orders[i].Status = ord.Status
+	s.orders[i].Accrual = ord.Accrual
+	s.orders[i].UpdatedAt = now
+	s.history[ord.Number] = append(s.history[ord.Number], models.OrderStatusChange{Status: ord.Status, ChangedAt: now})
+	//credit accrual to the user's account
+	if ord.Status == models.OrderStatusProcessed && ord.Accrual != 0 {
+		s.postEntry(s.orders[i].UserID, models.EntryKindAccrual, string(ord.Number), ord.Accrual)
+	}
+	return nil
+}
+
+func (s *MemStore) GetOrderStatusHistory(ctx context.Context, number models.OrderNumber) ([]models.OrderStatusChange, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]models.OrderStatusChange{}, s.history[number]...), nil
+}
+
+// postEntry must be called under lock. The entry with the same kind and reference is posted only once.
+func (s *MemStore) postEntry(userID string, kind models.EntryKind, reference string, amount models.SumScore) bool {
+	key := string(kind) + ":" + reference
+	if _, ok := s.journalKeys[key]; ok {
+		return false
+	}
+	acc, ok := s.accounts[userID]
+	if !ok {
+		acc = &memAccount{}
+		s.accounts[userID] = acc
+	}
+	acc.balance += amount
+	if kind == models.EntryKindWithdrawal {
+		acc.withdrawn -= amount
+	}
+	s.journalKeys[key] = struct{}{}
+	s.journal = append(s.journal, models.JournalEntry{
+		ID:           int64(len(s.journal) + 1),
+		UserID:       userID,
+		Kind:         kind,
+		Reference:    reference,
+		Amount:       amount,
+		BalanceAfter: acc.balance,
+		CreatedAt:    time.Now(),
+	})
+	return true
+}
+
+func (s *MemStore) GetJournalByUserID(ctx context.Context, userID string) ([]models.JournalEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := []models.JournalEntry{}
+	for _, e := range s.journal {
+		if e.UserID == userID {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (s *MemStore) GetJournalPage(ctx context.Context, userID string, filter models.JournalFilter) ([]models.JournalEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := []models.JournalEntry{}
+	for _, e := range s.journal {
+		if e.UserID != userID || e.ID <= filter.AfterID {
+			continue
+		}
+		if !filter.From.IsZero() && e.CreatedAt.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && !e.CreatedAt.Before(filter.To) {
+			continue
+		}
+		entries = append(entries, e)
+		if filter.Limit > 0 && len(entries) == filter.Limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+func (s *MemStore) CreateAdjustment(ctx context.Context, adj models.Adjustment) (models.Adjustment, error) {
+	if err := ctx.Err(); err != nil {
+		return adj, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[adj.UserID]
+	if !ok {
+		return adj, ErrUserNotFound
+	}
+	if adj.Amount < 0 && acc.balance+adj.Amount < 0 {
+		return adj, ErrNotEnoughFunds
+	}
+	adj.ID = int64(len(s.adjustments) + 1)
+	adj.CreatedAt = time.Now()
+	s.adjustments = append(s.adjustments, adj)
+	s.postEntry(adj.UserID, models.EntryKindAdjustment, fmt.Sprint(adj.ID), adj.Amount)
+	return adj, nil
+}
+
+func (s *MemStore) GetAdjustmentsByUserID(ctx context.Context, userID string) ([]models.Adjustment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []models.Adjustment{}
+	for _, adj := range s.adjustments {
+		if adj.UserID == userID {
+			list = append(list, adj)
+		}
+	}
+	return list, nil
+}
+
+func (s *MemStore) CheckLedger(ctx context.Context) ([]models.LedgerDiscrepancy, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	journal := make(map[string]*memAccount)
+	for _, e := range s.journal {
+		acc, ok := journal[e.UserID]
+		if !ok {
+			acc = &memAccount{}
+			journal[e.UserID] = acc
+		}
+		acc.balance += e.Amount
+		if e.Kind == models.EntryKindWithdrawal {
+			acc.withdrawn -= e.Amount
+		}
+	}
+	userIDs := make(map[string]struct{})
+	for id := range s.accounts {
+		userIDs[id] = struct{}{}
+	}
+	for id := range journal {
+		userIDs[id] = struct{}{}
+	}
+
+	list := []models.LedgerDiscrepancy{}
+	for id := range userIDs {
+		acc, jrn := memAccount{}, memAccount{}
+		if a, ok := s.accounts[id]; ok {
+			acc = *a
+		}
+		if j, ok := journal[id]; ok {
+			jrn = *j
+		}
+		if acc != jrn {
+			list = append(list, models.LedgerDiscrepancy{
+				UserID:           id,
+				Balance:          acc.balance,
+				JournalBalance:   jrn.balance,
+				Withdrawn:        acc.withdrawn,
+				JournalWithdrawn: jrn.withdrawn,
+			})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].UserID < list[j].UserID
+	})
+	return list, nil
+}
+
+func (s *MemStore) ClaimAccrualJobs(ctx context.Context, limit int, lease time.Duration) ([]models.AccrualJob, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	due := []*models.AccrualJob{}
+	for _, job := range s.jobs {
+		if !job.NextAttemptAt.After(now) {
+			due = append(due, job)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	jobs := make([]models.AccrualJob, 0, len(due))
+	for _, job := range due {
+		job.NextAttemptAt = now.Add(lease)
+		jobs = append(jobs, *job)
+	}
+	return jobs, nil
+}
+
+func (s *MemStore) CompleteAccrualJob(ctx context.Context, number models.OrderNumber) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.jobs, number)
+	return nil
+}
+
+func (s *MemStore) RetryAccrualJob(ctx context.Context, number models.OrderNumber, nextAttemptAt time.Time, lastErr string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job, ok := s.jobs[number]; ok {
+		job.Attempts++
+		job.NextAttemptAt = nextAttemptAt
+		job.LastError = lastErr
+	}
+	return nil
+}
+
+func (s *MemStore) PostponeAccrualJob(ctx context.Context, number models.OrderNumber, nextAttemptAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job, ok := s.jobs[number]; ok {
+		job.Attempts = 0
+		job.NextAttemptAt = nextAttemptAt
+		job.LastError = ""
+	}
+	return nil
+}
+
+func (s *MemStore) RequeueAccrualJob(ctx context.Context, number models.OrderNumber) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orderIdx[number]; !ok {
+		return ErrOrderNotFound
+	}
+	job, ok := s.jobs[number]
+	if !ok {
+		job = &models.AccrualJob{OrderNumber: number, CreatedAt: time.Now()}
+		s.jobs[number] = job
+	}
+	job.Attempts = 0
+	job.NextAttemptAt = time.Now()
+	job.LastError = ""
+	return nil
+}
+
+func (s *MemStore) CreateRefreshToken(ctx context.Context, token models.RefreshToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.refresh[token.TokenHash]; ok {
+		return errors.New("refresh token already exist")
+	}
+	token.CreatedAt = time.Now()
+	token.UsedAt, token.RevokedAt = nil, nil
+	s.refresh[token.TokenHash] = &token
+	return nil
+}
+
+func (s *MemStore) RotateRefreshToken(ctx context.Context, hash, nextHash string, expiresAt time.Time) (models.RefreshToken, error) {
+	if err := ctx.Err(); err != nil {
+		return models.RefreshToken{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.refresh[hash]
+	if !ok {
+		return models.RefreshToken{}, ErrRefreshTokenNotFound
+	}
+	now := time.Now()
+	if token.UsedAt != nil || token.RevokedAt != nil {
+		s.revokeFamily(token.FamilyID, now)
+		return models.RefreshToken{}, ErrRefreshTokenReused
+	}
+	if now.After(token.ExpiresAt) {
+		return models.RefreshToken{}, ErrRefreshTokenExpired
+	}
+	token.UsedAt = &now
+	next := models.RefreshToken{
+		TokenHash: nextHash,
+		UserID:    token.UserID,
+		FamilyID:  token.FamilyID,
+		ExpiresAt: expiresAt,
+		CreatedAt: now,
+	}
+	stored := next
+	s.refresh[nextHash] = &stored
+	return next, nil
+}
+
+func (s *MemStore) RevokeRefreshTokenFamily(ctx context.Context, userID, hash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.refresh[hash]
+	if !ok || token.UserID != userID {
+		return ErrRefreshTokenNotFound
+	}
+	s.revokeFamily(token.FamilyID, time.Now())
+	return nil
+}
+
+// revokeFamily must be called under the lock
+func (s *MemStore) revokeFamily(familyID string, now time.Time) {
+	for _, token := range s.refresh {
+		if token.FamilyID == familyID && token.RevokedAt == nil {
+			revokedAt := now
+			token.RevokedAt = &revokedAt
+		}
+	}
+}
+
+func (s *MemStore) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, exp := range s.revoked {
+		if exp.Before(now) {
+			delete(s.revoked, id)
+		}
+	}
+	s.revoked[jti] = expiresAt
+	return nil
+}
+
+func (s *MemStore) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.revoked[jti]
+	return ok, nil
+}
+
+func (s *MemStore) GetLoginAttempts(ctx context.Context, key string) (models.LoginAttempts, error) {
+	if err := ctx.Err(); err != nil {
+		return models.LoginAttempts{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	attempts, ok := s.attempts[key]
+	if !ok {
+		return models.LoginAttempts{Key: key}, nil
+	}
+	return attempts, nil
+}
+
+func (s *MemStore) CountLoginAttempt(ctx context.Context, key string, window time.Duration,
+	block func(failures int) time.Duration) (models.LoginAttempts, error) {
+	if err := ctx.Err(); err != nil {
+		return models.LoginAttempts{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	kind := loginKeyKind(key)
+	for k, attempts := range s.attempts {
+		if strings.HasPrefix(k, kind) && forgottenAttempts(attempts, now, window) {
+			delete(s.attempts, k)
+		}
+	}
+	attempts, ok := s.attempts[key]
+	if !ok {
+		attempts = models.LoginAttempts{Key: key}
+	}
+	if now.Before(attempts.BlockedUntil) {
+		return attempts, ErrLoginBlocked
+	}
+	nextFailure(&attempts, now, window, block)
+	s.attempts[key] = attempts
+	return attempts, nil
+}
+
+func (s *MemStore) ReleaseLoginAttempt(ctx context.Context, key string, block func(failures int) time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts, ok := s.attempts[key]
+	if !ok {
+		return nil
+	}
+	releaseAttempt(&attempts, block)
+	s.attempts[key] = attempts
+	return nil
+}
+
+func (s *MemStore) ResetLoginAttempts(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+	return nil
+}
+
+func (s *MemStore) ReserveIdempotencyKey(ctx context.Context, req models.IdempotentResponse) (models.IdempotentResponse, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return req, false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, stored := range s.idempotency {
+		if stored.ExpiresAt.Before(req.CreatedAt) {
+			delete(s.idempotency, k)
+		}
+	}
+	k := idempotencyKey{userID: req.UserID, key: req.Key}
+	if stored, ok := s.idempotency[k]; ok && stored.ExpiresAt.After(req.CreatedAt) {
+		stale := !stored.Done() && !stored.LockedUntil.After(req.CreatedAt) && stored.RequestHash == req.RequestHash
+		if !stale {
+			return stored, false, nil
+		}
+	}
+	req.Status, req.Header, req.Body = 0, nil, nil
+	s.idempotency[k] = req
+	return req, true, nil
+}
+
+func (s *MemStore) SaveIdempotentResponse(ctx context.Context, resp models.IdempotentResponse) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := idempotencyKey{userID: resp.UserID, key: resp.Key}
+	stored, ok := s.idempotency[k]
+	if !ok || stored.Done() || !stored.CreatedAt.Equal(resp.CreatedAt) {
+		return ErrIdempotencyKeyLost
+	}
+	stored.Status, stored.Header, stored.Body = resp.Status, resp.Header, resp.Body
+	s.idempotency[k] = stored
+	return nil
+}
+
+func (s *MemStore) DeleteIdempotencyKey(ctx context.Context, req models.IdempotentResponse) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := idempotencyKey{userID: req.UserID, key: req.Key}
+	if stored, ok := s.idempotency[k]; ok && !stored.Done() && stored.CreatedAt.Equal(req.CreatedAt) {
+		delete(s.idempotency, k)
+	}
+	return nil
+}
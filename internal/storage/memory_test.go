@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+)
+
+func TestMemStore_CheckLedger(t *testing.T) {
+	ctx := context.Background()
+	s := newMemStore()
+	userID, err := s.CreateUser(ctx, "user1", "hash1")
+	require.NoError(t, err)
+	require.NoError(t, s.CreateOrder(ctx, models.Order{Number: "12345678903", UserID: userID, UploadedAt: time.Now()}))
+	require.NoError(t, s.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.OrderStatusProcessed, Accrual: models.Points(700)}))
+
+	//corrupt the maintained balance
+	s.accounts[userID].balance = models.Points(1000)
+
+	list, err := s.CheckLedger(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []models.LedgerDiscrepancy{{
+		UserID:         userID,
+		Balance:        models.Points(1000),
+		JournalBalance: models.Points(700),
+	}}, list)
+}
+
+func TestMemStore_PurgeIdempotencyKeys(t *testing.T) {
+	ctx := context.Background()
+	s := newMemStore()
+	now := time.Now()
+	for i, expiresAt := range []time.Time{now.Add(time.Minute), now.Add(3 * time.Minute)} {
+		_, reserved, err := s.ReserveIdempotencyKey(ctx, models.IdempotentResponse{UserID: "1", Key: fmt.Sprint(i),
+			RequestHash: "hash1", CreatedAt: now, LockedUntil: now.Add(time.Minute), ExpiresAt: expiresAt})
+		require.NoError(t, err)
+		require.True(t, reserved)
+	}
+
+	later := now.Add(2 * time.Minute)
+	_, _, err := s.ReserveIdempotencyKey(ctx, models.IdempotentResponse{UserID: "2", Key: "0",
+		RequestHash: "hash1", CreatedAt: later, LockedUntil: later.Add(time.Minute), ExpiresAt: later.Add(time.Hour)})
+	require.NoError(t, err)
+	assert.Len(t, s.idempotency, 2)
+	_, ok := s.idempotency[idempotencyKey{userID: "1", key: "0"}]
+	assert.False(t, ok)
+}
@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+// advisory lock key, the same for all replicas
+const migrationLockKey = 72707369
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies embedded migrations and tracks them in schema_migrations table
+type Migrator struct {
+	db         *sqlx.DB
+	migrations []Migration
+}
+
+// NewMigrator connects to database and loads embedded migrations
+func NewMigrator(databaseURL string) (*Migrator, error) {
+	store, err := openStore(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMigrator(store.db)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func newMigrator(db *sqlx.DB) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFS)
+	if err != nil {
+		return nil, fmt.Errorf("load migrations failed: %w", err)
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+func (m *Migrator) Close() {
+	m.db.Close()
+}
+
+// Up applies all pending migrations and returns their count
+func (m *Migrator) Up() (int, error) {
+	applied := 0
+	err := m.withLock(func(conn *sqlx.Conn) error {
+		versions, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if _, ok := versions[mig.Version]; ok {
+				continue
+			}
+			err := inTx(conn, func(tx *sqlx.Tx) error {
+				if _, err := tx.Exec(mig.Up); err != nil {
+					return err
+				}
+				_, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)",
+					mig.Version, mig.Name, time.Now())
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s up failed: %w", mig.Version, mig.Name, err)
+			}
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down rolls back the given number of the last applied migrations
+func (m *Migrator) Down(steps int) (int, error) {
+	rolledBack := 0
+	err := m.withLock(func(conn *sqlx.Conn) error {
+		versions, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && rolledBack < steps; i-- {
+			mig := m.migrations[i]
+			if _, ok := versions[mig.Version]; !ok {
+				continue
+			}
+			err := inTx(conn, func(tx *sqlx.Tx) error {
+				if _, err := tx.Exec(mig.Down); err != nil {
+					return err
+				}
+				_, err := tx.Exec("DELETE FROM schema_migrations WHERE version=$1", mig.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s down failed: %w", mig.Version, mig.Name, err)
+			}
+			rolledBack++
+		}
+		return nil
+	})
+	return rolledBack, err
+}
+
+// Status returns all known migrations with their state
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	var list []MigrationStatus
+	err := m.withLock(func(conn *sqlx.Conn) error {
+		versions, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			appliedAt, ok := versions[mig.Version]
+			list = append(list, MigrationStatus{Migration: mig, Applied: ok, AppliedAt: appliedAt})
+		}
+		return nil
+	})
+	return list, err
+}
+
+// withLock runs fn on a single connection holding the migration advisory lock
+func (m *Migrator) withLock(fn func(conn *sqlx.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.db.Connx(ctx)
+	if err != nil {
+		return fmt.Errorf("get db connection failed: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return fmt.Errorf("acquire migration lock failed: %w", err)
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockKey)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations(
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL)`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations failed: %w", err)
+	}
+	return fn(conn)
+}
+
+func appliedVersions(conn *sqlx.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryxContext(context.Background(), "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("get applied migrations failed: %w", err)
+	}
+	defer rows.Close()
+
+	versions := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		versions[version] = appliedAt
+	}
+	return versions, rows.Err()
+}
+
+func inTx(conn *sqlx.Conn, fn func(tx *sqlx.Tx) error) error {
+	tx, err := conn.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// loadMigrations reads files named like 0001_name.up.sql and 0001_name.down.sql
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		base := path.Base(file)
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unknown migration direction: %s", base)
+		}
+		nameParts := strings.SplitN(strings.TrimSuffix(base, "."+direction+".sql"), "_", 2)
+		if len(nameParts) != 2 {
+			return nil, fmt.Errorf("invalid migration file name: %s", base)
+		}
+		version, err := strconv.Atoi(nameParts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version: %s", base)
+		}
+		body, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: nameParts[1]}
+			byVersion[version] = mig
+		} else if mig.Name != nameParts[1] {
+			return nil, fmt.Errorf("migration %04d has different names: %s and %s", version, mig.Name, nameParts[1])
+		}
+		if direction == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s must have up and down files", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFS)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	for i, mig := range migrations {
+		assert.Equal(t, i+1, mig.Version, "migration versions must be sequential")
+		assert.NotEmpty(t, mig.Up)
+		assert.NotEmpty(t, mig.Down)
+	}
+
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{name: "without down", fsys: fstest.MapFS{
+			"migrations/0001_init.up.sql": {Data: []byte("SELECT 1")},
+		}},
+		{name: "invalid version", fsys: fstest.MapFS{
+			"migrations/one_init.up.sql":   {Data: []byte("SELECT 1")},
+			"migrations/one_init.down.sql": {Data: []byte("SELECT 1")},
+		}},
+		{name: "different names", fsys: fstest.MapFS{
+			"migrations/0001_init.up.sql":    {Data: []byte("SELECT 1")},
+			"migrations/0001_other.down.sql": {Data: []byte("SELECT 1")},
+		}},
+		{name: "unknown direction", fsys: fstest.MapFS{
+			"migrations/0001_init.sql": {Data: []byte("SELECT 1")},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadMigrations(tt.fsys)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	s, teardown := TestStore(t)
+	defer teardown()
+
+	m, err := newMigrator(s.(*Store).db)
+	require.NoError(t, err)
+	total := len(m.migrations)
+
+	n, err := m.Up()
+	require.NoError(t, err)
+	assert.Equal(t, 0, n, "store is migrated on open")
+
+	n, err = m.Down(total)
+	require.NoError(t, err)
+	assert.Equal(t, total, n)
+
+	list, err := m.Status()
+	require.NoError(t, err)
+	for _, st := range list {
+		assert.False(t, st.Applied)
+	}
+
+	n, err = m.Up()
+	require.NoError(t, err)
+	assert.Equal(t, total, n)
+}
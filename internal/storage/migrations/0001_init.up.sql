@@ -0,0 +1,19 @@
+-- IF NOT EXISTS keeps this migration safe for databases created before versioned migrations
+CREATE TABLE IF NOT EXISTS users(
+    id SERIAL PRIMARY KEY,
+    login TEXT UNIQUE NOT NULL,
+    encrypted_password TEXT NOT NULL);
+
+CREATE TABLE IF NOT EXISTS orders(
+    number TEXT UNIQUE NOT NULL,
+    status VARCHAR(25),
+    sum NUMERIC DEFAULT 0,
+    user_id INTEGER NOT NULL,
+    uploaded_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ DEFAULT '0001-01-01 00:00:00 +0000');
+
+CREATE TABLE IF NOT EXISTS withdrawals(
+    order_number TEXT PRIMARY KEY NOT NULL,
+    sum NUMERIC DEFAULT 0,
+    user_id INTEGER NOT NULL,
+    processed_at TIMESTAMPTZ);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS journal_entries;
+DROP TABLE IF EXISTS accounts;
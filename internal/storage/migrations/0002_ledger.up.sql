@@ -0,0 +1,48 @@
+CREATE TABLE accounts(
+    user_id INTEGER PRIMARY KEY,
+    balance NUMERIC NOT NULL DEFAULT 0,
+    withdrawn NUMERIC NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now());
+
+-- journal entries are immutable, amount is positive for credit and negative for debit
+CREATE TABLE journal_entries(
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    kind VARCHAR(25) NOT NULL,
+    reference TEXT NOT NULL,
+    amount NUMERIC NOT NULL,
+    balance_after NUMERIC NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    UNIQUE (kind, reference));
+
+CREATE INDEX journal_entries_user_id_idx ON journal_entries(user_id, id);
+
+-- move existing history to the journal in chronological order
+INSERT INTO accounts (user_id) SELECT id FROM users;
+
+INSERT INTO journal_entries (user_id, kind, reference, amount, balance_after, created_at)
+SELECT user_id, kind, reference, amount, 0, created_at
+FROM (
+    SELECT user_id, 'accrual' AS kind, number AS reference, sum AS amount,
+           GREATEST(uploaded_at, updated_at) AS created_at
+    FROM orders WHERE sum <> 0
+    UNION ALL
+    SELECT user_id, 'withdrawal', order_number, -sum, processed_at
+    FROM withdrawals
+    ) AS q
+ORDER BY created_at;
+
+UPDATE journal_entries j SET balance_after = q.running
+FROM (
+    SELECT id, SUM(amount) OVER (PARTITION BY user_id ORDER BY id) AS running
+    FROM journal_entries
+    ) AS q
+WHERE j.id = q.id;
+
+INSERT INTO accounts (user_id)
+SELECT DISTINCT user_id FROM journal_entries
+ON CONFLICT DO NOTHING;
+
+UPDATE accounts a SET
+    balance = coalesce((SELECT SUM(amount) FROM journal_entries WHERE user_id = a.user_id), 0),
+    withdrawn = coalesce((SELECT -SUM(amount) FROM journal_entries WHERE user_id = a.user_id AND kind = 'withdrawal'), 0);
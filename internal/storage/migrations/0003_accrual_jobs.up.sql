@@ -0,0 +1,12 @@
+CREATE TABLE accrual_jobs(
+    order_number TEXT PRIMARY KEY,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now());
+
+CREATE INDEX accrual_jobs_next_attempt_at_idx ON accrual_jobs(next_attempt_at);
+
+-- orders which were polled from memory before
+INSERT INTO accrual_jobs (order_number, next_attempt_at)
+SELECT number, now() FROM orders WHERE status IN ('NEW', 'PROCESSING');
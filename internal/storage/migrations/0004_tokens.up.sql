@@ -0,0 +1,17 @@
+CREATE TABLE refresh_tokens(
+    token_hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    family_id TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ);
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens(family_id);
+
+-- revoked access tokens are kept until they expire
+CREATE TABLE revoked_tokens(
+    jti TEXT PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL);
+
+CREATE INDEX revoked_tokens_expires_at_idx ON revoked_tokens(expires_at);
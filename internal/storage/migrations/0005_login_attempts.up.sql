@@ -0,0 +1,5 @@
+CREATE TABLE login_attempts(
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    blocked_until TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01 00:00:00 +0000');
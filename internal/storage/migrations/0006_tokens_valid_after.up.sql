@@ -0,0 +1,2 @@
+-- tokens issued before the password change are rejected
+ALTER TABLE users ADD COLUMN tokens_valid_after TIMESTAMPTZ NOT NULL DEFAULT '0001-01-01 00:00:00 +0000';
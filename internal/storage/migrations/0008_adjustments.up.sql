@@ -0,0 +1,11 @@
+-- manual balance changes made by operators, each one is posted to the journal with its id as reference
+CREATE TABLE balance_adjustments(
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    amount NUMERIC NOT NULL,
+    reason VARCHAR(25) NOT NULL,
+    operator_id INTEGER NOT NULL,
+    note TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL);
+
+CREATE INDEX balance_adjustments_user_id_idx ON balance_adjustments(user_id, id);
@@ -0,0 +1,2 @@
+-- keyset pagination of the user's orders
+CREATE INDEX IF NOT EXISTS orders_user_id_uploaded_at_idx ON orders(user_id, uploaded_at, number);
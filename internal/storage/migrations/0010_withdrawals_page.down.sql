@@ -0,0 +1 @@
+DROP INDEX IF EXISTS withdrawals_user_id_processed_at_idx;
@@ -0,0 +1,2 @@
+-- keyset pagination of the user's withdrawals
+CREATE INDEX IF NOT EXISTS withdrawals_user_id_processed_at_idx ON withdrawals(user_id, processed_at, order_number);
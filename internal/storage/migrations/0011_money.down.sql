@@ -0,0 +1,5 @@
+ALTER TABLE balance_adjustments ALTER COLUMN amount TYPE NUMERIC;
+ALTER TABLE journal_entries ALTER COLUMN amount TYPE NUMERIC, ALTER COLUMN balance_after TYPE NUMERIC;
+ALTER TABLE accounts ALTER COLUMN balance TYPE NUMERIC, ALTER COLUMN withdrawn TYPE NUMERIC;
+ALTER TABLE withdrawals ALTER COLUMN sum TYPE NUMERIC;
+ALTER TABLE orders ALTER COLUMN sum TYPE NUMERIC;
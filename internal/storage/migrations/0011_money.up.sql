@@ -0,0 +1,6 @@
+-- amounts are exact with two decimal places, values written as float before are rounded
+ALTER TABLE orders ALTER COLUMN sum TYPE NUMERIC(20,2);
+ALTER TABLE withdrawals ALTER COLUMN sum TYPE NUMERIC(20,2);
+ALTER TABLE accounts ALTER COLUMN balance TYPE NUMERIC(20,2), ALTER COLUMN withdrawn TYPE NUMERIC(20,2);
+ALTER TABLE journal_entries ALTER COLUMN amount TYPE NUMERIC(20,2), ALTER COLUMN balance_after TYPE NUMERIC(20,2);
+ALTER TABLE balance_adjustments ALTER COLUMN amount TYPE NUMERIC(20,2);
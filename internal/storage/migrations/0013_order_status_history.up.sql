@@ -0,0 +1,14 @@
+-- every status the order has had, the history of existing orders starts with their current status
+CREATE TABLE order_status_history(
+    id BIGSERIAL PRIMARY KEY,
+    order_number TEXT NOT NULL,
+    status VARCHAR(25) NOT NULL,
+    changed_at TIMESTAMPTZ NOT NULL);
+
+CREATE INDEX order_status_history_order_number_idx ON order_status_history(order_number, id);
+
+INSERT INTO order_status_history (order_number, status, changed_at)
+SELECT number, 'NEW', uploaded_at FROM orders
+UNION ALL
+SELECT number, status, updated_at FROM orders WHERE status <> 'NEW'
+ORDER BY 3;
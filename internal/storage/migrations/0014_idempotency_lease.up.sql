@@ -0,0 +1,2 @@
+-- the request in progress holds the key until locked_until, then a retry may take it over
+ALTER TABLE idempotency_keys ADD COLUMN locked_until TIMESTAMPTZ NOT NULL DEFAULT now();
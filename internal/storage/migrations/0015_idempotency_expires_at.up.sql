@@ -0,0 +1,2 @@
+-- expired keys are purged when new keys are reserved
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys(expires_at);
@@ -0,0 +1,2 @@
+-- forgotten attempts are purged when new attempts are counted
+CREATE INDEX login_attempts_last_failure_at_idx ON login_attempts(last_failure_at);
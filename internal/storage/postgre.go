@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,6 +33,25 @@ func NewSQLStore(databaseURL string) (Repository, error) {
 }
 
 func newStore(databaseURL string) (*Store, error) {
+	store, err := openStore(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	//apply schema migrations
+	m, err := newMigrator(store.db)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	if _, err := m.Up(); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("migrate db error: %w", err)
+	}
+	return store, nil
+}
+
+// openStore connects to database and creates it if it doesn't exist
+func openStore(databaseURL string) (*Store, error) {
 	store := &Store{databaseURL: databaseURL}
 	if err := store.Open(); err != nil {
 		var pqError *pq.Error
@@ -47,30 +68,10 @@ func newStore(databaseURL string) (*Store, error) {
 			if err := store.Open(); err != nil {
 				return nil, fmt.Errorf("open db error: %w", err)
 			}
+		} else {
+			return nil, err
 		}
 	}
-	//create tables
-	_, err := store.db.Exec(`CREATE TABLE IF NOT EXISTS users(
-		id SERIAL PRIMARY KEY,	
-    	login TEXT UNIQUE NOT NULL,
-		encrypted_password TEXT NOT NULL);
-	CREATE TABLE IF NOT EXISTS orders(
-	    number TEXT UNIQUE NOT NULL,
-	    status VARCHAR(25),
-	    sum NUMERIC DEFAULT 0,
-	    user_id INTEGER NOT NULL,
-	    uploaded_at TIMESTAMPTZ,
-	    updated_at TIMESTAMPTZ DEFAULT '0001-01-01 00:00:00 +0000');
-	CREATE TABLE IF NOT EXISTS withdrawals(
-	    order_number TEXT PRIMARY KEY NOT NULL,
-	    sum NUMERIC DEFAULT 0,
-	    user_id INTEGER NOT NULL,
-	    processed_at TIMESTAMPTZ);`)
-
-	if err != nil {
-		fmt.Println(err)
-		return nil, fmt.Errorf("new store exec query error: %w", err)
-	}
 	return store, nil
 }
 
@@ -130,19 +131,34 @@ func (s *Store) Close() {
 	}
 }
 
-func (s *Store) CreateUser(login, encryptedPas string) (string, error) {
+func (s *Store) CreateUser(ctx context.Context, login, encryptedPas string) (string, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "-1", err
+	}
+	defer tx.Rollback()
+
 	var userID int
-	err := s.db.QueryRowx("INSERT INTO users (login, encrypted_password) VALUES ($1, $2) RETURNING id",
+	err = tx.QueryRowxContext(ctx, "INSERT INTO users (login, encrypted_password) VALUES ($1, $2) RETURNING id",
 		login, encryptedPas).Scan(&userID)
 	if err != nil {
-		return "", err
+		if errPq, ok := err.(*pq.Error); ok && errPq.Code == pgerrcode.UniqueViolation {
+			return "-1", ErrUserAlreadyExist
+		}
+		return "-1", err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO accounts (user_id) VALUES ($1)", userID); err != nil {
+		return "-1", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "-1", err
 	}
 	return fmt.Sprint(userID), nil
 }
 
-func (s *Store) UserExist(login string) (bool, error) {
+func (s *Store) UserExist(ctx context.Context, login string) (bool, error) {
 	var id int
-	err := s.db.QueryRowx("SELECT id FROM users WHERE login=$1", login).Scan(&id)
+	err := s.db.QueryRowxContext(ctx, "SELECT id FROM users WHERE login=$1", login).Scan(&id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
@@ -152,9 +168,9 @@ func (s *Store) UserExist(login string) (bool, error) {
 	return true, nil
 }
 
-func (s *Store) GetUserHashPassword(login string) (string, error) {
+func (s *Store) GetUserHashPassword(ctx context.Context, login string) (string, error) {
 	var encryptedPas string
-	err := s.db.QueryRowx("SELECT encrypted_password FROM users WHERE login=$1", login).Scan(&encryptedPas)
+	err := s.db.QueryRowxContext(ctx, "SELECT encrypted_password FROM users WHERE login=$1", login).Scan(&encryptedPas)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return "", ErrUserNotFound
@@ -164,10 +180,10 @@ func (s *Store) GetUserHashPassword(login string) (string, error) {
 	return encryptedPas, nil
 }
 
-func (s *Store) GetUserByLogin(login string) (models.User, error) {
+func (s *Store) GetUserByLogin(ctx context.Context, login string) (models.User, error) {
 	user := models.User{}
-	//err := s.db.QueryRowx("SELECT * FROM users WHERE login=$1", login).Scan(&user)
-	err := s.db.Get(&user, "SELECT * FROM users WHERE login=$1", login)
+	//err := s.db.QueryRowxContext(ctx, "SELECT * FROM users WHERE login=$1", login).Scan(&user)
+	err := s.db.GetContext(ctx, &user, "SELECT * FROM users WHERE login=$1", login)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return user, ErrUserNotFound
@@ -177,9 +193,85 @@ func (s *Store) GetUserByLogin(login string) (models.User, error) {
 	return user, nil
 }
 
-func (s *Store) GetOrderByNumber(number models.OrderNumber) (models.Order, error) {
+// validUserID reports whether the id fits users.id column
+func validUserID(userID string) bool {
+	_, err := strconv.ParseInt(userID, 10, 32)
+	return err == nil
+}
+
+func (s *Store) GetUserByID(ctx context.Context, userID string) (models.User, error) {
+	user := models.User{}
+	//the id of the path may be anything, Postgres would fail comparing it with INTEGER column
+	if !validUserID(userID) {
+		return user, ErrUserNotFound
+	}
+	err := s.db.GetContext(ctx, &user, "SELECT * FROM users WHERE id=$1", userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return user, ErrUserNotFound
+		}
+		return user, err
+	}
+	return user, nil
+}
+
+func (s *Store) UpdateUserPassword(ctx context.Context, userID, encryptedPas string) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE users SET encrypted_password=$1 WHERE id=$2", encryptedPas, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err != nil {
+			return err
+		}
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *Store) ChangeUserPassword(ctx context.Context, userID, encryptedPas string, validAfter time.Time) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE users SET encrypted_password=$1, tokens_valid_after=$2 WHERE id=$3",
+		encryptedPas, validAfter, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err != nil {
+			return err
+		}
+		return ErrUserNotFound
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at=$1 WHERE user_id=$2 AND revoked_at IS NULL",
+		time.Now(), userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) SetUserRole(ctx context.Context, userID string, role models.Role) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE users SET role=$1 WHERE id=$2", role, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err != nil {
+			return err
+		}
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *Store) GetOrderByNumber(ctx context.Context, number models.OrderNumber) (models.Order, error) {
 	order := models.Order{}
-	err := s.db.Get(&order, "SELECT * FROM orders WHERE number=$1", number)
+	err := s.db.GetContext(ctx, &order, "SELECT * FROM orders WHERE number=$1", number)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return order, ErrOrderNotFound
@@ -189,18 +281,38 @@ func (s *Store) GetOrderByNumber(number models.OrderNumber) (models.Order, error
 	return order, nil
 }
 
-func (s *Store) CreateOrder(order models.Order) error {
-	_, err := s.db.Exec("INSERT INTO orders (number, user_id, uploaded_at, status) VALUES ($1, $2, $3, $4)",
+// CreateOrder saves the order and enqueues the job for getting its status from the accrual system
+func (s *Store) CreateOrder(ctx context.Context, order models.Order) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO orders (number, user_id, uploaded_at, status) VALUES ($1, $2, $3, $4)",
 		order.Number, order.UserID, order.UploadedAt, models.OrderStatusNew)
 	if err != nil {
+		if errPq, ok := err.(*pq.Error); ok && errPq.Code == pgerrcode.UniqueViolation {
+			return ErrOrderAlreadyExist
+		}
 		return err
 	}
-	return nil
+	_, err = tx.ExecContext(ctx, "INSERT INTO order_status_history (order_number, status, changed_at) VALUES ($1, $2, $3)",
+		order.Number, models.OrderStatusNew, order.UploadedAt)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO accrual_jobs (order_number, next_attempt_at) VALUES ($1, $2)",
+		order.Number, time.Now())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (s *Store) GetOrderListByUserID(userID string) ([]models.Order, error) {
+func (s *Store) GetOrderListByUserID(ctx context.Context, userID string) ([]models.Order, error) {
 	orderList := []models.Order{}
-	err := s.db.Select(&orderList, "SELECT * FROM orders WHERE user_id=$1 ORDER BY uploaded_at ASC", userID)
+	err := s.db.SelectContext(ctx, &orderList, "SELECT * FROM orders WHERE user_id=$1 ORDER BY uploaded_at ASC", userID)
 	if err != nil && err != sql.ErrNoRows {
 		return orderList, err
 	} else {
@@ -208,33 +320,67 @@ func (s *Store) GetOrderListByUserID(userID string) ([]models.Order, error) {
 	}
 }
 
-func (s *Store) GetBalanceByUserID(userID string) (models.SumScore, error) {
+func (s *Store) GetOrderPage(ctx context.Context, userID string, filter models.OrderFilter) ([]models.Order, error) {
+	orderList := []models.Order{}
+	query := "SELECT * FROM orders WHERE user_id=$1"
+	args := []interface{}{userID}
+	if len(filter.Statuses) > 0 {
+		statuses := make([]string, len(filter.Statuses))
+		for i, status := range filter.Statuses {
+			statuses[i] = string(status)
+		}
+		args = append(args, pq.Array(statuses))
+		query += fmt.Sprintf(" AND status = ANY($%d)", len(args))
+	}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		query += fmt.Sprintf(" AND uploaded_at>=$%d", len(args))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		query += fmt.Sprintf(" AND uploaded_at<$%d", len(args))
+	}
+	direction, cmp := "ASC", ">"
+	if filter.Desc {
+		direction, cmp = "DESC", "<"
+	}
+	if filter.After != nil {
+		args = append(args, filter.After.UploadedAt, filter.After.Number)
+		query += fmt.Sprintf(" AND (uploaded_at, number) %s ($%d, $%d)", cmp, len(args)-1, len(args))
+	}
+	query += fmt.Sprintf(" ORDER BY uploaded_at %s, number %s", direction, direction)
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	err := s.db.SelectContext(ctx, &orderList, query, args...)
+	if err != nil && err != sql.ErrNoRows {
+		return orderList, err
+	}
+	return orderList, nil
+}
+
+func (s *Store) GetBalanceByUserID(ctx context.Context, userID string) (models.SumScore, error) {
 	var bal models.SumScore = 0
-	//err := s.db.Get(&bal, "SELECT coalesce(SUM(sum), 0) FROM orders WHERE user_id=$1", userID)
-	err := s.db.Get(&bal, `SELECT coalesce(SUM(sum), 0)
-    FROM (
-		SELECT sum FROM orders WHERE user_id=$1
-		UNION ALL 
-		SELECT -sum FROM withdrawals WHERE user_id=$1
-		) AS q`, userID)
+	err := s.db.GetContext(ctx, &bal, "SELECT balance FROM accounts WHERE user_id=$1", userID)
 	if err != nil && err != sql.ErrNoRows {
 		return -1, err
 	}
 	return bal, nil
 }
 
-func (s *Store) GetWithdrawalsByUserID(userID string) (models.SumScore, error) {
+func (s *Store) GetWithdrawalsByUserID(ctx context.Context, userID string) (models.SumScore, error) {
 	var bal models.SumScore = 0
-	err := s.db.Get(&bal, "SELECT coalesce(SUM(sum), 0) FROM withdrawals WHERE user_id=$1", userID)
-	if err != nil {
+	err := s.db.GetContext(ctx, &bal, "SELECT withdrawn FROM accounts WHERE user_id=$1", userID)
+	if err != nil && err != sql.ErrNoRows {
 		return -1, err
 	}
 	return bal, nil
 }
 
-func (s *Store) GetWithdrawalsListByUserID(userID string) ([]models.OrderWithdraw, error) {
+func (s *Store) GetWithdrawalsListByUserID(ctx context.Context, userID string) ([]models.OrderWithdraw, error) {
 	withdrawList := []models.OrderWithdraw{}
-	err := s.db.Select(&withdrawList, `SELECT order_number, sum, processed_at FROM withdrawals WHERE user_id=$1 
+	err := s.db.SelectContext(ctx, &withdrawList, `SELECT order_number, sum, processed_at FROM withdrawals WHERE user_id=$1 
                                                  ORDER BY processed_at ASC`, userID)
 	if err != nil && err != sql.ErrNoRows {
 		return withdrawList, err
@@ -243,19 +389,76 @@ func (s *Store) GetWithdrawalsListByUserID(userID string) ([]models.OrderWithdra
 	}
 }
 
-func (s *Store) CreateWithdraw(userID string, withdraw models.WithdrawRequest) error {
-	_, err := s.db.Exec("INSERT INTO withdrawals (user_id, order_number, sum, processed_at) VALUES ($1, $2, $3, $4)",
+func (s *Store) GetWithdrawalPage(ctx context.Context, userID string, filter models.WithdrawalFilter) ([]models.OrderWithdraw, error) {
+	withdrawList := []models.OrderWithdraw{}
+	query := "SELECT order_number, sum, processed_at FROM withdrawals WHERE user_id=$1"
+	args := []interface{}{userID}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		query += fmt.Sprintf(" AND processed_at>=$%d", len(args))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		query += fmt.Sprintf(" AND processed_at<$%d", len(args))
+	}
+	if filter.MinSum != 0 {
+		args = append(args, filter.MinSum)
+		query += fmt.Sprintf(" AND sum>=$%d", len(args))
+	}
+	if filter.MaxSum != 0 {
+		args = append(args, filter.MaxSum)
+		query += fmt.Sprintf(" AND sum<=$%d", len(args))
+	}
+	if filter.After != nil {
+		args = append(args, filter.After.ProcessedAt, filter.After.OrderNumber)
+		query += fmt.Sprintf(" AND (processed_at, order_number) > ($%d, $%d)", len(args)-1, len(args))
+	}
+	query += " ORDER BY processed_at ASC, order_number ASC"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	err := s.db.SelectContext(ctx, &withdrawList, query, args...)
+	if err != nil && err != sql.ErrNoRows {
+		return withdrawList, err
+	}
+	return withdrawList, nil
+}
+
+func (s *Store) WithdrawTx(ctx context.Context, userID string, withdraw models.WithdrawRequest) error {
+	//the negative sum would credit the account
+	if withdraw.Sum <= 0 {
+		return ErrInvalidSum
+	}
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	//lock the user's account so concurrent withdrawals of this user are serialized
+	bal, err := lockAccount(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	if bal < withdraw.Sum {
+		return ErrNotEnoughFunds
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO withdrawals (user_id, order_number, sum, processed_at) VALUES ($1, $2, $3, $4)",
 		userID, withdraw.OrderNumber, withdraw.Sum, time.Now())
 	if err != nil {
-		if errPq, ok := err.(*pq.Error); ok && errPq.Code == "23505" {
-			return ErrWithdrawAlreadyExist //err.Code.Name()
+		if errPq, ok := err.(*pq.Error); ok && errPq.Code == pgerrcode.UniqueViolation {
+			return ErrWithdrawAlreadyExist
 		}
 		return err
 	}
-	return nil
+	if _, err := postEntry(ctx, tx, userID, models.EntryKindWithdrawal, withdraw.OrderNumber, -withdraw.Sum); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (s *Store) GetOrdersWithStatus(status ...models.OrderStatus) ([]models.OrderNumber, error) {
+func (s *Store) GetOrdersWithStatus(ctx context.Context, status ...models.OrderStatus) ([]models.OrderNumber, error) {
 	orderNumbers := []models.OrderNumber{}
 	if len(status) == 0 {
 		return orderNumbers, errors.New("there is no status")
@@ -271,7 +474,7 @@ func (s *Store) GetOrdersWithStatus(status ...models.OrderStatus) ([]models.Orde
 	} else {
 		str = strStat[0]
 	}
-	err := s.db.Select(&orderNumbers,
+	err := s.db.SelectContext(ctx, &orderNumbers,
 		fmt.Sprintf("SELECT number FROM orders WHERE %s ORDER BY uploaded_at ASC", str))
 	if err != nil && err != sql.ErrNoRows {
 		return orderNumbers, err
@@ -279,11 +482,63 @@ func (s *Store) GetOrdersWithStatus(status ...models.OrderStatus) ([]models.Orde
 	return orderNumbers, nil
 }
 
-func (s *Store) UpdateOrder(ord models.Order) error {
-	_, err := s.db.Exec("UPDATE orders SET status=$1, sum=$2, updated_at=$3 WHERE number=$4",
-		ord.Status, ord.Accrual, time.Now(), ord.Number)
+func (s *Store) UpdateOrder(ctx context.Context, ord models.Order) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+
+	cur := models.Order{}
+	err = tx.GetContext(ctx, &cur, "SELECT * FROM orders WHERE number=$1 FOR UPDATE", ord.Number)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	if cur.Status == ord.Status && cur.Accrual == ord.Accrual {
+		return nil
+	}
+	if !cur.Status.CanTransitionTo(ord.Status) {
+		return fmt.Errorf("%w: %s to %s", ErrOrderStatusConflict, cur.Status, ord.Status)
+	}
+	prev := make([]string, 0, 2)
+	for _, status := range ord.Status.PreviousStatuses() {
+		prev = append(prev, string(status))
+	}
+	now := time.Now()
+	//the status is checked by the update too, so the state machine holds for any writer of the table
+	res, err := tx.ExecContext(ctx, "UPDATE orders SET status=$1, sum=$2, updated_at=$3 WHERE number=$4 AND status = ANY($5)",
+		ord.Status, ord.Accrual, now, ord.Number, pq.Array(prev))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%w: %s to %s", ErrOrderStatusConflict, cur.Status, ord.Status)
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO order_status_history (order_number, status, changed_at) VALUES ($1, $2, $3)",
+		ord.Number, ord.Status, now)
+	if err != nil {
+		return err
+	}
+	//credit accrual to the user's account
+	if ord.Status == models.OrderStatusProcessed && ord.Accrual != 0 {
+		if _, err := postEntry(ctx, tx, cur.UserID, models.EntryKindAccrual, string(ord.Number), ord.Accrual); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) GetOrderStatusHistory(ctx context.Context, number models.OrderNumber) ([]models.OrderStatusChange, error) {
+	history := []models.OrderStatusChange{}
+	err := s.db.SelectContext(ctx, &history, "SELECT status, changed_at FROM order_status_history WHERE order_number=$1 ORDER BY id",
+		number)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return history, nil
 }
@@ -1,18 +1,19 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
 )
 
 func TestMain(m *testing.M) {
-	DatabaseTestURL = os.Getenv("databaseTestURL")
-	if DatabaseTestURL == "" {
-		DatabaseTestURL = "host=localhost dbname=gophermart_test user=postgres password=123 sslmode=disable"
-	}
+	DatabaseTestURL, _ = TestDatabaseURL()
 	os.Exit(m.Run())
 }
 
@@ -24,6 +25,7 @@ func teardown(t *testing.T, s *Store, tables ...string) {
 }
 
 func TestStore_CreateUser(t *testing.T) {
+	ctx := context.Background()
 	type args struct {
 		login        string
 		encryptedPas string
@@ -56,7 +58,7 @@ func TestStore_CreateUser(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			userID, err := s.CreateUser(tt.args.login, tt.args.encryptedPas)
+			userID, err := s.CreateUser(ctx, tt.args.login, tt.args.encryptedPas)
 			if tt.wantErr {
 				assert.NotNil(t, err)
 				assert.Equal(t, "-1", userID)
@@ -68,3 +70,49 @@ func TestStore_CreateUser(t *testing.T) {
 		})
 	}
 }
+
+//the query waiting for a locked account must be aborted by the context deadline
+func TestStore_WithdrawTxDeadline(t *testing.T) {
+	ctx := context.Background()
+	repo, teardown := TestStore(t)
+	defer teardown("users", "accounts")
+	s := repo.(*Store)
+
+	userID, err := s.CreateUser(ctx, "user1", "hash1")
+	assert.NoError(t, err)
+	tx, err := s.db.BeginTxx(ctx, nil)
+	assert.NoError(t, err)
+	defer tx.Rollback()
+	_, err = lockAccount(ctx, tx, userID)
+	assert.NoError(t, err)
+
+	reqCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = s.WithdrawTx(reqCtx, userID, models.WithdrawRequest{OrderNumber: "2377225624", Sum: models.Points(1)})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestStore_PurgeIdempotencyKeys(t *testing.T) {
+	ctx := context.Background()
+	repo, teardown := TestStore(t)
+	defer teardown("idempotency_keys")
+	s := repo.(*Store)
+
+	now := time.Now()
+	for i, expiresAt := range []time.Time{now.Add(time.Minute), now.Add(3 * time.Minute)} {
+		_, reserved, err := s.ReserveIdempotencyKey(ctx, models.IdempotentResponse{UserID: "1", Key: fmt.Sprint(i),
+			RequestHash: "hash1", CreatedAt: now, LockedUntil: now.Add(time.Minute), ExpiresAt: expiresAt})
+		assert.NoError(t, err)
+		assert.True(t, reserved)
+	}
+
+	later := now.Add(2 * time.Minute)
+	_, _, err := s.ReserveIdempotencyKey(ctx, models.IdempotentResponse{UserID: "2", Key: "0",
+		RequestHash: "hash1", CreatedAt: later, LockedUntil: later.Add(time.Minute), ExpiresAt: later.Add(time.Hour)})
+	assert.NoError(t, err)
+	var keys []string
+	assert.NoError(t, s.db.SelectContext(ctx, &keys, "SELECT user_id || ':' || key FROM idempotency_keys ORDER BY 1"))
+	assert.Equal(t, []string{"1:1", "2:0"}, keys)
+}
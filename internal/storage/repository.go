@@ -1,28 +1,122 @@
 package storage
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"time"
+
 	"github.com/OlegMzhelskiy/gophermart/internal/models"
 )
 
+const (
+	TypePostgres = "postgres"
+	TypeMemory   = "memory"
+)
+
 var (
 	ErrUserNotFound         = errors.New("user not found")
+	ErrUserAlreadyExist     = errors.New("user with this login already exist")
 	ErrOrderNotFound        = errors.New("order not found")
+	ErrOrderAlreadyExist    = errors.New("order already exist")
 	ErrWithdrawAlreadyExist = errors.New("withdraw on this order already exist")
+	ErrNotEnoughFunds       = errors.New("not enough funds in the account")
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenExpired  = errors.New("refresh token expired")
+	ErrRefreshTokenReused   = errors.New("refresh token was already used")
+	ErrOrderStatusConflict  = errors.New("order status can't be changed to this status")
+	ErrLoginBlocked         = errors.New("login attempts are blocked")
+	ErrInvalidSum           = errors.New("sum must be positive")
+	ErrIdempotencyKeyLost   = errors.New("idempotency key isn't reserved by the request")
 )
 
 type Repository interface {
 	Open() error
 	Close()
-	CreateUser(login, password string) (string, error)
-	GetUserByLogin(login string) (models.User, error)
-	GetOrderByNumber(number models.OrderNumber) (models.Order, error)
-	CreateOrder(order models.Order) error
-	GetOrderListByUserID(userID string) ([]models.Order, error)
-	GetBalanceByUserID(userID string) (models.SumScore, error)
-	GetWithdrawalsByUserID(userID string) (models.SumScore, error)
-	CreateWithdraw(userID string, withdraw models.WithdrawRequest) error
-	GetWithdrawalsListByUserID(userID string) ([]models.OrderWithdraw, error)
-	GetOrdersWithStatus(status ...models.OrderStatus) ([]models.OrderNumber, error)
-	UpdateOrder(models.Order) error
+	CreateUser(ctx context.Context, login, password string) (string, error)
+	GetUserByLogin(ctx context.Context, login string) (models.User, error)
+	GetUserByID(ctx context.Context, userID string) (models.User, error)
+	// UpdateUserPassword replaces the password hash, e.g. rehashed with another cost
+	UpdateUserPassword(ctx context.Context, userID, encryptedPassword string) error
+	// ChangeUserPassword replaces the password hash, invalidates tokens issued before validAfter
+	// and revokes all refresh tokens of the user
+	ChangeUserPassword(ctx context.Context, userID, encryptedPassword string, validAfter time.Time) error
+	SetUserRole(ctx context.Context, userID string, role models.Role) error
+	GetOrderByNumber(ctx context.Context, number models.OrderNumber) (models.Order, error)
+	// CreateOrder saves the order and enqueues the job for getting its status from the accrual system
+	CreateOrder(ctx context.Context, order models.Order) error
+	GetOrderListByUserID(ctx context.Context, userID string) ([]models.Order, error)
+	// GetOrderPage returns the user's orders matching the filter ordered by uploaded_at and number
+	GetOrderPage(ctx context.Context, userID string, filter models.OrderFilter) ([]models.Order, error)
+	GetBalanceByUserID(ctx context.Context, userID string) (models.SumScore, error)
+	GetWithdrawalsByUserID(ctx context.Context, userID string) (models.SumScore, error)
+	// WithdrawTx atomically checks user's balance and debits it
+	WithdrawTx(ctx context.Context, userID string, withdraw models.WithdrawRequest) error
+	GetWithdrawalsListByUserID(ctx context.Context, userID string) ([]models.OrderWithdraw, error)
+	// GetWithdrawalPage returns the user's withdrawals matching the filter ordered by processed_at and order number
+	GetWithdrawalPage(ctx context.Context, userID string, filter models.WithdrawalFilter) ([]models.OrderWithdraw, error)
+	GetOrdersWithStatus(ctx context.Context, status ...models.OrderStatus) ([]models.OrderNumber, error)
+	// UpdateOrder changes the status and accrual of the order and records the change in the status history.
+	// The change not allowed by the order state machine returns ErrOrderStatusConflict,
+	// repeating the current status and accrual does nothing.
+	UpdateOrder(ctx context.Context, order models.Order) error
+	// GetOrderStatusHistory returns the statuses of the order, the oldest first
+	GetOrderStatusHistory(ctx context.Context, number models.OrderNumber) ([]models.OrderStatusChange, error)
+	GetJournalByUserID(ctx context.Context, userID string) ([]models.JournalEntry, error)
+	// GetJournalPage returns the user's entries matching the filter ordered by ID
+	GetJournalPage(ctx context.Context, userID string, filter models.JournalFilter) ([]models.JournalEntry, error)
+	// CreateAdjustment atomically saves the adjustment and posts it to the user's account,
+	// debit exceeding the balance returns ErrNotEnoughFunds
+	CreateAdjustment(ctx context.Context, adj models.Adjustment) (models.Adjustment, error)
+	GetAdjustmentsByUserID(ctx context.Context, userID string) ([]models.Adjustment, error)
+	// CheckLedger recomputes balances from the journal and returns accounts that don't match
+	CheckLedger(ctx context.Context) ([]models.LedgerDiscrepancy, error)
+	// ClaimAccrualJobs returns due jobs and hides them from other workers for the lease time
+	ClaimAccrualJobs(ctx context.Context, limit int, lease time.Duration) ([]models.AccrualJob, error)
+	CompleteAccrualJob(ctx context.Context, number models.OrderNumber) error
+	RetryAccrualJob(ctx context.Context, number models.OrderNumber, nextAttemptAt time.Time, lastErr string) error
+	// PostponeAccrualJob makes the job due at nextAttemptAt with reset attempts, the order is still being processed
+	PostponeAccrualJob(ctx context.Context, number models.OrderNumber, nextAttemptAt time.Time) error
+	// RequeueAccrualJob makes the order's job due now with reset attempts, the job is created if it was completed
+	RequeueAccrualJob(ctx context.Context, number models.OrderNumber) error
+	CreateRefreshToken(ctx context.Context, token models.RefreshToken) error
+	// RotateRefreshToken marks the token used and saves its successor of the same family.
+	// Presenting a used or revoked token revokes the whole family and returns ErrRefreshTokenReused.
+	RotateRefreshToken(ctx context.Context, hash, nextHash string, expiresAt time.Time) (models.RefreshToken, error)
+	// RevokeRefreshTokenFamily revokes the family of the user's token
+	RevokeRefreshTokenFamily(ctx context.Context, userID, hash string) error
+	// RevokeAccessToken adds the token to the revocation list until it expires
+	RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error)
+	GetLoginAttempts(ctx context.Context, key string) (models.LoginAttempts, error)
+	// CountLoginAttempt counts the attempt as a failure before the password is checked, the counter restarts
+	// if the previous failure is older than window. block returns for how long the key is blocked after
+	// the given number of failures. The attempt of the blocked key isn't counted, ErrLoginBlocked is returned
+	// with the attempts. Keys of one kind, e.g. "ip:", share the window, their rows which aren't blocked
+	// and have no failures within the window are purged.
+	CountLoginAttempt(ctx context.Context, key string, window time.Duration, block func(failures int) time.Duration) (models.LoginAttempts, error)
+	// ReleaseLoginAttempt uncounts the attempt which hasn't failed
+	ReleaseLoginAttempt(ctx context.Context, key string, block func(failures int) time.Duration) error
+	ResetLoginAttempts(ctx context.Context, key string) error
+	// ReserveIdempotencyKey saves the request if the user's key isn't stored, has expired or the same request
+	// holding it has been locked for too long, and returns true.
+	// Otherwise the stored request, in progress or with the response, is returned. Expired keys are purged.
+	ReserveIdempotencyKey(ctx context.Context, req models.IdempotentResponse) (models.IdempotentResponse, bool, error)
+	// SaveIdempotentResponse stores the response to the request reserved at resp.CreatedAt,
+	// ErrIdempotencyKeyLost is returned if the reservation has been taken over
+	SaveIdempotentResponse(ctx context.Context, resp models.IdempotentResponse) error
+	// DeleteIdempotencyKey releases the key reserved at req.CreatedAt, so the request may be repeated
+	DeleteIdempotencyKey(ctx context.Context, req models.IdempotentResponse) error
+}
+
+// New creates repository of the given storage type
+func New(storageType, databaseURL string) (Repository, error) {
+	switch storageType {
+	case TypePostgres, "":
+		return NewSQLStore(databaseURL)
+	case TypeMemory:
+		return NewMemStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage type: %s", storageType)
+	}
 }
@@ -0,0 +1,926 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+)
+
+type storeFactory func(t *testing.T) (Repository, func(...string))
+
+var allTables = []string{"users", "orders", "withdrawals", "accounts", "journal_entries", "accrual_jobs", "refresh_tokens", "revoked_tokens", "login_attempts", "balance_adjustments", "idempotency_keys", "order_status_history"}
+
+// conformance tests run against every Repository implementation
+func TestRepository(t *testing.T) {
+	factories := []struct {
+		name string
+		new  storeFactory
+	}{
+		{name: TypeMemory, new: TestMemStore},
+		{name: TypePostgres, new: TestStore},
+	}
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s Repository)
+	}{
+		{name: "users", run: testRepositoryUsers},
+		{name: "user password", run: testRepositoryUserPassword},
+		{name: "user role", run: testRepositoryUserRole},
+		{name: "orders", run: testRepositoryOrders},
+		{name: "orders with status", run: testRepositoryOrdersWithStatus},
+		{name: "order page", run: testRepositoryOrderPage},
+		{name: "order status transitions", run: testRepositoryOrderStatus},
+		{name: "withdrawals and balance", run: testRepositoryWithdrawals},
+		{name: "concurrent withdrawals", run: testRepositoryConcurrentWithdrawals},
+		{name: "withdrawal page", run: testRepositoryWithdrawalPage},
+		{name: "ledger", run: testRepositoryLedger},
+		{name: "adjustments", run: testRepositoryAdjustments},
+		{name: "journal page", run: testRepositoryJournalPage},
+		{name: "cancelled context", run: testRepositoryCancelledContext},
+		{name: "accrual jobs", run: testRepositoryAccrualJobs},
+		{name: "concurrent accrual job claims", run: testRepositoryConcurrentClaims},
+		{name: "requeue accrual job", run: testRepositoryRequeueAccrualJob},
+		{name: "refresh tokens", run: testRepositoryRefreshTokens},
+		{name: "revoked access tokens", run: testRepositoryRevokedTokens},
+		{name: "login attempts", run: testRepositoryLoginAttempts},
+		{name: "purge login attempts", run: testRepositoryPurgeLoginAttempts},
+		{name: "concurrent login failures", run: testRepositoryConcurrentLoginFailures},
+		{name: "idempotency keys", run: testRepositoryIdempotencyKeys},
+	}
+	for _, f := range factories {
+		t.Run(f.name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					s, teardown := f.new(t)
+					defer teardown(allTables...)
+					tt.run(t, s)
+				})
+			}
+		})
+	}
+}
+
+func testRepositoryUsers(t *testing.T, s Repository) {
+	ctx := context.Background()
+	userID, err := s.CreateUser(ctx, "user1", "hash1")
+	require.NoError(t, err)
+	assert.NotEqual(t, "-1", userID)
+
+	userID2, err := s.CreateUser(ctx, "user1", "hash2")
+	assert.ErrorIs(t, err, ErrUserAlreadyExist)
+	assert.Equal(t, "-1", userID2)
+
+	user, err := s.GetUserByLogin(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, userID, user.ID)
+	assert.Equal(t, "hash1", user.EncryptedPassword)
+
+	_, err = s.GetUserByLogin(ctx, "unknown")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func testRepositoryOrders(t *testing.T, s Repository) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	orders := []models.Order{
+		{Number: "12345678903", UserID: "1", UploadedAt: now},
+		{Number: "79927398713", UserID: "1", UploadedAt: now.Add(-time.Minute)},
+		{Number: "4561261212345467", UserID: "2", UploadedAt: now},
+	}
+	for _, ord := range orders {
+		require.NoError(t, s.CreateOrder(ctx, ord))
+	}
+	assert.ErrorIs(t, s.CreateOrder(ctx, orders[0]), ErrOrderAlreadyExist)
+
+	ord, err := s.GetOrderByNumber(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, "1", ord.UserID)
+	assert.Equal(t, models.OrderStatusNew, ord.Status)
+
+	_, err = s.GetOrderByNumber(ctx, "0")
+	assert.ErrorIs(t, err, ErrOrderNotFound)
+
+	list, err := s.GetOrderListByUserID(ctx, "1")
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, models.OrderNumber("79927398713"), list[0].Number)
+	assert.Equal(t, models.OrderNumber("12345678903"), list[1].Number)
+
+	list, err = s.GetOrderListByUserID(ctx, "3")
+	require.NoError(t, err)
+	assert.Empty(t, list)
+
+	err = s.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.OrderStatusProcessed, Accrual: models.Points(500)})
+	require.NoError(t, err)
+	ord, err = s.GetOrderByNumber(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusProcessed, ord.Status)
+	assert.Equal(t, models.Points(500), ord.Accrual)
+}
+
+func testRepositoryOrdersWithStatus(t *testing.T, s Repository) {
+	ctx := context.Background()
+	now := time.Now()
+	require.NoError(t, s.CreateOrder(ctx, models.Order{Number: "12345678903", UserID: "1", UploadedAt: now}))
+	require.NoError(t, s.CreateOrder(ctx, models.Order{Number: "79927398713", UserID: "1", UploadedAt: now.Add(time.Second)}))
+	require.NoError(t, s.CreateOrder(ctx, models.Order{Number: "4561261212345467", UserID: "1", UploadedAt: now.Add(2 * time.Second)}))
+	require.NoError(t, s.UpdateOrder(ctx, models.Order{Number: "79927398713", Status: models.OrderStatusProcessing}))
+	require.NoError(t, s.UpdateOrder(ctx, models.Order{Number: "4561261212345467", Status: models.OrderStatusInvalid}))
+
+	numbers, err := s.GetOrdersWithStatus(ctx, models.OrderStatusProcessing, models.OrderStatusNew)
+	require.NoError(t, err)
+	assert.Equal(t, []models.OrderNumber{"12345678903", "79927398713"}, numbers)
+
+	_, err = s.GetOrdersWithStatus(ctx)
+	assert.Error(t, err)
+}
+
+func testRepositoryWithdrawals(t *testing.T, s Repository) {
+	ctx := context.Background()
+	userID, err := s.CreateUser(ctx, "user1", "hash1")
+	require.NoError(t, err)
+	require.NoError(t, s.CreateOrder(ctx, models.Order{Number: "12345678903", UserID: userID, UploadedAt: time.Now()}))
+	require.NoError(t, s.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.OrderStatusProcessed, Accrual: models.Points(700)}))
+
+	bal, err := s.GetBalanceByUserID(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Points(700), bal)
+
+	require.NoError(t, s.WithdrawTx(ctx, userID, models.WithdrawRequest{OrderNumber: "2377225624", Sum: models.Points(200)}))
+	require.NoError(t, s.WithdrawTx(ctx, userID, models.WithdrawRequest{OrderNumber: "79927398713", Sum: models.Points(50)}))
+	err = s.WithdrawTx(ctx, userID, models.WithdrawRequest{OrderNumber: "2377225624", Sum: models.Points(10)})
+	assert.ErrorIs(t, err, ErrWithdrawAlreadyExist)
+	err = s.WithdrawTx(ctx, userID, models.WithdrawRequest{OrderNumber: "4561261212345467", Sum: models.Points(451)})
+	assert.ErrorIs(t, err, ErrNotEnoughFunds)
+	err = s.WithdrawTx(ctx, "100500", models.WithdrawRequest{OrderNumber: "4561261212345467", Sum: models.Points(1)})
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	//the negative sum must not credit the account
+	for _, sum := range []models.SumScore{0, -models.Points(1000), -1} {
+		err = s.WithdrawTx(ctx, userID, models.WithdrawRequest{OrderNumber: "4561261212345467", Sum: sum})
+		assert.ErrorIs(t, err, ErrInvalidSum, sum)
+	}
+
+	bal, err = s.GetBalanceByUserID(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Points(450), bal)
+
+	withdrawn, err := s.GetWithdrawalsByUserID(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Points(250), withdrawn)
+
+	list, err := s.GetWithdrawalsListByUserID(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "2377225624", list[0].OrderNumber)
+	assert.Equal(t, models.Points(200), list[0].Sum)
+
+	list, err = s.GetWithdrawalsListByUserID(ctx, "100500")
+	require.NoError(t, err)
+	assert.Empty(t, list)
+}
+
+// parallel withdrawals must never drive the balance below zero
+func testRepositoryConcurrentWithdrawals(t *testing.T, s Repository) {
+	ctx := context.Background()
+	const (
+		funds    = 100
+		requests = 300
+	)
+	userID, err := s.CreateUser(ctx, "user1", "hash1")
+	require.NoError(t, err)
+	require.NoError(t, s.CreateOrder(ctx, models.Order{Number: "12345678903", UserID: userID, UploadedAt: time.Now()}))
+	require.NoError(t, s.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.OrderStatusProcessed, Accrual: models.Points(funds)}))
+
+	var succeeded, rejected int64
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := s.WithdrawTx(ctx, userID, models.WithdrawRequest{OrderNumber: fmt.Sprintf("w%d", i), Sum: models.Points(1)})
+			switch {
+			case err == nil:
+				atomic.AddInt64(&succeeded, 1)
+			case errors.Is(err, ErrNotEnoughFunds):
+				atomic.AddInt64(&rejected, 1)
+			default:
+				t.Errorf("WithdrawTx() unexpected error: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(funds), succeeded)
+	assert.Equal(t, int64(requests-funds), rejected)
+	bal, err := s.GetBalanceByUserID(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Points(0), bal)
+}
+
+func testRepositoryLedger(t *testing.T, s Repository) {
+	ctx := context.Background()
+	userID, err := s.CreateUser(ctx, "user1", "hash1")
+	require.NoError(t, err)
+	require.NoError(t, s.CreateOrder(ctx, models.Order{Number: "12345678903", UserID: userID, UploadedAt: time.Now()}))
+	processed := models.Order{Number: "12345678903", Status: models.OrderStatusProcessed, Accrual: models.Points(700)}
+	require.NoError(t, s.UpdateOrder(ctx, processed))
+	//repeated update must not credit the accrual twice
+	require.NoError(t, s.UpdateOrder(ctx, processed))
+	require.NoError(t, s.WithdrawTx(ctx, userID, models.WithdrawRequest{OrderNumber: "2377225624", Sum: models.Points(200)}))
+
+	entries, err := s.GetJournalByUserID(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, models.EntryKindAccrual, entries[0].Kind)
+	assert.Equal(t, "12345678903", entries[0].Reference)
+	assert.Equal(t, models.Points(700), entries[0].Amount)
+	assert.Equal(t, models.Points(700), entries[0].BalanceAfter)
+	assert.Equal(t, models.EntryKindWithdrawal, entries[1].Kind)
+	assert.Equal(t, models.Points(-200), entries[1].Amount)
+	assert.Equal(t, models.Points(500), entries[1].BalanceAfter)
+
+	bal, err := s.GetBalanceByUserID(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Points(500), bal)
+
+	list, err := s.CheckLedger(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, list)
+}
+
+func testRepositoryCancelledContext(t *testing.T, s Repository) {
+	userID, err := s.CreateUser(context.Background(), "user1", "hash1")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = s.CreateUser(ctx, "user2", "hash2")
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = s.GetOrderByNumber(ctx, "12345678903")
+	assert.ErrorIs(t, err, context.Canceled)
+	err = s.WithdrawTx(ctx, userID, models.WithdrawRequest{OrderNumber: "2377225624", Sum: models.Points(1)})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = s.GetUserByLogin(context.Background(), "user2")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func testRepositoryAccrualJobs(t *testing.T, s Repository) {
+	ctx := context.Background()
+	require.NoError(t, s.CreateOrder(ctx, models.Order{Number: "12345678903", UserID: "1", UploadedAt: time.Now()}))
+
+	jobs, err := s.ClaimAccrualJobs(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, models.OrderNumber("12345678903"), jobs[0].OrderNumber)
+	assert.Equal(t, 0, jobs[0].Attempts)
+
+	//the job is leased
+	jobs, err = s.ClaimAccrualJobs(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	require.NoError(t, s.RetryAccrualJob(ctx, "12345678903", time.Now().Add(-time.Second), "accrual is unavailable"))
+	jobs, err = s.ClaimAccrualJobs(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, 1, jobs[0].Attempts)
+	assert.Equal(t, "accrual is unavailable", jobs[0].LastError)
+
+	//the order is still being processed, the failures are forgotten
+	require.NoError(t, s.PostponeAccrualJob(ctx, "12345678903", time.Now().Add(-time.Second)))
+	jobs, err = s.ClaimAccrualJobs(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, 0, jobs[0].Attempts)
+	assert.Empty(t, jobs[0].LastError)
+
+	require.NoError(t, s.CompleteAccrualJob(ctx, "12345678903"))
+	require.NoError(t, s.RetryAccrualJob(ctx, "12345678903", time.Now().Add(-time.Second), ""))
+	jobs, err = s.ClaimAccrualJobs(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, jobs)
+}
+
+func testRepositoryRequeueAccrualJob(t *testing.T, s Repository) {
+	ctx := context.Background()
+	assert.ErrorIs(t, s.RequeueAccrualJob(ctx, "12345678903"), ErrOrderNotFound)
+	require.NoError(t, s.CreateOrder(ctx, models.Order{Number: "12345678903", UserID: "1", UploadedAt: time.Now()}))
+	require.NoError(t, s.CreateOrder(ctx, models.Order{Number: "2377225624", UserID: "1", UploadedAt: time.Now()}))
+
+	//the failing job is postponed
+	require.NoError(t, s.RetryAccrualJob(ctx, "12345678903", time.Now().Add(time.Hour), "accrual is unavailable"))
+	require.NoError(t, s.RequeueAccrualJob(ctx, "12345678903"))
+	//the completed job is created again
+	require.NoError(t, s.CompleteAccrualJob(ctx, "2377225624"))
+	require.NoError(t, s.RequeueAccrualJob(ctx, "2377225624"))
+
+	jobs, err := s.ClaimAccrualJobs(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, jobs, 2)
+	for _, job := range jobs {
+		assert.Equal(t, 0, job.Attempts)
+		assert.Empty(t, job.LastError)
+	}
+}
+
+//every job must be claimed by exactly one of the concurrent workers
+func testRepositoryConcurrentClaims(t *testing.T, s Repository) {
+	const (
+		orders  = 100
+		workers = 10
+	)
+	ctx := context.Background()
+	for i := 0; i < orders; i++ {
+		number := models.OrderNumber(fmt.Sprintf("%d", 1000+i))
+		require.NoError(t, s.CreateOrder(ctx, models.Order{Number: number, UserID: "1", UploadedAt: time.Now()}))
+	}
+
+	var mu sync.Mutex
+	claimed := make(map[models.OrderNumber]int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				jobs, err := s.ClaimAccrualJobs(ctx, 3, time.Minute)
+				if err != nil {
+					t.Errorf("ClaimAccrualJobs() error: %s", err)
+					return
+				}
+				if len(jobs) == 0 {
+					return
+				}
+				mu.Lock()
+				for _, job := range jobs {
+					claimed[job.OrderNumber]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, claimed, orders)
+	for number, n := range claimed {
+		assert.Equal(t, 1, n, "order %s claimed %d times", number, n)
+	}
+}
+
+func testRepositoryRefreshTokens(t *testing.T, s Repository) {
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Hour)
+	require.NoError(t, s.CreateRefreshToken(ctx, models.RefreshToken{TokenHash: "h1", UserID: "1", FamilyID: "f1", ExpiresAt: expiresAt}))
+	require.NoError(t, s.CreateRefreshToken(ctx, models.RefreshToken{TokenHash: "other", UserID: "1", FamilyID: "f2", ExpiresAt: expiresAt}))
+
+	next, err := s.RotateRefreshToken(ctx, "h1", "h2", expiresAt)
+	require.NoError(t, err)
+	assert.Equal(t, "h2", next.TokenHash)
+	assert.Equal(t, "1", next.UserID)
+	assert.Equal(t, "f1", next.FamilyID)
+
+	_, err = s.RotateRefreshToken(ctx, "unknown", "h3", expiresAt)
+	assert.ErrorIs(t, err, ErrRefreshTokenNotFound)
+
+	//reuse of h1 revokes h2 as well, but not another family
+	_, err = s.RotateRefreshToken(ctx, "h1", "h3", expiresAt)
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+	_, err = s.RotateRefreshToken(ctx, "h2", "h3", expiresAt)
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+	_, err = s.RotateRefreshToken(ctx, "other", "other2", expiresAt)
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, s.RevokeRefreshTokenFamily(ctx, "2", "other2"), ErrRefreshTokenNotFound)
+	require.NoError(t, s.RevokeRefreshTokenFamily(ctx, "1", "other2"))
+	require.NoError(t, s.RevokeRefreshTokenFamily(ctx, "1", "other2"))
+	_, err = s.RotateRefreshToken(ctx, "other2", "other3", expiresAt)
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+
+	require.NoError(t, s.CreateRefreshToken(ctx, models.RefreshToken{TokenHash: "old", UserID: "1", FamilyID: "f3", ExpiresAt: time.Now().Add(-time.Second)}))
+	_, err = s.RotateRefreshToken(ctx, "old", "new", expiresAt)
+	assert.ErrorIs(t, err, ErrRefreshTokenExpired)
+}
+
+func testRepositoryRevokedTokens(t *testing.T, s Repository) {
+	ctx := context.Background()
+	revoked, err := s.IsAccessTokenRevoked(ctx, "jti1")
+	require.NoError(t, err)
+	assert.False(t, revoked)
+
+	require.NoError(t, s.RevokeAccessToken(ctx, "jti1", time.Now().Add(time.Hour)))
+	require.NoError(t, s.RevokeAccessToken(ctx, "jti1", time.Now().Add(time.Hour)))
+	revoked, err = s.IsAccessTokenRevoked(ctx, "jti1")
+	require.NoError(t, err)
+	assert.True(t, revoked)
+
+	//expired entries are purged
+	require.NoError(t, s.RevokeAccessToken(ctx, "jti2", time.Now().Add(-time.Hour)))
+	require.NoError(t, s.RevokeAccessToken(ctx, "jti3", time.Now().Add(time.Hour)))
+	revoked, err = s.IsAccessTokenRevoked(ctx, "jti2")
+	require.NoError(t, err)
+	assert.False(t, revoked)
+}
+
+func testRepositoryLoginAttempts(t *testing.T, s Repository) {
+	ctx := context.Background()
+	block := func(failures int) time.Duration {
+		if failures < 2 {
+			return 0
+		}
+		return time.Hour
+	}
+
+	attempts, err := s.GetLoginAttempts(ctx, "login:user1")
+	require.NoError(t, err)
+	assert.Equal(t, 0, attempts.Failures)
+
+	attempts, err = s.CountLoginAttempt(ctx, "login:user1", time.Hour, block)
+	require.NoError(t, err)
+	assert.Equal(t, 1, attempts.Failures)
+	assert.False(t, attempts.BlockedUntil.After(time.Now()))
+
+	attempts, err = s.CountLoginAttempt(ctx, "login:user1", time.Hour, block)
+	require.NoError(t, err)
+	assert.Equal(t, 2, attempts.Failures)
+	assert.True(t, attempts.BlockedUntil.After(time.Now().Add(50*time.Minute)))
+
+	//the attempt of the blocked key isn't counted
+	attempts, err = s.CountLoginAttempt(ctx, "login:user1", time.Hour, block)
+	require.ErrorIs(t, err, ErrLoginBlocked)
+	assert.Equal(t, 2, attempts.Failures)
+	assert.True(t, attempts.BlockedUntil.After(time.Now().Add(50*time.Minute)))
+
+	attempts, err = s.GetLoginAttempts(ctx, "login:user1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, attempts.Failures)
+
+	//the released attempt lifts the block it caused
+	require.NoError(t, s.ReleaseLoginAttempt(ctx, "login:user1", block))
+	attempts, err = s.GetLoginAttempts(ctx, "login:user1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, attempts.Failures)
+	assert.True(t, attempts.BlockedUntil.IsZero())
+	require.NoError(t, s.ReleaseLoginAttempt(ctx, "login:unknown", block))
+
+	//the attempt of another key is counted apart
+	attempts, err = s.CountLoginAttempt(ctx, "ip:127.0.0.1", time.Hour, block)
+	require.NoError(t, err)
+	assert.Equal(t, 1, attempts.Failures)
+
+	//failures older than the window are forgotten
+	attempts, err = s.CountLoginAttempt(ctx, "ip:127.0.0.1", 0, block)
+	require.NoError(t, err)
+	assert.Equal(t, 1, attempts.Failures)
+
+	require.NoError(t, s.ResetLoginAttempts(ctx, "login:user1"))
+	attempts, err = s.GetLoginAttempts(ctx, "login:user1")
+	require.NoError(t, err)
+	assert.Equal(t, 0, attempts.Failures)
+	assert.True(t, attempts.BlockedUntil.IsZero())
+}
+
+// attempts of random logins don't pile up, the forgotten ones are purged
+func testRepositoryPurgeLoginAttempts(t *testing.T, s Repository) {
+	ctx := context.Background()
+	noBlock := func(failures int) time.Duration { return 0 }
+	blockHour := func(failures int) time.Duration { return time.Hour }
+	const window = 10 * time.Millisecond
+
+	_, err := s.CountLoginAttempt(ctx, "login:random1", window, noBlock)
+	require.NoError(t, err)
+	_, err = s.CountLoginAttempt(ctx, "login:blocked", window, blockHour)
+	require.NoError(t, err)
+	_, err = s.CountLoginAttempt(ctx, "ip:10.0.0.1", time.Hour, noBlock)
+	require.NoError(t, err)
+	time.Sleep(2 * window)
+
+	_, err = s.CountLoginAttempt(ctx, "login:random2", window, noBlock)
+	require.NoError(t, err)
+	//the failure older than the window is purged
+	attempts, err := s.GetLoginAttempts(ctx, "login:random1")
+	require.NoError(t, err)
+	assert.Equal(t, 0, attempts.Failures)
+	assert.True(t, attempts.LastFailureAt.IsZero())
+	//the blocked key is kept
+	attempts, err = s.GetLoginAttempts(ctx, "login:blocked")
+	require.NoError(t, err)
+	assert.Equal(t, 1, attempts.Failures)
+	//keys of another kind have their own window
+	attempts, err = s.GetLoginAttempts(ctx, "ip:10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, attempts.Failures)
+	attempts, err = s.GetLoginAttempts(ctx, "login:random2")
+	require.NoError(t, err)
+	assert.Equal(t, 1, attempts.Failures)
+}
+
+// concurrent attempts of replicas are all counted, and no more attempts than allowed pass before the block
+func testRepositoryConcurrentLoginFailures(t *testing.T, s Repository) {
+	const attempts, allowed = 50, 5
+	ctx := context.Background()
+	block := func(failures int) time.Duration {
+		if failures < allowed {
+			return 0
+		}
+		return time.Hour
+	}
+	var wg sync.WaitGroup
+	var passed int32
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.CountLoginAttempt(ctx, "login:user1", time.Hour, block)
+			if err == nil {
+				atomic.AddInt32(&passed, 1)
+				return
+			}
+			assert.ErrorIs(t, err, ErrLoginBlocked)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(allowed), passed)
+	got, err := s.GetLoginAttempts(ctx, "login:user1")
+	require.NoError(t, err)
+	assert.Equal(t, allowed, got.Failures)
+}
+
+func testRepositoryUserPassword(t *testing.T, s Repository) {
+	ctx := context.Background()
+	userID, err := s.CreateUser(ctx, "user1", "hash1")
+	require.NoError(t, err)
+	user, err := s.GetUserByID(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", user.Login)
+	for _, id := range []string{"100500", "abc", "1.5", "", "99999999999"} {
+		_, err = s.GetUserByID(ctx, id)
+		assert.ErrorIs(t, err, ErrUserNotFound, id)
+	}
+
+	require.NoError(t, s.UpdateUserPassword(ctx, userID, "hash2"))
+	assert.ErrorIs(t, s.UpdateUserPassword(ctx, "100500", "hash2"), ErrUserNotFound)
+	user, err = s.GetUserByLogin(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, "hash2", user.EncryptedPassword)
+	assert.True(t, user.TokensValidAfter.Before(time.Now()))
+
+	expiresAt := time.Now().Add(time.Hour)
+	require.NoError(t, s.CreateRefreshToken(ctx, models.RefreshToken{TokenHash: "h1", UserID: userID, FamilyID: "f1", ExpiresAt: expiresAt}))
+	require.NoError(t, s.CreateRefreshToken(ctx, models.RefreshToken{TokenHash: "h2", UserID: "100500", FamilyID: "f2", ExpiresAt: expiresAt}))
+
+	validAfter := time.Now().Truncate(time.Second)
+	require.NoError(t, s.ChangeUserPassword(ctx, userID, "hash3", validAfter))
+	assert.ErrorIs(t, s.ChangeUserPassword(ctx, "100500", "hash3", validAfter), ErrUserNotFound)
+	user, err = s.GetUserByID(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, "hash3", user.EncryptedPassword)
+	assert.True(t, validAfter.Equal(user.TokensValidAfter))
+
+	//refresh tokens of the user are revoked
+	_, err = s.RotateRefreshToken(ctx, "h1", "h3", expiresAt)
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+	_, err = s.RotateRefreshToken(ctx, "h2", "h4", expiresAt)
+	assert.NoError(t, err)
+}
+
+func testRepositoryUserRole(t *testing.T, s Repository) {
+	ctx := context.Background()
+	userID, err := s.CreateUser(ctx, "user1", "hash1")
+	require.NoError(t, err)
+	user, err := s.GetUserByID(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleUser, user.Role)
+
+	require.NoError(t, s.SetUserRole(ctx, userID, models.RoleAdmin))
+	assert.ErrorIs(t, s.SetUserRole(ctx, "100500", models.RoleAdmin), ErrUserNotFound)
+	user, err = s.GetUserByLogin(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleAdmin, user.Role)
+}
+
+func testRepositoryAdjustments(t *testing.T, s Repository) {
+	ctx := context.Background()
+	userID, err := s.CreateUser(ctx, "user1", "hash1")
+	require.NoError(t, err)
+	operatorID, err := s.CreateUser(ctx, "admin", "hash2")
+	require.NoError(t, err)
+
+	credit, err := s.CreateAdjustment(ctx, models.Adjustment{UserID: userID, Amount: models.Points(300),
+		Reason: models.AdjustmentReasonCompensation, OperatorID: operatorID, Note: "lost order"})
+	require.NoError(t, err)
+	assert.NotZero(t, credit.ID)
+	_, err = s.CreateAdjustment(ctx, models.Adjustment{UserID: userID, Amount: models.Points(-500),
+		Reason: models.AdjustmentReasonFraud, OperatorID: operatorID})
+	assert.ErrorIs(t, err, ErrNotEnoughFunds)
+	_, err = s.CreateAdjustment(ctx, models.Adjustment{UserID: userID, Amount: models.Points(-100),
+		Reason: models.AdjustmentReasonFraud, OperatorID: operatorID})
+	require.NoError(t, err)
+	_, err = s.CreateAdjustment(ctx, models.Adjustment{UserID: "100500", Amount: models.Points(100),
+		Reason: models.AdjustmentReasonGoodwill, OperatorID: operatorID})
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	bal, err := s.GetBalanceByUserID(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Points(200), bal)
+	wd, err := s.GetWithdrawalsByUserID(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Points(0), wd)
+
+	list, err := s.GetAdjustmentsByUserID(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, models.Points(300), list[0].Amount)
+	assert.Equal(t, models.AdjustmentReasonCompensation, list[0].Reason)
+	assert.Equal(t, operatorID, list[0].OperatorID)
+	assert.Equal(t, "lost order", list[0].Note)
+	assert.Equal(t, models.Points(-100), list[1].Amount)
+
+	entries, err := s.GetJournalByUserID(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, models.EntryKindAdjustment, entries[0].Kind)
+	assert.Equal(t, fmt.Sprint(credit.ID), entries[0].Reference)
+
+	discrepancies, err := s.CheckLedger(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, discrepancies)
+}
+
+func testRepositoryJournalPage(t *testing.T, s Repository) {
+	ctx := context.Background()
+	userID, err := s.CreateUser(ctx, "user1", "hash1")
+	require.NoError(t, err)
+	otherID, err := s.CreateUser(ctx, "user2", "hash2")
+	require.NoError(t, err)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		_, err := s.CreateAdjustment(ctx, models.Adjustment{UserID: userID, Amount: models.Points(int64(i + 1)),
+			Reason: models.AdjustmentReasonGoodwill, OperatorID: otherID})
+		require.NoError(t, err)
+	}
+	_, err = s.CreateAdjustment(ctx, models.Adjustment{UserID: otherID, Amount: models.Points(10),
+		Reason: models.AdjustmentReasonGoodwill, OperatorID: otherID})
+	require.NoError(t, err)
+
+	page, err := s.GetJournalPage(ctx, userID, models.JournalFilter{Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	assert.Equal(t, models.Points(1), page[0].Amount)
+	assert.Equal(t, models.Points(3), page[1].BalanceAfter)
+
+	page, err = s.GetJournalPage(ctx, userID, models.JournalFilter{AfterID: page[1].ID, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, page, 3)
+	assert.Equal(t, models.Points(15), page[2].BalanceAfter)
+
+	page, err = s.GetJournalPage(ctx, userID, models.JournalFilter{From: start.Add(-time.Hour), To: start.Add(time.Hour)})
+	require.NoError(t, err)
+	assert.Len(t, page, 5)
+	page, err = s.GetJournalPage(ctx, userID, models.JournalFilter{To: start.Add(-time.Hour)})
+	require.NoError(t, err)
+	assert.Empty(t, page)
+	page, err = s.GetJournalPage(ctx, userID, models.JournalFilter{From: start.Add(time.Hour)})
+	require.NoError(t, err)
+	assert.Empty(t, page)
+}
+
+func testRepositoryOrderPage(t *testing.T, s Repository) {
+	ctx := context.Background()
+	base := time.Now().Truncate(time.Second).Add(-time.Hour)
+	//the last two orders are uploaded at the same time and sorted by number
+	orders := []struct {
+		number     models.OrderNumber
+		uploadedAt time.Time
+		status     models.OrderStatus
+	}{
+		{"1001", base, models.OrderStatusProcessed},
+		{"1002", base.Add(time.Minute), models.OrderStatusNew},
+		{"1003", base.Add(2 * time.Minute), models.OrderStatusInvalid},
+		{"1004", base.Add(3 * time.Minute), models.OrderStatusProcessed},
+		{"1005", base.Add(3 * time.Minute), models.OrderStatusNew},
+	}
+	for _, o := range orders {
+		require.NoError(t, s.CreateOrder(ctx, models.Order{Number: o.number, UserID: "1", UploadedAt: o.uploadedAt}))
+		if o.status != models.OrderStatusNew {
+			require.NoError(t, s.UpdateOrder(ctx, models.Order{Number: o.number, Status: o.status}))
+		}
+	}
+	require.NoError(t, s.CreateOrder(ctx, models.Order{Number: "2001", UserID: "2", UploadedAt: base}))
+
+	numbers := func(list []models.Order) []models.OrderNumber {
+		res := []models.OrderNumber{}
+		for _, o := range list {
+			res = append(res, o.Number)
+		}
+		return res
+	}
+	tests := []struct {
+		name   string
+		filter models.OrderFilter
+		want   []models.OrderNumber
+	}{
+		{name: "all", filter: models.OrderFilter{}, want: []models.OrderNumber{"1001", "1002", "1003", "1004", "1005"}},
+		{name: "desc", filter: models.OrderFilter{Desc: true, Limit: 3}, want: []models.OrderNumber{"1005", "1004", "1003"}},
+		{name: "after", filter: models.OrderFilter{After: &models.OrderPosition{UploadedAt: base.Add(3 * time.Minute), Number: "1004"}},
+			want: []models.OrderNumber{"1005"}},
+		{name: "desc after", filter: models.OrderFilter{Desc: true, After: &models.OrderPosition{UploadedAt: base.Add(3 * time.Minute), Number: "1005"}, Limit: 2},
+			want: []models.OrderNumber{"1004", "1003"}},
+		{name: "statuses", filter: models.OrderFilter{Statuses: []models.OrderStatus{models.OrderStatusProcessed, models.OrderStatusInvalid}},
+			want: []models.OrderNumber{"1001", "1003", "1004"}},
+		{name: "period", filter: models.OrderFilter{From: base.Add(time.Minute), To: base.Add(3 * time.Minute)},
+			want: []models.OrderNumber{"1002", "1003"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := s.GetOrderPage(ctx, "1", tt.filter)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, numbers(list))
+		})
+	}
+}
+
+func testRepositoryWithdrawalPage(t *testing.T, s Repository) {
+	ctx := context.Background()
+	userID, err := s.CreateUser(ctx, "user1", "hash1")
+	require.NoError(t, err)
+	_, err = s.CreateAdjustment(ctx, models.Adjustment{UserID: userID, Amount: models.Points(1000), Reason: models.AdjustmentReasonGoodwill, OperatorID: userID})
+	require.NoError(t, err)
+	start := time.Now().Add(-time.Second)
+	for i, number := range []string{"1001", "1002", "1003", "1004"} {
+		require.NoError(t, s.WithdrawTx(ctx, userID, models.WithdrawRequest{OrderNumber: number, Sum: models.Points(int64(100 * (i + 1)))}))
+	}
+
+	numbers := func(list []models.OrderWithdraw) []string {
+		res := []string{}
+		for _, wd := range list {
+			res = append(res, wd.OrderNumber)
+		}
+		return res
+	}
+	page, err := s.GetWithdrawalPage(ctx, userID, models.WithdrawalFilter{Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1001", "1002"}, numbers(page))
+
+	tests := []struct {
+		name   string
+		filter models.WithdrawalFilter
+		want   []string
+	}{
+		{name: "after", filter: models.WithdrawalFilter{After: &models.WithdrawalPosition{ProcessedAt: page[1].ProcessedAt, OrderNumber: page[1].OrderNumber}},
+			want: []string{"1003", "1004"}},
+		{name: "sum range", filter: models.WithdrawalFilter{MinSum: models.Points(200), MaxSum: models.Points(300)}, want: []string{"1002", "1003"}},
+		{name: "period", filter: models.WithdrawalFilter{From: start, To: time.Now().Add(time.Second)}, want: []string{"1001", "1002", "1003", "1004"}},
+		{name: "before period", filter: models.WithdrawalFilter{To: start}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := s.GetWithdrawalPage(ctx, userID, tt.filter)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, numbers(list))
+		})
+	}
+
+	page, err = s.GetWithdrawalPage(ctx, "100500", models.WithdrawalFilter{})
+	require.NoError(t, err)
+	assert.Empty(t, page)
+}
+
+func testRepositoryIdempotencyKeys(t *testing.T, s Repository) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Microsecond)
+	reservation := func(userID, hash string, at time.Time) models.IdempotentResponse {
+		return models.IdempotentResponse{UserID: userID, Key: "key1", RequestHash: hash, CreatedAt: at,
+			LockedUntil: at.Add(time.Minute), ExpiresAt: at.Add(time.Hour)}
+	}
+	req := reservation("1", "hash1", now)
+
+	_, reserved, err := s.ReserveIdempotencyKey(ctx, req)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+
+	//the request is in progress
+	stored, reserved, err := s.ReserveIdempotencyKey(ctx, req)
+	require.NoError(t, err)
+	assert.False(t, reserved)
+	assert.False(t, stored.Done())
+	assert.Equal(t, "hash1", stored.RequestHash)
+
+	resp := req
+	resp.Status = 200
+	resp.Header = models.ResponseHeader{"Content-Type": {"application/json"}}
+	resp.Body = []byte(`{"ok":true}`)
+	require.NoError(t, s.SaveIdempotentResponse(ctx, resp))
+	//the response is stored once
+	assert.ErrorIs(t, s.SaveIdempotentResponse(ctx, resp), ErrIdempotencyKeyLost)
+	stored, reserved, err = s.ReserveIdempotencyKey(ctx, reservation("1", "hash2", now))
+	require.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, 200, stored.Status)
+	assert.Equal(t, "hash1", stored.RequestHash)
+	assert.Equal(t, resp.Header, stored.Header)
+	assert.Equal(t, resp.Body, stored.Body)
+	//the done request isn't released
+	require.NoError(t, s.DeleteIdempotencyKey(ctx, req))
+	_, reserved, err = s.ReserveIdempotencyKey(ctx, reservation("1", "hash1", now.Add(2*time.Minute)))
+	require.NoError(t, err)
+	assert.False(t, reserved)
+
+	//the same key of another user is another request
+	_, reserved, err = s.ReserveIdempotencyKey(ctx, reservation("2", "hash1", now))
+	require.NoError(t, err)
+	assert.True(t, reserved)
+
+	//the lock of the request in progress has passed, only its retry takes the key over
+	retry := reservation("2", "hash1", now.Add(2*time.Minute))
+	_, reserved, err = s.ReserveIdempotencyKey(ctx, reservation("2", "hash2", retry.CreatedAt))
+	require.NoError(t, err)
+	assert.False(t, reserved)
+	stored, reserved, err = s.ReserveIdempotencyKey(ctx, retry)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+	assert.Equal(t, retry.CreatedAt, stored.CreatedAt)
+	//the first request can't store its response or release the key of the retry
+	first := reservation("2", "hash1", now)
+	first.Status = 200
+	assert.ErrorIs(t, s.SaveIdempotentResponse(ctx, first), ErrIdempotencyKeyLost)
+	require.NoError(t, s.DeleteIdempotencyKey(ctx, first))
+	stored, reserved, err = s.ReserveIdempotencyKey(ctx, reservation("2", "hash1", retry.CreatedAt))
+	require.NoError(t, err)
+	assert.False(t, reserved)
+	assert.True(t, stored.CreatedAt.Equal(retry.CreatedAt))
+
+	//the expired key is reused
+	later := now.Add(2 * time.Hour)
+	stored, reserved, err = s.ReserveIdempotencyKey(ctx, reservation("1", "hash3", later))
+	require.NoError(t, err)
+	assert.True(t, reserved)
+	assert.False(t, stored.Done())
+
+	require.NoError(t, s.DeleteIdempotencyKey(ctx, stored))
+	_, reserved, err = s.ReserveIdempotencyKey(ctx, req)
+	require.NoError(t, err)
+	assert.True(t, reserved)
+}
+
+func testRepositoryOrderStatus(t *testing.T, s Repository) {
+	ctx := context.Background()
+	userID, err := s.CreateUser(ctx, "user1", "hash1")
+	require.NoError(t, err)
+	uploaded := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	require.NoError(t, s.CreateOrder(ctx, models.Order{Number: "12345678903", UserID: userID, UploadedAt: uploaded}))
+	require.NoError(t, s.CreateOrder(ctx, models.Order{Number: "79927398713", UserID: userID, UploadedAt: uploaded}))
+
+	require.NoError(t, s.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.OrderStatusProcessing}))
+	//the repeated status is ignored
+	require.NoError(t, s.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.OrderStatusProcessing}))
+	require.NoError(t, s.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.OrderStatusProcessed, Accrual: models.Points(500)}))
+
+	//the final status can't be changed
+	err = s.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.OrderStatusProcessing})
+	assert.ErrorIs(t, err, ErrOrderStatusConflict)
+	err = s.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.OrderStatusProcessed, Accrual: models.Points(900)})
+	assert.ErrorIs(t, err, ErrOrderStatusConflict)
+	err = s.UpdateOrder(ctx, models.Order{Number: "12345678903", Status: models.OrderStatusNew})
+	assert.ErrorIs(t, err, ErrOrderStatusConflict)
+
+	ord, err := s.GetOrderByNumber(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusProcessed, ord.Status)
+	assert.Equal(t, models.Points(500), ord.Accrual)
+	bal, err := s.GetBalanceByUserID(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Points(500), bal)
+
+	history, err := s.GetOrderStatusHistory(ctx, "12345678903")
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	assert.Equal(t, models.OrderStatusNew, history[0].Status)
+	assert.True(t, uploaded.Equal(history[0].ChangedAt))
+	assert.Equal(t, models.OrderStatusProcessing, history[1].Status)
+	assert.Equal(t, models.OrderStatusProcessed, history[2].Status)
+	assert.False(t, history[2].ChangedAt.Before(history[1].ChangedAt))
+
+	//the order may skip PROCESSING
+	require.NoError(t, s.UpdateOrder(ctx, models.Order{Number: "79927398713", Status: models.OrderStatusInvalid}))
+	err = s.UpdateOrder(ctx, models.Order{Number: "79927398713", Status: models.OrderStatusProcessed, Accrual: models.Points(100)})
+	assert.ErrorIs(t, err, ErrOrderStatusConflict)
+	history, err = s.GetOrderStatusHistory(ctx, "79927398713")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, models.OrderStatusInvalid, history[1].Status)
+
+	history, err = s.GetOrderStatusHistory(ctx, "2377225624")
+	require.NoError(t, err)
+	assert.Empty(t, history)
+}
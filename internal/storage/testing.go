@@ -2,14 +2,56 @@ package storage
 
 import (
 	"fmt"
-	"github.com/stretchr/testify/assert"
+	"log"
+	"os"
 	"strings"
 	"testing"
 )
 
+// DefaultTestDatabaseURL is the test database used if databaseTestURL env var isn't set
+const DefaultTestDatabaseURL = "host=localhost dbname=gophermart_test user=postgres password=123 sslmode=disable"
+
+// TestDatabaseURL returns the test database and reports whether it's reachable, the store tests run on is logged.
+// Tests of Postgres store are skipped or run on in-memory store if it isn't.
+func TestDatabaseURL() (string, bool) {
+	databaseURL := os.Getenv("databaseTestURL")
+	if databaseURL == "" {
+		databaseURL = DefaultTestDatabaseURL
+	}
+	s, err := newStore(databaseURL)
+	if err != nil {
+		log.Printf("postgres is unavailable, its tests are skipped or run on in-memory store: %s", err)
+		return databaseURL, false
+	}
+	s.Close()
+	log.Print("tests run on postgres store")
+	return databaseURL, true
+}
+
+// NewTestSQLStore returns SQL store connected to the emptied test database, ids start from 1 again
+func NewTestSQLStore(databaseURL string) (Repository, error) {
+	s, err := newStore(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	tables := []string{}
+	err = s.db.Select(&tables, "SELECT tablename FROM pg_tables WHERE schemaname='public' AND tablename<>'schema_migrations'")
+	if err == nil && len(tables) > 0 {
+		_, err = s.db.Exec(fmt.Sprintf("TRUNCATE %s RESTART IDENTITY CASCADE", strings.Join(tables, ", ")))
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// TestStore returns SQL store connected to the test database. The test is skipped if the database is unavailable.
 func TestStore(t *testing.T) (Repository, func(...string)) {
 	s, err := newStore(DatabaseTestURL)
-	assert.NoError(t, err)
+	if err != nil {
+		t.Skipf("postgres is unavailable: %s", err)
+	}
 
 	return s, func(tables ...string) {
 		if len(tables) > 0 {
@@ -21,3 +63,8 @@ func TestStore(t *testing.T) (Repository, func(...string)) {
 	}
 
 }
+
+// TestMemStore returns empty in-memory store
+func TestMemStore(_ *testing.T) (Repository, func(...string)) {
+	return newMemStore(), func(...string) {}
+}
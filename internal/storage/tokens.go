@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+)
+
+func (s *Store) CreateRefreshToken(ctx context.Context, token models.RefreshToken) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO refresh_tokens (token_hash, user_id, family_id, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		token.TokenHash, token.UserID, token.FamilyID, token.ExpiresAt, time.Now())
+	return err
+}
+
+// RotateRefreshToken marks the token used and saves its successor of the same family.
+// Presenting a used or revoked token revokes the whole family and returns ErrRefreshTokenReused.
+func (s *Store) RotateRefreshToken(ctx context.Context, hash, nextHash string, expiresAt time.Time) (models.RefreshToken, error) {
+	next := models.RefreshToken{}
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return next, err
+	}
+	defer tx.Rollback()
+
+	token := models.RefreshToken{}
+	err = tx.GetContext(ctx, &token, "SELECT * FROM refresh_tokens WHERE token_hash=$1 FOR UPDATE", hash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return next, ErrRefreshTokenNotFound
+		}
+		return next, err
+	}
+	now := time.Now()
+	if token.UsedAt != nil || token.RevokedAt != nil {
+		//the token is stolen or replayed, nobody may use the family anymore
+		_, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at=$1 WHERE family_id=$2 AND revoked_at IS NULL",
+			now, token.FamilyID)
+		if err != nil {
+			return next, err
+		}
+		if err := tx.Commit(); err != nil {
+			return next, err
+		}
+		return next, ErrRefreshTokenReused
+	}
+	if now.After(token.ExpiresAt) {
+		return next, ErrRefreshTokenExpired
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET used_at=$1 WHERE token_hash=$2", now, hash); err != nil {
+		return next, err
+	}
+	next = models.RefreshToken{
+		TokenHash: nextHash,
+		UserID:    token.UserID,
+		FamilyID:  token.FamilyID,
+		ExpiresAt: expiresAt,
+		CreatedAt: now,
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO refresh_tokens (token_hash, user_id, family_id, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		next.TokenHash, next.UserID, next.FamilyID, next.ExpiresAt, next.CreatedAt)
+	if err != nil {
+		return models.RefreshToken{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return models.RefreshToken{}, err
+	}
+	return next, nil
+}
+
+// RevokeRefreshTokenFamily revokes the family of the user's token
+func (s *Store) RevokeRefreshTokenFamily(ctx context.Context, userID, hash string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at=$1
+		WHERE revoked_at IS NULL AND family_id=(SELECT family_id FROM refresh_tokens WHERE token_hash=$2 AND user_id=$3)`,
+		time.Now(), hash, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	//the family may be revoked already
+	var exists bool
+	err = s.db.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM refresh_tokens WHERE token_hash=$1 AND user_id=$2)", hash, userID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrRefreshTokenNotFound
+	}
+	return nil
+}
+
+// RevokeAccessToken adds the token to the revocation list until it expires, expired entries are purged
+func (s *Store) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	now := time.Now()
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM revoked_tokens WHERE expires_at < $1", now); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, "INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		jti, expiresAt)
+	return err
+}
+
+func (s *Store) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	var revoked bool
+	err := s.db.GetContext(ctx, &revoked, "SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti=$1)", jti)
+	return revoked, err
+}
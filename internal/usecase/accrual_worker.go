@@ -0,0 +1,120 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+	"github.com/OlegMzhelskiy/gophermart/pkg/accrual"
+)
+
+const (
+	jobLease       = time.Minute
+	jobBackoffBase = 5 * time.Second
+	jobBackoffMax  = 10 * time.Minute
+)
+
+// workerGettingOrderStatus claims due accrual jobs and hands them to the pool of workers
+func (u *OrderUseCase) workerGettingOrderStatus(done chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	jobs := make(chan models.AccrualJob)
+	var wg sync.WaitGroup
+	for i := 0; i < u.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				u.processJob(ctx, job)
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
+
+	ticker := time.NewTicker(u.pollInterval)
+	defer ticker.Stop()
+	for {
+		u.dispatchDueJobs(ctx, jobs)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		case <-u.wakeUp:
+		}
+	}
+}
+
+// dispatchDueJobs claims due jobs batch by batch until there are none.
+// A batch is no larger than the pool, so leases don't expire while jobs wait for a free worker.
+func (u *OrderUseCase) dispatchDueJobs(ctx context.Context, jobs chan<- models.AccrualJob) {
+	for ctx.Err() == nil {
+		claimed, err := u.repo.ClaimAccrualJobs(ctx, u.workers, jobLease)
+		if err != nil {
+			log.Printf("claim accrual jobs failed: %s", err)
+			return
+		}
+		for _, job := range claimed {
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if len(claimed) < u.workers {
+			return
+		}
+	}
+}
+
+func (u *OrderUseCase) processJob(ctx context.Context, job models.AccrualJob) {
+	isCalc, err := u.UpdateOrderInfoFromAccrual(ctx, job.OrderNumber)
+	if ctx.Err() != nil {
+		return //the lease expires and the job will be claimed again
+	}
+	if err == nil && isCalc {
+		if err := u.repo.CompleteAccrualJob(ctx, job.OrderNumber); err != nil {
+			log.Printf("complete accrual job failed: %s", err)
+		}
+		return
+	}
+	if err == nil {
+		//the order is still being processed, it's polled as usual
+		if err := u.repo.PostponeAccrualJob(ctx, job.OrderNumber, time.Now().Add(u.pollInterval)); err != nil {
+			log.Printf("reschedule accrual job failed: %s", err)
+		}
+		return
+	}
+	nextAttemptAt := time.Now().Add(backoff(job.Attempts, jobBackoffBase, jobBackoffMax))
+	//the accrual system asked to wait
+	var rlErr *accrual.RateLimitError
+	if errors.As(err, &rlErr) {
+		nextAttemptAt = time.Now().Add(rlErr.RetryAfter)
+	}
+	if err := u.repo.RetryAccrualJob(ctx, job.OrderNumber, nextAttemptAt, err.Error()); err != nil {
+		log.Printf("reschedule accrual job failed: %s", err)
+	}
+}
+
+// backoff returns delay before the next attempt: base*2^attempts capped by max, with random jitter in its upper half
+func backoff(attempts int, base, max time.Duration) time.Duration {
+	d := max
+	if attempts < 32 {
+		if exp := base << attempts; exp > 0 && exp < max {
+			d = exp
+		}
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
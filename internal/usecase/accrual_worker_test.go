@@ -0,0 +1,214 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+	"github.com/OlegMzhelskiy/gophermart/pkg/accrual"
+	"github.com/OlegMzhelskiy/gophermart/pkg/accrual/stub"
+)
+
+// slowAccrual answers PROCESSED after delay and tracks the number of concurrent calls
+type slowAccrual struct {
+	delay       time.Duration
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (a *slowAccrual) GetOrderStatus(ctx context.Context, number models.OrderNumber) (accrual.AccrualRequest, error) {
+	a.mu.Lock()
+	a.inFlight++
+	if a.inFlight > a.maxInFlight {
+		a.maxInFlight = a.inFlight
+	}
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.inFlight--
+		a.mu.Unlock()
+	}()
+
+	time.Sleep(a.delay)
+	return accrual.AccrualRequest{Order: string(number), Status: models.OrderAccrualStatusProcessed, Sum: models.Points(10)}, nil
+}
+
+func TestBackoff(t *testing.T) {
+	base, max := time.Second, time.Minute
+	for attempts := 0; attempts < 70; attempts++ {
+		want := max
+		if attempts < 6 {
+			want = base << attempts
+		}
+		d := backoff(attempts, base, max)
+		assert.GreaterOrEqual(t, d, want/2, "attempts %d", attempts)
+		assert.LessOrEqual(t, d, want, "attempts %d", attempts)
+	}
+}
+
+func TestOrderUseCase_WorkerPool(t *testing.T) {
+	const (
+		orders  = 40
+		workers = 4
+	)
+	ctx := context.Background()
+	repo := storage.NewMemStore()
+	for i := 0; i < orders; i++ {
+		number := models.OrderNumber(fmt.Sprintf("%d", 1000+i))
+		require.NoError(t, repo.CreateOrder(ctx, models.Order{Number: number, UserID: "1", UploadedAt: time.Now()}))
+	}
+
+	acc := &slowAccrual{delay: 20 * time.Millisecond}
+	u := OrderUseCase{
+		repo:         repo,
+		wakeUp:       make(chan struct{}, 1),
+		accrual:      acc,
+		workers:      workers,
+		pollInterval: 10 * time.Millisecond,
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go u.workerGettingOrderStatus(done)
+
+	assert.Eventually(t, func() bool {
+		pending, err := repo.GetOrdersWithStatus(ctx, models.OrderStatusNew)
+		return err == nil && len(pending) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+	assert.LessOrEqual(t, acc.maxInFlight, workers)
+	assert.Greater(t, acc.maxInFlight, 1)
+}
+
+func TestOrderUseCase_AccrualStub(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(stub.New(stub.Config{
+		Orders: map[string][]stub.Step{
+			"12345678903": {{Status: models.OrderAccrualStatusProcessed, Accrual: models.Points(500)}},
+			"79927398713": {{Status: models.OrderAccrualStatusInvalid}},
+		},
+	}))
+	defer srv.Close()
+
+	repo := storage.NewMemStore()
+	userID, err := repo.CreateUser(ctx, "user1", "hash1")
+	require.NoError(t, err)
+	done := make(chan struct{})
+	defer close(done)
+	u := NewOrderUseCase(repo, done, Config{AccrualAddr: srv.URL, PollInterval: 10 * time.Millisecond})
+
+	require.NoError(t, u.UploadOrder(ctx, models.Order{Number: "12345678903", UserID: userID, UploadedAt: time.Now()}))
+	require.NoError(t, u.UploadOrder(ctx, models.Order{Number: "79927398713", UserID: userID, UploadedAt: time.Now()}))
+
+	assert.Eventually(t, func() bool {
+		bal, err := repo.GetBalanceByUserID(ctx, userID)
+		return err == nil && bal == models.Points(500)
+	}, 5*time.Second, 10*time.Millisecond)
+	ord, err := repo.GetOrderByNumber(ctx, "79927398713")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusInvalid, ord.Status)
+}
+
+// scriptedAccrual answers the statuses one by one
+type scriptedAccrual struct {
+	answers []accrual.AccrualRequest
+}
+
+func (a *scriptedAccrual) GetOrderStatus(ctx context.Context, number models.OrderNumber) (accrual.AccrualRequest, error) {
+	answer := a.answers[0]
+	a.answers = a.answers[1:]
+	return answer, nil
+}
+
+func TestOrderUseCase_UpdateOrderInfoFromAccrual(t *testing.T) {
+	ctx := context.Background()
+	repo := storage.NewMemStore()
+	userID, err := repo.CreateUser(ctx, "user1", "hash1")
+	require.NoError(t, err)
+	require.NoError(t, repo.CreateOrder(ctx, models.Order{Number: "12345678903", UserID: userID, UploadedAt: time.Now()}))
+	acc := &scriptedAccrual{answers: []accrual.AccrualRequest{
+		{Status: models.OrderAccrualStatusRegistered},
+		{Status: models.OrderAccrualStatusProcessing},
+		{Status: models.OrderAccrualStatusProcessing},
+		{Status: models.OrderAccrualStatusProcessed, Sum: models.Points(500)},
+		{Status: models.OrderAccrualStatusProcessing},
+		{Status: models.OrderAccrualStatusInvalid},
+		{Status: "DONE"},
+	}}
+	u := OrderUseCase{repo: repo, accrual: acc}
+
+	wantStatuses := []models.OrderStatus{models.OrderStatusNew, models.OrderStatusProcessing, models.OrderStatusProcessing,
+		models.OrderStatusProcessed, models.OrderStatusProcessed, models.OrderStatusProcessed}
+	wantCalc := []bool{false, false, false, true, true, true}
+	for i := range wantStatuses {
+		isCalc, err := u.UpdateOrderInfoFromAccrual(ctx, "12345678903")
+		require.NoError(t, err, i)
+		assert.Equal(t, wantCalc[i], isCalc, i)
+		ord, err := repo.GetOrderByNumber(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, wantStatuses[i], ord.Status, i)
+		if wantCalc[i] {
+			assert.Equal(t, models.Points(500), ord.Accrual, i)
+		}
+	}
+	_, err = u.UpdateOrderInfoFromAccrual(ctx, "12345678903")
+	assert.Error(t, err)
+
+	history, err := repo.GetOrderStatusHistory(ctx, "12345678903")
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	bal, err := repo.GetBalanceByUserID(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Points(500), bal)
+}
+
+// failingAccrual can't be reached
+type failingAccrual struct{}
+
+func (failingAccrual) GetOrderStatus(ctx context.Context, number models.OrderNumber) (accrual.AccrualRequest, error) {
+	return accrual.AccrualRequest{}, errors.New("connection refused")
+}
+
+func TestOrderUseCase_ProcessJob(t *testing.T) {
+	const pollInterval = 20 * time.Millisecond
+	ctx := context.Background()
+	repo := storage.NewMemStore()
+	require.NoError(t, repo.CreateOrder(ctx, models.Order{Number: "12345678903", UserID: "1", UploadedAt: time.Now()}))
+	claim := func() []models.AccrualJob {
+		jobs, err := repo.ClaimAccrualJobs(ctx, 10, time.Minute)
+		require.NoError(t, err)
+		return jobs
+	}
+	jobs := claim()
+	require.Len(t, jobs, 1)
+
+	//the order in progress is polled with the usual interval however many times it was polled before
+	u := OrderUseCase{repo: repo, pollInterval: pollInterval, accrual: &scriptedAccrual{answers: []accrual.AccrualRequest{
+		{Status: models.OrderAccrualStatusProcessing},
+	}}}
+	job := jobs[0]
+	job.Attempts = 20
+	u.processJob(ctx, job)
+	assert.Empty(t, claim())
+	time.Sleep(2 * pollInterval)
+	jobs = claim()
+	require.Len(t, jobs, 1)
+	assert.Equal(t, 0, jobs[0].Attempts)
+
+	//the unavailable accrual system is retried with backoff
+	u.accrual = failingAccrual{}
+	u.processJob(ctx, jobs[0])
+	time.Sleep(2 * pollInterval)
+	assert.Empty(t, claim())
+}
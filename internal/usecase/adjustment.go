@@ -0,0 +1,59 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+)
+
+var (
+	ErrInvalidAdjustment       = errors.New("adjustment must be credit or debit of positive sum")
+	ErrUnknownAdjustmentReason = errors.New("unknown adjustment reason")
+)
+
+// AdjustBalance credits or debits the user's balance on behalf of the operator
+func (u UserUseCase) AdjustBalance(ctx context.Context, operatorID, userID string, req models.AdjustmentRequest) (models.Adjustment, error) {
+	if req.Sum <= 0 {
+		return models.Adjustment{}, ErrInvalidAdjustment
+	}
+	amount := req.Sum
+	switch req.Type {
+	case models.AdjustmentTypeCredit:
+	case models.AdjustmentTypeDebit:
+		amount = -amount
+	default:
+		return models.Adjustment{}, ErrInvalidAdjustment
+	}
+	if !req.Reason.Valid() {
+		return models.Adjustment{}, fmt.Errorf("%w: %q", ErrUnknownAdjustmentReason, req.Reason)
+	}
+	adj, err := u.repo.CreateAdjustment(ctx, models.Adjustment{
+		UserID:     userID,
+		Amount:     amount,
+		Reason:     req.Reason,
+		OperatorID: operatorID,
+		Note:       req.Note,
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrNotEnoughFunds) {
+			return adj, ErrNotEnoughFunds
+		}
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return adj, ErrUserNotFound
+		}
+		return adj, fmt.Errorf("create adjustment failed: %w", err)
+	}
+	return adj, nil
+}
+
+// GetAdjustments returns the adjustments of the user's balance, the oldest first
+func (u UserUseCase) GetAdjustments(ctx context.Context, userID string) ([]models.Adjustment, error) {
+	list, err := u.repo.GetAdjustmentsByUserID(ctx, userID)
+	if err != nil {
+		return list, fmt.Errorf("getting user's adjustments failed: %w", err)
+	}
+	return list, nil
+}
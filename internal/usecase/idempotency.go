@@ -0,0 +1,99 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+)
+
+const (
+	DefaultIdempotencyTTL = 24 * time.Hour
+	//the request in progress holds the key this long, then its retry may take the key over
+	DefaultIdempotencyLease = time.Minute
+	maxIdempotencyKeyLen    = 255
+)
+
+var (
+	ErrInvalidIdempotencyKey    = errors.New("idempotency key must be from 1 to 255 printable ASCII characters")
+	ErrIdempotencyKeyReused     = errors.New("idempotency key was already used with another request")
+	ErrIdempotencyKeyInProgress = errors.New("request with this idempotency key is in progress")
+)
+
+// IdempotencyUseCase keeps the first response to the request with Idempotency-Key for ttl,
+// retries of the request get this response instead of repeating the request
+type IdempotencyUseCase struct {
+	repo  storage.Repository
+	ttl   time.Duration
+	lease time.Duration
+}
+
+func NewIdempotencyUseCase(repo storage.Repository, ttl time.Duration) IdempotencyUseCase {
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	return IdempotencyUseCase{repo: repo, ttl: ttl, lease: DefaultIdempotencyLease}
+}
+
+// Begin reserves the user's key for the request with the fingerprint requestHash and returns the reservation.
+// If the request was already done its stored response is returned, it's Done and the request must not be repeated.
+func (u IdempotencyUseCase) Begin(ctx context.Context, userID, key, requestHash string) (models.IdempotentResponse, error) {
+	if !validIdempotencyKey(key) {
+		return models.IdempotentResponse{}, ErrInvalidIdempotencyKey
+	}
+	//the database keeps microseconds, the reservation is found by its time
+	now := time.Now().Truncate(time.Microsecond)
+	stored, reserved, err := u.repo.ReserveIdempotencyKey(ctx, models.IdempotentResponse{
+		UserID:      userID,
+		Key:         key,
+		RequestHash: requestHash,
+		CreatedAt:   now,
+		LockedUntil: now.Add(u.lease),
+		ExpiresAt:   now.Add(u.ttl),
+	})
+	if err != nil {
+		return models.IdempotentResponse{}, fmt.Errorf("reserve idempotency key failed: %w", err)
+	}
+	if reserved {
+		return stored, nil
+	}
+	if stored.RequestHash != requestHash {
+		return models.IdempotentResponse{}, ErrIdempotencyKeyReused
+	}
+	if !stored.Done() {
+		return models.IdempotentResponse{}, ErrIdempotencyKeyInProgress
+	}
+	return stored, nil
+}
+
+// Complete stores the response to the request reserved by Begin, it fails if the reservation
+// has been taken over by a retry after the lease
+func (u IdempotencyUseCase) Complete(ctx context.Context, resp models.IdempotentResponse) error {
+	if err := u.repo.SaveIdempotentResponse(ctx, resp); err != nil {
+		return fmt.Errorf("save idempotent response failed: %w", err)
+	}
+	return nil
+}
+
+// Abort releases the key reserved by Begin, e.g. the request failed and may be repeated
+func (u IdempotencyUseCase) Abort(ctx context.Context, reservation models.IdempotentResponse) error {
+	if err := u.repo.DeleteIdempotencyKey(ctx, reservation); err != nil {
+		return fmt.Errorf("delete idempotency key failed: %w", err)
+	}
+	return nil
+}
+
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > maxIdempotencyKeyLen {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
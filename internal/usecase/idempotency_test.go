@@ -0,0 +1,92 @@
+package usecase
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+)
+
+func TestIdempotencyUseCase(t *testing.T) {
+	ctx := context.Background()
+	u := NewIdempotencyUseCase(storage.NewMemStore(), time.Hour)
+
+	reservation, err := u.Begin(ctx, "1", "key1", "hash1")
+	require.NoError(t, err)
+	assert.False(t, reservation.Done())
+
+	_, err = u.Begin(ctx, "1", "key1", "hash1")
+	assert.ErrorIs(t, err, ErrIdempotencyKeyInProgress)
+	_, err = u.Begin(ctx, "1", "key1", "hash2")
+	assert.ErrorIs(t, err, ErrIdempotencyKeyReused)
+
+	resp := reservation
+	resp.Status, resp.Body = 202, []byte("ok")
+	require.NoError(t, u.Complete(ctx, resp))
+	stored, err := u.Begin(ctx, "1", "key1", "hash1")
+	require.NoError(t, err)
+	require.True(t, stored.Done())
+	assert.Equal(t, 202, stored.Status)
+	assert.Equal(t, []byte("ok"), stored.Body)
+
+	//the aborted request may be repeated
+	reservation, err = u.Begin(ctx, "1", "key2", "hash1")
+	require.NoError(t, err)
+	require.NoError(t, u.Abort(ctx, reservation))
+	reservation, err = u.Begin(ctx, "1", "key2", "hash1")
+	require.NoError(t, err)
+	assert.False(t, reservation.Done())
+
+	for _, key := range []string{"", strings.Repeat("k", 256), "key\n"} {
+		_, err = u.Begin(ctx, "1", key, "hash1")
+		assert.ErrorIs(t, err, ErrInvalidIdempotencyKey)
+	}
+}
+
+func TestIdempotencyUseCase_Expired(t *testing.T) {
+	ctx := context.Background()
+	u := NewIdempotencyUseCase(storage.NewMemStore(), time.Nanosecond)
+
+	reservation, err := u.Begin(ctx, "1", "key1", "hash1")
+	require.NoError(t, err)
+	reservation.Status = 200
+	require.NoError(t, u.Complete(ctx, reservation))
+	time.Sleep(time.Millisecond)
+
+	//the key is forgotten after ttl and may be used with another request
+	stored, err := u.Begin(ctx, "1", "key1", "hash2")
+	require.NoError(t, err)
+	assert.False(t, stored.Done())
+}
+
+func TestIdempotencyUseCase_Lease(t *testing.T) {
+	ctx := context.Background()
+	u := NewIdempotencyUseCase(storage.NewMemStore(), time.Hour)
+	u.lease = time.Millisecond
+
+	first, err := u.Begin(ctx, "1", "key1", "hash1")
+	require.NoError(t, err)
+	time.Sleep(2 * time.Millisecond)
+
+	//the first request has hung, its retry takes the key over after the lease
+	_, err = u.Begin(ctx, "1", "key1", "hash2")
+	assert.ErrorIs(t, err, ErrIdempotencyKeyReused)
+	retry, err := u.Begin(ctx, "1", "key1", "hash1")
+	require.NoError(t, err)
+	assert.False(t, retry.Done())
+
+	//the first request can't overwrite the response of the retry or release its key
+	first.Status = 200
+	assert.ErrorIs(t, u.Complete(ctx, first), storage.ErrIdempotencyKeyLost)
+	require.NoError(t, u.Abort(ctx, first))
+	retry.Status = 202
+	require.NoError(t, u.Complete(ctx, retry))
+	stored, err := u.Begin(ctx, "1", "key1", "hash1")
+	require.NoError(t, err)
+	assert.Equal(t, 202, stored.Status)
+}
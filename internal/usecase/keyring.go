@@ -0,0 +1,179 @@
+package usecase
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownSigningKey = errors.New("unknown token signing key")
+	ErrSigningKeyExpired = errors.New("token signing key is no longer active")
+)
+
+// SigningKey is a secret for signing tokens, kid of tokens refers to its ID
+type SigningKey struct {
+	ID        string    `json:"kid"`
+	Secret    string    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Keyring signs tokens with the newest key and verifies them with any active key.
+// The key stays active for ttl after the next key was added, so tokens signed with it expire naturally.
+type Keyring struct {
+	mu   sync.RWMutex
+	keys []SigningKey //sorted by CreatedAt, the last one signs
+	ttl  time.Duration
+}
+
+// NewKeyring returns keyring with the keys. A random key is generated if there are no keys,
+// it's known to this process only, so it suits tests and local runs.
+func NewKeyring(ttl time.Duration, keys ...SigningKey) (*Keyring, error) {
+	k := &Keyring{ttl: ttl}
+	if len(keys) == 0 {
+		key, err := GenerateSigningKey()
+		if err != nil {
+			return nil, err
+		}
+		keys = []SigningKey{key}
+	}
+	if err := k.Replace(keys); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// GenerateSigningKey returns a new random key
+func GenerateSigningKey() (SigningKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return SigningKey{}, fmt.Errorf("generate signing key failed: %w", err)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return SigningKey{}, fmt.Errorf("generate signing key failed: %w", err)
+	}
+	return SigningKey{ID: hex.EncodeToString(id), Secret: hex.EncodeToString(secret), CreatedAt: time.Now().UTC()}, nil
+}
+
+// SigningKeyFromSecret returns the key with ID derived from the secret, so all replicas have the same kid
+func SigningKeyFromSecret(secret string) SigningKey {
+	sum := sha256.Sum256([]byte(secret))
+	return SigningKey{ID: hex.EncodeToString(sum[:8]), Secret: secret}
+}
+
+// Replace sets new keys, e.g. reloaded from the file
+func (k *Keyring) Replace(keys []SigningKey) error {
+	if len(keys) == 0 {
+		return errors.New("there are no signing keys")
+	}
+	sorted := make([]SigningKey, len(keys))
+	copy(sorted, keys)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].CreatedAt.Before(sorted[j].CreatedAt) })
+	ids := make(map[string]struct{}, len(sorted))
+	for _, key := range sorted {
+		if key.ID == "" || key.Secret == "" {
+			return errors.New("signing key must have kid and secret")
+		}
+		if _, ok := ids[key.ID]; ok {
+			return fmt.Errorf("duplicate signing key %q", key.ID)
+		}
+		ids[key.ID] = struct{}{}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = sorted
+	return nil
+}
+
+// Rotate adds a new signing key and drops the keys which are no longer active
+func (k *Keyring) Rotate() (SigningKey, error) {
+	key, err := GenerateSigningKey()
+	if err != nil {
+		return key, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = append(k.keys, key)
+	k.keys = activeKeys(k.keys, k.ttl, key.CreatedAt)
+	return key, nil
+}
+
+// Keys returns the keys which are active at the moment
+func (k *Keyring) Keys(now time.Time) []SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return activeKeys(k.keys, k.ttl, now)
+}
+
+// signingKey returns the newest key
+func (k *Keyring) signingKey() SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[len(k.keys)-1]
+}
+
+// verificationKey returns secret of the key if it's still active
+func (k *Keyring) verificationKey(id string, now time.Time) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for i, key := range k.keys {
+		if key.ID != id {
+			continue
+		}
+		if i < len(k.keys)-1 && now.After(k.keys[i+1].CreatedAt.Add(k.ttl)) {
+			return nil, ErrSigningKeyExpired
+		}
+		return []byte(key.Secret), nil
+	}
+	return nil, ErrUnknownSigningKey
+}
+
+// activeKeys drops keys superseded more than ttl before now, keys must be sorted
+func activeKeys(keys []SigningKey, ttl time.Duration, now time.Time) []SigningKey {
+	active := make([]SigningKey, 0, len(keys))
+	for i, key := range keys {
+		if i < len(keys)-1 && now.After(keys[i+1].CreatedAt.Add(ttl)) {
+			continue
+		}
+		active = append(active, key)
+	}
+	return active
+}
+
+// LoadSigningKeys reads keys from JSON file, missing file has no keys
+func LoadSigningKeys(path string) ([]SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read signing keys failed: %w", err)
+	}
+	keys := []SigningKey{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("parse signing keys failed: %w", err)
+	}
+	return keys, nil
+}
+
+// SaveSigningKeys writes keys to JSON file readable by the owner only
+func SaveSigningKeys(path string, keys []SigningKey) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write signing keys failed: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,111 @@
+package usecase
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+)
+
+func TestKeyring_VerificationKey(t *testing.T) {
+	now := time.Now()
+	ttl := time.Hour
+	keys, err := NewKeyring(ttl,
+		SigningKey{ID: "new", Secret: "s3", CreatedAt: now.Add(-10 * time.Minute)},
+		SigningKey{ID: "old", Secret: "s1", CreatedAt: now.Add(-3 * time.Hour)},
+		SigningKey{ID: "prev", Secret: "s2", CreatedAt: now.Add(-2 * time.Hour)},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "new", keys.signingKey().ID)
+
+	tests := []struct {
+		name   string
+		kid    string
+		secret string
+		err    error
+	}{
+		{name: "signing key", kid: "new", secret: "s3"},
+		{name: "superseded within ttl", kid: "prev", secret: "s2"},
+		{name: "superseded more than ttl ago", kid: "old", err: ErrSigningKeyExpired},
+		{name: "unknown", kid: "other", err: ErrUnknownSigningKey},
+		{name: "without kid", kid: "", err: ErrUnknownSigningKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, err := keys.verificationKey(tt.kid, now)
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.secret, string(secret))
+		})
+	}
+
+	active := keys.Keys(now)
+	require.Len(t, active, 2)
+	assert.Equal(t, "prev", active[0].ID)
+}
+
+func TestKeyring_Replace(t *testing.T) {
+	keys, err := NewKeyring(time.Hour)
+	require.NoError(t, err)
+	require.Len(t, keys.Keys(time.Now()), 1)
+
+	assert.Error(t, keys.Replace(nil))
+	assert.Error(t, keys.Replace([]SigningKey{{ID: "k1"}}))
+	assert.Error(t, keys.Replace([]SigningKey{{ID: "k1", Secret: "a"}, {ID: "k1", Secret: "b"}}))
+	assert.NoError(t, keys.Replace([]SigningKey{SigningKeyFromSecret("secret")}))
+	assert.Equal(t, SigningKeyFromSecret("secret").ID, keys.signingKey().ID)
+}
+
+func TestUserUseCase_TokenRotation(t *testing.T) {
+	keys, err := NewKeyring(time.Hour, SigningKeyFromSecret("secret"))
+	require.NoError(t, err)
+	u := UserUseCase{keys: keys, tokenTTL: time.Hour}
+
+	oldToken, err := u.GenerateToken(models.User{ID: "1"})
+	require.NoError(t, err)
+
+	key, err := keys.Rotate()
+	require.NoError(t, err)
+	newToken, err := u.GenerateToken(models.User{ID: "2"})
+	require.NoError(t, err)
+
+	parsed, _ := jwt.Parse(newToken, nil)
+	require.NotNil(t, parsed)
+	assert.Equal(t, key.ID, parsed.Header["kid"])
+
+	//tokens of both keys are valid
+	for userID, token := range map[string]string{"1": oldToken, "2": newToken} {
+		valid, claims, err := u.ParseToken(token)
+		require.NoError(t, err)
+		assert.True(t, valid)
+		assert.Equal(t, userID, claims.UserID)
+	}
+
+	//another deployment with another secret doesn't accept the token
+	other, err := NewKeyring(time.Hour, SigningKeyFromSecret("another secret"))
+	require.NoError(t, err)
+	valid, _, err := UserUseCase{keys: other, tokenTTL: time.Hour}.ParseToken(newToken)
+	assert.Error(t, err)
+	assert.False(t, valid)
+}
+
+func TestSigningKeysFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	keys, err := LoadSigningKeys(path)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	key, err := GenerateSigningKey()
+	require.NoError(t, err)
+	require.NoError(t, SaveSigningKeys(path, []SigningKey{key}))
+	keys, err = LoadSigningKeys(path)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, key.ID, keys[0].ID)
+	assert.Equal(t, key.Secret, keys[0].Secret)
+	assert.True(t, key.CreatedAt.Equal(keys[0].CreatedAt))
+}
@@ -0,0 +1,127 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+)
+
+var ErrTooManyLoginAttempts = errors.New("too many failed login attempts")
+
+// LoginThrottledError is returned while login attempts are blocked, it matches ErrTooManyLoginAttempts
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginThrottledError) Error() string {
+	return fmt.Sprintf("%s: retry after %s", ErrTooManyLoginAttempts, e.RetryAfter)
+}
+
+func (e *LoginThrottledError) Is(target error) bool {
+	return target == ErrTooManyLoginAttempts
+}
+
+// LoginPolicy describes how failed logins are throttled.
+// After FreeAttempts failures every next attempt waits BaseDelay*2^n capped by MaxDelay,
+// after LockoutAfter failures attempts are blocked for LockoutDuration.
+type LoginPolicy struct {
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	Window          time.Duration //failures older than Window are forgotten
+}
+
+var (
+	// DefaultLoginPolicy throttles failures of the login
+	DefaultLoginPolicy = LoginPolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    10,
+		LockoutDuration: 15 * time.Minute,
+		Window:          15 * time.Minute,
+	}
+	// DefaultIPLoginPolicy throttles failures from the IP address, it's softer because of NAT
+	DefaultIPLoginPolicy = LoginPolicy{
+		FreeAttempts:    20,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    100,
+		LockoutDuration: 15 * time.Minute,
+		Window:          15 * time.Minute,
+	}
+)
+
+// block returns for how long the attempts are blocked after the failures
+func (p LoginPolicy) block(failures int) time.Duration {
+	if p.LockoutAfter > 0 && failures >= p.LockoutAfter {
+		return p.LockoutDuration
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	n := failures - p.FreeAttempts - 1
+	if n >= 32 {
+		return p.MaxDelay
+	}
+	if d := p.BaseDelay << n; d > 0 && d < p.MaxDelay {
+		return d
+	}
+	return p.MaxDelay
+}
+
+type loginKey struct {
+	key    string
+	policy LoginPolicy
+}
+
+func (u UserUseCase) loginKeys(login, ip string) []loginKey {
+	keys := []loginKey{{key: "login:" + login, policy: u.loginPolicy}}
+	if ip != "" {
+		keys = append(keys, loginKey{key: "ip:" + ip, policy: u.ipPolicy})
+	}
+	return keys
+}
+
+// beginLoginAttempt counts the attempt of the login and of the IP address as a failure before the password
+// is checked, so concurrent attempts can't all pass the check before their failures are recorded.
+// It returns LoginThrottledError if the login or the IP address is blocked, such attempt isn't counted.
+func (u UserUseCase) beginLoginAttempt(ctx context.Context, login, ip string) error {
+	keys := u.loginKeys(login, ip)
+	for i, k := range keys {
+		attempts, err := u.repo.CountLoginAttempt(ctx, k.key, k.policy.Window, k.policy.block)
+		if err != nil {
+			u.releaseLoginAttempts(ctx, keys[:i])
+			if errors.Is(err, storage.ErrLoginBlocked) {
+				return &LoginThrottledError{RetryAfter: time.Until(attempts.BlockedUntil)}
+			}
+			return fmt.Errorf("count login attempt failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// releaseLoginAttempts uncounts the attempt which hasn't failed, the failure is kept if it's impossible
+func (u UserUseCase) releaseLoginAttempts(ctx context.Context, keys []loginKey) {
+	for _, k := range keys {
+		if err := u.repo.ReleaseLoginAttempt(ctx, k.key, k.policy.block); err != nil {
+			log.Printf("release login attempt %s failed: %s", k.key, err)
+		}
+	}
+}
+
+// loginSucceeded forgets failures of the login. Only this attempt of the IP address is uncounted,
+// its failures are kept, otherwise the attacker could reset them by logging in to own account.
+func (u UserUseCase) loginSucceeded(ctx context.Context, login, ip string) error {
+	if err := u.repo.ResetLoginAttempts(ctx, "login:"+login); err != nil {
+		return fmt.Errorf("reset login attempts failed: %w", err)
+	}
+	u.releaseLoginAttempts(ctx, u.loginKeys(login, ip)[1:])
+	return nil
+}
@@ -0,0 +1,114 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+)
+
+func TestLoginPolicy_Block(t *testing.T) {
+	p := LoginPolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        10 * time.Second,
+		LockoutAfter:    10,
+		LockoutDuration: time.Hour,
+	}
+	tests := map[int]time.Duration{
+		1:   0,
+		3:   0,
+		4:   time.Second,
+		5:   2 * time.Second,
+		6:   4 * time.Second,
+		7:   8 * time.Second,
+		8:   10 * time.Second,
+		9:   10 * time.Second,
+		10:  time.Hour,
+		100: time.Hour,
+	}
+	for failures, want := range tests {
+		assert.Equal(t, want, p.block(failures), "failures %d", failures)
+	}
+	assert.Equal(t, time.Duration(0), LoginPolicy{}.block(100))
+}
+
+func TestUserUseCase_AuthUserThrottling(t *testing.T) {
+	ctx := context.Background()
+	u := newTestUserUseCase(t)
+	u.loginPolicy = LoginPolicy{FreeAttempts: 2, BaseDelay: time.Hour, MaxDelay: time.Hour, Window: time.Hour}
+	u.ipPolicy = LoginPolicy{FreeAttempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour, Window: time.Hour}
+	require.NoError(t, u.CreateUser(ctx, &models.User{Login: "user1", Password: "qwerty123"}))
+	require.NoError(t, u.CreateUser(ctx, &models.User{Login: "user2", Password: "qwerty123"}))
+
+	auth := func(login, password, ip string) error {
+		return u.AuthUser(ctx, &models.User{Login: login, Password: password}, ip)
+	}
+
+	assert.ErrorIs(t, auth("user1", "wrong", "10.0.0.1"), ErrInvalidLoginOrPassword)
+	//success resets failures of the login
+	require.NoError(t, auth("user1", "qwerty123", "10.0.0.1"))
+	assert.ErrorIs(t, auth("user1", "wrong", "10.0.0.1"), ErrInvalidLoginOrPassword)
+	assert.ErrorIs(t, auth("user1", "wrong", "10.0.0.2"), ErrInvalidLoginOrPassword)
+	assert.ErrorIs(t, auth("user1", "wrong", "10.0.0.3"), ErrInvalidLoginOrPassword)
+
+	//the login is blocked from any address, even with the right password
+	err := auth("user1", "qwerty123", "10.0.0.4")
+	var throttled *LoginThrottledError
+	require.ErrorAs(t, err, &throttled)
+	assert.ErrorIs(t, err, ErrTooManyLoginAttempts)
+	assert.InDelta(t, time.Hour.Seconds(), throttled.RetryAfter.Seconds(), 5)
+
+	//unknown logins from one address block the address
+	assert.ErrorIs(t, auth("nobody", "x", "10.0.0.1"), ErrInvalidLoginOrPassword)
+	assert.ErrorIs(t, auth("nobody2", "x", "10.0.0.1"), ErrInvalidLoginOrPassword)
+	assert.ErrorIs(t, auth("user2", "qwerty123", "10.0.0.1"), ErrTooManyLoginAttempts)
+	assert.NoError(t, auth("user2", "qwerty123", "10.0.0.5"))
+}
+
+// parallel guesses are counted before the password is checked, so they can't all pass the throttling
+func TestUserUseCase_AuthUserConcurrentGuesses(t *testing.T) {
+	const guesses = 20
+	ctx := context.Background()
+	u := newTestUserUseCase(t)
+	u.loginPolicy = LoginPolicy{FreeAttempts: 2, BaseDelay: time.Hour, MaxDelay: time.Hour, Window: time.Hour}
+	u.ipPolicy = LoginPolicy{FreeAttempts: 100, BaseDelay: time.Hour, MaxDelay: time.Hour, Window: time.Hour}
+	require.NoError(t, u.CreateUser(ctx, &models.User{Login: "user1", Password: "qwerty123"}))
+
+	var wg sync.WaitGroup
+	var checked, throttled int32
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := u.AuthUser(ctx, &models.User{Login: "user1", Password: fmt.Sprintf("guess%d", i)}, "10.0.0.1")
+			switch {
+			case errors.Is(err, ErrInvalidLoginOrPassword):
+				atomic.AddInt32(&checked, 1)
+			case errors.Is(err, ErrTooManyLoginAttempts):
+				atomic.AddInt32(&throttled, 1)
+			default:
+				t.Errorf("unexpected error %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	//the third failure blocks the login
+	assert.Equal(t, int32(3), checked)
+	assert.Equal(t, int32(guesses-3), throttled)
+
+	//the successful login of another user from the address doesn't count as the failure of the address
+	require.NoError(t, u.CreateUser(ctx, &models.User{Login: "user2", Password: "qwerty123"}))
+	require.NoError(t, u.AuthUser(ctx, &models.User{Login: "user2", Password: "qwerty123"}, "10.0.0.1"))
+	attempts, err := u.repo.GetLoginAttempts(ctx, "ip:10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, 3, attempts.Failures)
+}
@@ -1,11 +1,12 @@
 package usecase
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/OlegMzhelskiy/gophermart/pkg/accrual"
 	"github.com/OlegMzhelskiy/gophermart/pkg/validate"
-	"log"
+	"sync"
 	"time"
 
 	"github.com/OlegMzhelskiy/gophermart/internal/models"
@@ -18,54 +19,94 @@ var (
 	ErrInvalidOrderNumber            = errors.New("invalid order number")
 	ErrNotEnoughFunds                = errors.New("not enough funds in the account")
 	ErrWithdrawAlreadyExist          = errors.New("withdraw on this order already exist")
+	ErrOrderNotFound                 = errors.New("order not found")
+	ErrInvalidOrderStatus            = errors.New("invalid order status")
+	ErrInvalidSumRange               = errors.New("sum range must be positive and the minimum must not exceed the maximum")
+	ErrOrderStatusConflict           = errors.New("order status can't be changed to this status")
+	ErrOrderFinal                    = errors.New("order status is final")
+	ErrInvalidWithdrawSum            = errors.New("withdrawal sum must be positive")
 )
 
 type OrderUseCase struct {
-	repo             storage.Repository
-	processingOrders []models.OrderNumber
-	chProcOrder      chan models.OrderNumber
-	accrual          accrual.Accrualer
+	repo         storage.Repository
+	wakeUp       chan struct{}
+	accrual      accrual.Accrualer
+	workers      int
+	pollInterval time.Duration
+	wg           *sync.WaitGroup   //running workers
+	orderNumbers validate.Pipeline //validate.OrderNumberPipeline if it's nil
 }
 
-func NewOrderUseCase(repo storage.Repository, done chan struct{}, asAdr string) OrderUseCase {
+func NewOrderUseCase(repo storage.Repository, done chan struct{}, cfg Config) OrderUseCase {
 	u := OrderUseCase{
-		repo:        repo,
-		chProcOrder: make(chan models.OrderNumber, 100),
-		accrual:     accrual.NewSystem(asAdr),
+		repo:         repo,
+		wakeUp:       make(chan struct{}, 1),
+		accrual:      accrual.NewSystem(cfg.AccrualAddr),
+		workers:      cfg.Workers,
+		pollInterval: cfg.PollInterval,
+		wg:           &sync.WaitGroup{},
 	}
-
-	var err error
-	u.processingOrders, err = u.repo.GetOrdersWithStatus(models.OrderStatusProcessing, models.OrderStatusNew)
-	if err != nil {
-		log.Printf("get order with status failed: %s", err)
+	if u.workers < 1 {
+		u.workers = DefaultWorkers
+	}
+	if u.pollInterval <= 0 {
+		u.pollInterval = DefaultPollInterval
 	}
 
-	go u.workerGettingOrderStatus(done)
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		u.workerGettingOrderStatus(done)
+	}()
 
 	return u
 }
 
-func (u OrderUseCase) UploadOrder(order models.Order) error {
-	if order.Number == "" || !validate.CheckLuna(order.Number) {
-		return ErrInvalidOrderNumber
+// Wait blocks until the workers stop after closing done channel or ctx expires
+func (u OrderUseCase) Wait(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		u.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for accrual workers: %w", ctx.Err())
+	}
+}
+
+// orderNumber returns the normalized number if it's valid in one of the accepted schemes
+func (u OrderUseCase) orderNumber(s string) (models.OrderNumber, error) {
+	pipeline := u.orderNumbers
+	if pipeline == nil {
+		pipeline = validate.OrderNumberPipeline
 	}
-	orderDB, err := u.repo.GetOrderByNumber(order.Number)
+	number, err := pipeline.Run(s)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidOrderNumber, err)
+	}
+	return models.OrderNumber(number), nil
+}
+
+func (u OrderUseCase) UploadOrder(ctx context.Context, order models.Order) error {
+	number, err := u.orderNumber(string(order.Number))
+	if err != nil {
+		return err
+	}
+	order.Number = number
+	orderDB, err := u.repo.GetOrderByNumber(ctx, order.Number)
 	if err != nil && err != storage.ErrOrderNotFound {
 		return fmt.Errorf("get order by number failed: %w", err)
 	}
 	if err == storage.ErrOrderNotFound {
-		err = u.repo.CreateOrder(order)
+		//the order is saved together with the job for the worker
+		err = u.repo.CreateOrder(ctx, order)
 		if err != nil {
 			return fmt.Errorf("create order failed: %w", err)
 		}
-		//send for processing
-		go func(number models.OrderNumber) {
-			isCalc, err := u.UpdateOrderInfoFromAccrual(number)
-			if err != nil || !isCalc {
-				u.chProcOrder <- number //add to queue
-			}
-		}(order.Number)
-
+		u.wakeUpWorker()
 		return nil
 	}
 	if orderDB.UserID == order.UserID {
@@ -75,31 +116,147 @@ func (u OrderUseCase) UploadOrder(order models.Order) error {
 	}
 }
 
-func (u OrderUseCase) GetOrderList(userID string) ([]models.Order, error) {
-	return u.repo.GetOrderListByUserID(userID)
+// RequeueOrder makes the order to be requested from the accrual system again right now.
+// Statuses PROCESSED and INVALID never change, so such orders aren't requested.
+func (u OrderUseCase) RequeueOrder(ctx context.Context, number models.OrderNumber) error {
+	order, err := u.repo.GetOrderByNumber(ctx, number)
+	if err != nil {
+		if errors.Is(err, storage.ErrOrderNotFound) {
+			return ErrOrderNotFound
+		}
+		return fmt.Errorf("get order by number failed: %w", err)
+	}
+	if order.Status.Final() {
+		return ErrOrderFinal
+	}
+	if err := u.repo.RequeueAccrualJob(ctx, number); err != nil {
+		if errors.Is(err, storage.ErrOrderNotFound) {
+			return ErrOrderNotFound
+		}
+		return fmt.Errorf("requeue accrual job failed: %w", err)
+	}
+	u.wakeUpWorker()
+	return nil
 }
 
-func (u OrderUseCase) GetWithdrawals(userID string) ([]models.OrderWithdraw, error) {
-	userWith, err := u.repo.GetWithdrawalsListByUserID(userID)
+//don't wait for the next tick
+func (u OrderUseCase) wakeUpWorker() {
+	select {
+	case u.wakeUp <- struct{}{}:
+	default:
+	}
+}
+
+func (u OrderUseCase) GetOrderList(ctx context.Context, userID string) ([]models.Order, error) {
+	return u.repo.GetOrderListByUserID(ctx, userID)
+}
+
+// GetOrderPage returns the page of the user's orders sorted by uploaded_at
+func (u OrderUseCase) GetOrderPage(ctx context.Context, userID string, query models.OrderQuery) (models.OrderPage, error) {
+	page := models.OrderPage{}
+	limit, err := pageLimit(query.Limit)
+	if err != nil {
+		return page, err
+	}
+	if err := checkPeriod(query.From, query.To); err != nil {
+		return page, err
+	}
+	for _, status := range query.Statuses {
+		if !status.Valid() {
+			return page, fmt.Errorf("%w: %q", ErrInvalidOrderStatus, status)
+		}
+	}
+	filter := models.OrderFilter{
+		Statuses: query.Statuses,
+		From:     query.From,
+		To:       query.To,
+		Desc:     query.Desc,
+		Limit:    limit + 1, //one more order tells whether there is the next page
+	}
+	if query.Cursor != "" {
+		filter.After = &models.OrderPosition{}
+		if err := decodeCursor(query.Cursor, filter.After); err != nil {
+			return page, err
+		}
+	}
+	orders, err := u.repo.GetOrderPage(ctx, userID, filter)
+	if err != nil {
+		return page, fmt.Errorf("get order page failed: %w", err)
+	}
+	if len(orders) > limit {
+		orders = orders[:limit]
+		last := orders[limit-1]
+		page.NextCursor = encodeCursor(models.OrderPosition{UploadedAt: last.UploadedAt, Number: last.Number})
+	}
+	page.Orders = orders
+	return page, nil
+}
+
+func (u OrderUseCase) GetWithdrawals(ctx context.Context, userID string) ([]models.OrderWithdraw, error) {
+	userWith, err := u.repo.GetWithdrawalsListByUserID(ctx, userID)
 	if err != nil {
 		return userWith, fmt.Errorf("getting user's withdrawals failed: %w", err)
 	}
 	return userWith, nil
 }
 
-func (u OrderUseCase) Withdraw(userID string, withdraw models.WithdrawRequest) error {
-	if withdraw.OrderNumber == "" { //|| !checkLuna(withdraw.OrderNumber) {
-		return ErrInvalidOrderNumber
+// GetWithdrawalPage returns the page of the user's withdrawals sorted by processed_at
+func (u OrderUseCase) GetWithdrawalPage(ctx context.Context, userID string, query models.WithdrawalQuery) (models.WithdrawalPage, error) {
+	page := models.WithdrawalPage{}
+	limit, err := pageLimit(query.Limit)
+	if err != nil {
+		return page, err
+	}
+	if err := checkPeriod(query.From, query.To); err != nil {
+		return page, err
+	}
+	if query.MinSum < 0 || query.MaxSum < 0 || (query.MaxSum != 0 && query.MinSum > query.MaxSum) {
+		return page, ErrInvalidSumRange
+	}
+	filter := models.WithdrawalFilter{
+		From:   query.From,
+		To:     query.To,
+		MinSum: query.MinSum,
+		MaxSum: query.MaxSum,
+		Limit:  limit + 1, //one more withdrawal tells whether there is the next page
+	}
+	if query.Cursor != "" {
+		filter.After = &models.WithdrawalPosition{}
+		if err := decodeCursor(query.Cursor, filter.After); err != nil {
+			return page, err
+		}
 	}
-	bal, err := u.repo.GetBalanceByUserID(userID)
+	list, err := u.repo.GetWithdrawalPage(ctx, userID, filter)
 	if err != nil {
-		return fmt.Errorf("get balance failed: %w", err)
+		return page, fmt.Errorf("getting user's withdrawals failed: %w", err)
 	}
-	if bal < withdraw.Sum {
-		return ErrNotEnoughFunds
+	if len(list) > limit {
+		list = list[:limit]
+		last := list[limit-1]
+		page.NextCursor = encodeCursor(models.WithdrawalPosition{ProcessedAt: last.ProcessedAt, OrderNumber: last.OrderNumber})
 	}
-	err = u.repo.CreateWithdraw(userID, withdraw)
+	page.Withdrawals = list
+	return page, nil
+}
+
+func (u OrderUseCase) Withdraw(ctx context.Context, userID string, withdraw models.WithdrawRequest) error {
+	number, err := u.orderNumber(withdraw.OrderNumber)
+	if err != nil {
+		return err
+	}
+	//the withdrawal of a negative sum would credit the account
+	if withdraw.Sum <= 0 {
+		return ErrInvalidWithdrawSum
+	}
+	withdraw.OrderNumber = string(number)
+	err = u.repo.WithdrawTx(ctx, userID, withdraw)
 	if err != nil {
+		if errors.Is(err, storage.ErrInvalidSum) {
+			return ErrInvalidWithdrawSum
+		}
+		if errors.Is(err, storage.ErrNotEnoughFunds) {
+			return ErrNotEnoughFunds
+		}
 		if errors.Is(err, storage.ErrWithdrawAlreadyExist) {
 			return ErrWithdrawAlreadyExist
 		}
@@ -108,55 +265,81 @@ func (u OrderUseCase) Withdraw(userID string, withdraw models.WithdrawRequest) e
 	return nil
 }
 
-// UpdateOrderInfoFromAccrual return (isCalculated, error)
-func (u *OrderUseCase) UpdateOrderInfoFromAccrual(number models.OrderNumber) (bool, error) {
-	req, err := u.accrual.GetOrderStatus(number)
+// orderStatusFromAccrual maps the status of the accrual system, the order keeps its status while it's registered
+func orderStatusFromAccrual(status string) (models.OrderStatus, bool, error) {
+	switch status {
+	case models.OrderAccrualStatusRegistered:
+		return "", false, nil
+	case models.OrderAccrualStatusProcessing:
+		return models.OrderStatusProcessing, true, nil
+	case models.OrderAccrualStatusProcessed:
+		return models.OrderStatusProcessed, true, nil
+	case models.OrderAccrualStatusInvalid:
+		return models.OrderStatusInvalid, true, nil
+	default:
+		return "", false, fmt.Errorf("unknown accrual status %q", status)
+	}
+}
+
+// UpdateOrderInfoFromAccrual return (isCalculated, error).
+// The status changes only along the order state machine, a late response for the order of final status is ignored.
+func (u *OrderUseCase) UpdateOrderInfoFromAccrual(ctx context.Context, number models.OrderNumber) (bool, error) {
+	req, err := u.accrual.GetOrderStatus(ctx, number)
 	if err != nil {
 		return false, err
 	}
-	var isCalc bool
-	var order models.Order
-	if req.Status != models.OrderAccrualStatusRegistered {
-		if req.Status == models.OrderAccrualStatusProcessing {
-			order, err = u.repo.GetOrderByNumber(number)
-			if err != nil {
-				return false, fmt.Errorf("get order by number failed: %w", err)
-			}
-			if order.Status != models.OrderStatusNew {
-				return false, nil
-			}
-			order.Status = models.OrderStatus(req.Status)
-		} else {
-			isCalc = true
-			order = models.Order{
-				Number:  number,
-				Accrual: req.Sum,
-				Status:  models.OrderStatus(req.Status)}
-		}
-		return isCalc, u.repo.UpdateOrder(order)
+	next, ok, err := orderStatusFromAccrual(req.Status)
+	if err != nil || !ok {
+		return false, err
+	}
+	order, err := u.repo.GetOrderByNumber(ctx, number)
+	if err != nil {
+		return false, fmt.Errorf("get order by number failed: %w", err)
+	}
+	if order.Status.Final() {
+		return true, nil
+	}
+	if order.Status == next {
+		return false, nil
+	}
+	if !order.Status.CanTransitionTo(next) {
+		return false, fmt.Errorf("order %s: %w: %s to %s", number, ErrOrderStatusConflict, order.Status, next)
+	}
+	order.Status = next
+	if next == models.OrderStatusProcessed {
+		order.Accrual = req.Sum
 	}
-	return false, nil
+	err = u.repo.UpdateOrder(ctx, order)
+	if errors.Is(err, storage.ErrOrderStatusConflict) {
+		//another worker has finished the order meanwhile
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("update order failed: %w", err)
+	}
+	return next.Final(), nil
 }
 
-func (u *OrderUseCase) workerGettingOrderStatus(done chan struct{}) {
-	ticker := time.NewTicker(time.Minute)
-	for {
-		select {
-		case <-done:
-			fmt.Println("quit goroutine getting order status")
-			return
-		case <-ticker.C:
-			for i, v := range u.processingOrders {
-				isCalc, err := u.UpdateOrderInfoFromAccrual(v)
-				if err == nil && isCalc {
-					u.processingOrders = append(u.processingOrders[:i], u.processingOrders[i+1:]...) //remove from queue
-				}
-			}
-		case number, ok := <-u.chProcOrder:
-			if !ok {
-				return
-			}
-			u.processingOrders = append(u.processingOrders, number) //add to queue
+// GetOrder returns the user's order with its status history, the number is normalized as on upload
+func (u OrderUseCase) GetOrder(ctx context.Context, userID string, number models.OrderNumber) (models.OrderDetails, error) {
+	number, err := u.orderNumber(string(number))
+	if err != nil {
+		return models.OrderDetails{}, err
+	}
+	order, err := u.repo.GetOrderByNumber(ctx, number)
+	if err != nil {
+		if errors.Is(err, storage.ErrOrderNotFound) {
+			return models.OrderDetails{}, ErrOrderNotFound
 		}
+		return models.OrderDetails{}, fmt.Errorf("get order by number failed: %w", err)
+	}
+	//the orders of other users aren't disclosed
+	if order.UserID != userID {
+		return models.OrderDetails{}, ErrOrderNotFound
+	}
+	history, err := u.repo.GetOrderStatusHistory(ctx, number)
+	if err != nil {
+		return models.OrderDetails{}, fmt.Errorf("get order status history failed: %w", err)
 	}
+	return models.OrderDetails{Order: order, History: history}, nil
 }
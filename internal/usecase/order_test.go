@@ -0,0 +1,191 @@
+package usecase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+	"github.com/OlegMzhelskiy/gophermart/pkg/validate"
+)
+
+func TestOrderUseCase_GetOrderPage(t *testing.T) {
+	ctx := context.Background()
+	repo := storage.NewMemStore()
+	u := OrderUseCase{repo: repo}
+	base := time.Now().Add(-time.Hour)
+	for i, number := range []models.OrderNumber{"12345678903", "2377225624", "4561261212345467", "49927398716"} {
+		require.NoError(t, repo.CreateOrder(ctx, models.Order{Number: number, UserID: "1", UploadedAt: base.Add(time.Duration(i) * time.Minute)}))
+	}
+
+	//pages of the newest orders cover all orders once
+	seen := []models.OrderNumber{}
+	query := models.OrderQuery{Desc: true, Limit: 3}
+	for {
+		page, err := u.GetOrderPage(ctx, "1", query)
+		require.NoError(t, err)
+		for _, o := range page.Orders {
+			seen = append(seen, o.Number)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	assert.Equal(t, []models.OrderNumber{"49927398716", "4561261212345467", "2377225624", "12345678903"}, seen)
+
+	page, err := u.GetOrderPage(ctx, "1", models.OrderQuery{Statuses: []models.OrderStatus{models.OrderStatusProcessed}})
+	require.NoError(t, err)
+	assert.Empty(t, page.Orders)
+
+	tests := []struct {
+		name  string
+		query models.OrderQuery
+		err   error
+	}{
+		{name: "unknown status", query: models.OrderQuery{Statuses: []models.OrderStatus{"DONE"}}, err: ErrInvalidOrderStatus},
+		{name: "broken cursor", query: models.OrderQuery{Cursor: "abc"}, err: ErrInvalidCursor},
+		{name: "too big limit", query: models.OrderQuery{Limit: MaxPageLimit + 1}, err: ErrInvalidPageLimit},
+		{name: "inverted period", query: models.OrderQuery{From: base, To: base.Add(-time.Hour)}, err: ErrInvalidPeriod},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := u.GetOrderPage(ctx, "1", tt.query)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestOrderUseCase_GetWithdrawalPage(t *testing.T) {
+	ctx := context.Background()
+	repo := storage.NewMemStore()
+	u := OrderUseCase{repo: repo}
+	userID, err := repo.CreateUser(ctx, "user1", "hash")
+	require.NoError(t, err)
+	_, err = repo.CreateAdjustment(ctx, models.Adjustment{UserID: userID, Amount: models.Points(1000), Reason: models.AdjustmentReasonGoodwill, OperatorID: userID})
+	require.NoError(t, err)
+	for i, number := range []string{"12345678903", "2377225624", "49927398716"} {
+		require.NoError(t, u.Withdraw(ctx, userID, models.WithdrawRequest{OrderNumber: number, Sum: models.Points(int64(100 * (i + 1)))}))
+	}
+
+	first, err := u.GetWithdrawalPage(ctx, userID, models.WithdrawalQuery{Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, first.Withdrawals, 2)
+	require.NotEmpty(t, first.NextCursor)
+	second, err := u.GetWithdrawalPage(ctx, userID, models.WithdrawalQuery{Limit: 2, Cursor: first.NextCursor})
+	require.NoError(t, err)
+	require.Len(t, second.Withdrawals, 1)
+	assert.Equal(t, "49927398716", second.Withdrawals[0].OrderNumber)
+	assert.Empty(t, second.NextCursor)
+
+	page, err := u.GetWithdrawalPage(ctx, userID, models.WithdrawalQuery{MinSum: models.Points(150), MaxSum: models.Points(250)})
+	require.NoError(t, err)
+	require.Len(t, page.Withdrawals, 1)
+	assert.Equal(t, "2377225624", page.Withdrawals[0].OrderNumber)
+
+	tests := []struct {
+		name  string
+		query models.WithdrawalQuery
+		err   error
+	}{
+		{name: "inverted sum range", query: models.WithdrawalQuery{MinSum: models.Points(300), MaxSum: models.Points(100)}, err: ErrInvalidSumRange},
+		{name: "negative sum", query: models.WithdrawalQuery{MinSum: models.Points(-1)}, err: ErrInvalidSumRange},
+		{name: "broken cursor", query: models.WithdrawalQuery{Cursor: "abc"}, err: ErrInvalidCursor},
+		{name: "negative limit", query: models.WithdrawalQuery{Limit: -5}, err: ErrInvalidPageLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := u.GetWithdrawalPage(ctx, userID, tt.query)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestOrderUseCase_Withdraw(t *testing.T) {
+	ctx := context.Background()
+	repo := storage.NewMemStore()
+	u := OrderUseCase{repo: repo}
+	userID, err := repo.CreateUser(ctx, "user1", "hash")
+	require.NoError(t, err)
+	_, err = repo.CreateAdjustment(ctx, models.Adjustment{UserID: userID, Amount: models.Points(1000), Reason: models.AdjustmentReasonGoodwill, OperatorID: userID})
+	require.NoError(t, err)
+
+	for _, number := range []string{"", "abc", "12345678904", "0"} {
+		err := u.Withdraw(ctx, userID, models.WithdrawRequest{OrderNumber: number, Sum: models.Points(100)})
+		assert.ErrorIs(t, err, ErrInvalidOrderNumber, number)
+	}
+	for _, sum := range []models.SumScore{0, -models.Points(1000)} {
+		err := u.Withdraw(ctx, userID, models.WithdrawRequest{OrderNumber: "4561261212345467", Sum: sum})
+		assert.ErrorIs(t, err, ErrInvalidWithdrawSum, sum)
+	}
+
+	//the number is saved normalized, so the same order written another way is the same withdrawal
+	require.NoError(t, u.Withdraw(ctx, userID, models.WithdrawRequest{OrderNumber: " 2377-2256-24 ", Sum: models.Points(100)}))
+	err = u.Withdraw(ctx, userID, models.WithdrawRequest{OrderNumber: "2377225624", Sum: models.Points(100)})
+	assert.ErrorIs(t, err, ErrWithdrawAlreadyExist)
+	list, err := u.GetWithdrawals(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "2377225624", list[0].OrderNumber)
+}
+
+func TestOrderUseCase_GetOrder(t *testing.T) {
+	ctx := context.Background()
+	repo := storage.NewMemStore()
+	u := OrderUseCase{repo: repo}
+	require.NoError(t, u.UploadOrder(ctx, models.Order{Number: "12345678903", UserID: "1", UploadedAt: time.Now()}))
+
+	for _, number := range []models.OrderNumber{"12345678903", " 1234-5678-903 "} {
+		order, err := u.GetOrder(ctx, "1", number)
+		require.NoError(t, err, number)
+		assert.Equal(t, models.OrderNumber("12345678903"), order.Number)
+		assert.Len(t, order.History, 1)
+	}
+	for _, number := range []models.OrderNumber{"", "abc", "12345678904"} {
+		_, err := u.GetOrder(ctx, "1", number)
+		assert.ErrorIs(t, err, ErrInvalidOrderNumber, number)
+	}
+	_, err := u.GetOrder(ctx, "2", "12345678903")
+	assert.ErrorIs(t, err, ErrOrderNotFound)
+}
+
+func TestOrderUseCase_OrderNumberSchemes(t *testing.T) {
+	ctx := context.Background()
+	done := make(chan struct{})
+	defer close(done)
+
+	_, err := NewUseCases(storage.NewMemStore(), done, Config{OrderNumberSchemes: []string{"luhn", "isbn"}})
+	assert.ErrorIs(t, err, validate.ErrUnknownScheme)
+
+	uc, err := NewUseCases(storage.NewMemStore(), done, Config{OrderNumberSchemes: []string{"ean", "damm"}})
+	require.NoError(t, err)
+	for _, number := range []models.OrderNumber{"4006381333931", "5724"} {
+		assert.NoError(t, uc.Order.UploadOrder(ctx, models.Order{Number: number, UserID: "1", UploadedAt: time.Now()}))
+	}
+	//Luhn isn't accepted anymore
+	err = uc.Order.UploadOrder(ctx, models.Order{Number: "12345678903", UserID: "1", UploadedAt: time.Now()})
+	assert.ErrorIs(t, err, ErrInvalidOrderNumber)
+}
+
+func TestOrderUseCase_RequeueOrder(t *testing.T) {
+	ctx := context.Background()
+	repo := storage.NewMemStore()
+	u := OrderUseCase{repo: repo, wakeUp: make(chan struct{}, 1)}
+	for _, number := range []models.OrderNumber{"12345678903", "2377225624", "49927398716"} {
+		require.NoError(t, repo.CreateOrder(ctx, models.Order{Number: number, UserID: "1", UploadedAt: time.Now()}))
+	}
+	require.NoError(t, repo.UpdateOrder(ctx, models.Order{Number: "2377225624", Status: models.OrderStatusProcessing}))
+	require.NoError(t, repo.UpdateOrder(ctx, models.Order{Number: "49927398716", Status: models.OrderStatusInvalid}))
+
+	assert.NoError(t, u.RequeueOrder(ctx, "12345678903"))
+	assert.NoError(t, u.RequeueOrder(ctx, "2377225624"))
+	assert.ErrorIs(t, u.RequeueOrder(ctx, "49927398716"), ErrOrderFinal)
+	assert.ErrorIs(t, u.RequeueOrder(ctx, "79927398713"), ErrOrderNotFound)
+
+	require.NoError(t, repo.UpdateOrder(ctx, models.Order{Number: "2377225624", Status: models.OrderStatusProcessed, Accrual: models.Points(10)}))
+	assert.ErrorIs(t, u.RequeueOrder(ctx, "2377225624"), ErrOrderFinal)
+}
@@ -0,0 +1,58 @@
+package usecase
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 1000
+)
+
+var (
+	ErrInvalidCursor    = errors.New("invalid cursor")
+	ErrInvalidPageLimit = errors.New("limit must be between 1 and 1000")
+	ErrInvalidPeriod    = errors.New("the beginning of the period is after its end")
+)
+
+// pageLimit returns the default limit for zero and validates others
+func pageLimit(limit int) (int, error) {
+	if limit == 0 {
+		return DefaultPageLimit, nil
+	}
+	if limit < 0 || limit > MaxPageLimit {
+		return 0, ErrInvalidPageLimit
+	}
+	return limit, nil
+}
+
+func checkPeriod(from, to time.Time) error {
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		return ErrInvalidPeriod
+	}
+	return nil
+}
+
+// encodeCursor makes the opaque cursor from the position of the last item of the page
+func encodeCursor(position interface{}) string {
+	data, _ := json.Marshal(position)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor restores the position, empty cursor leaves it zero
+func decodeCursor(cursor string, position interface{}) error {
+	if cursor == "" {
+		return nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, position); err != nil {
+		return ErrInvalidCursor
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package usecase
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrTokenRevoked        = errors.New("token is revoked")
+)
+
+// TokenPair is short-lived access token and refresh token for getting the next pair
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// IssueTokens returns tokens of the new session, its refresh tokens make a new family
+func (u UserUseCase) IssueTokens(ctx context.Context, user models.User) (TokenPair, error) {
+	pair := TokenPair{}
+	familyID, err := randomToken(16)
+	if err != nil {
+		return pair, err
+	}
+	refresh, err := randomToken(32)
+	if err != nil {
+		return pair, err
+	}
+	err = u.repo.CreateRefreshToken(ctx, models.RefreshToken{
+		TokenHash: hashToken(refresh),
+		UserID:    user.ID,
+		FamilyID:  familyID,
+		ExpiresAt: time.Now().Add(u.refreshTTL),
+	})
+	if err != nil {
+		return pair, fmt.Errorf("save refresh token failed: %w", err)
+	}
+	pair.RefreshToken = refresh
+	pair.AccessToken, err = u.GenerateToken(user)
+	return pair, err
+}
+
+// RefreshTokens exchanges the refresh token for the next pair, the refresh token can be used only once
+func (u UserUseCase) RefreshTokens(ctx context.Context, refreshToken string) (TokenPair, error) {
+	pair := TokenPair{}
+	if refreshToken == "" {
+		return pair, ErrInvalidRefreshToken
+	}
+	next, err := randomToken(32)
+	if err != nil {
+		return pair, err
+	}
+	stored, err := u.repo.RotateRefreshToken(ctx, hashToken(refreshToken), hashToken(next), time.Now().Add(u.refreshTTL))
+	if err != nil {
+		if errors.Is(err, storage.ErrRefreshTokenNotFound) || errors.Is(err, storage.ErrRefreshTokenExpired) ||
+			errors.Is(err, storage.ErrRefreshTokenReused) {
+			return pair, fmt.Errorf("%w: %s", ErrInvalidRefreshToken, err)
+		}
+		return pair, fmt.Errorf("rotate refresh token failed: %w", err)
+	}
+	//the role could be changed since the previous token
+	user, err := u.repo.GetUserByID(ctx, stored.UserID)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return pair, ErrInvalidRefreshToken
+		}
+		return pair, fmt.Errorf("get user by id failed: %w", err)
+	}
+	pair.RefreshToken = next
+	pair.AccessToken, err = u.GenerateToken(user)
+	return pair, err
+}
+
+// Logout revokes the access token and the family of the refresh token if it's given
+func (u UserUseCase) Logout(ctx context.Context, accessToken, refreshToken string) error {
+	_, claims, err := u.ParseToken(accessToken)
+	if err != nil {
+		return err
+	}
+	if claims.Id != "" {
+		if err := u.repo.RevokeAccessToken(ctx, claims.Id, time.Unix(claims.ExpiresAt, 0)); err != nil {
+			return fmt.Errorf("revoke access token failed: %w", err)
+		}
+	}
+	if refreshToken == "" {
+		return nil
+	}
+	err = u.repo.RevokeRefreshTokenFamily(ctx, claims.UserID, hashToken(refreshToken))
+	if err != nil && !errors.Is(err, storage.ErrRefreshTokenNotFound) {
+		return fmt.Errorf("revoke refresh token failed: %w", err)
+	}
+	return nil
+}
+
+// CheckRevoked returns ErrTokenRevoked if the token was revoked by logout, issued before the password change
+// or carries the role which the user no longer has
+func (u UserUseCase) CheckRevoked(ctx context.Context, claims tokenClaims) error {
+	if claims.Id != "" {
+		revoked, err := u.repo.IsAccessTokenRevoked(ctx, claims.Id)
+		if err != nil {
+			return fmt.Errorf("check token revocation failed: %w", err)
+		}
+		if revoked {
+			return ErrTokenRevoked
+		}
+	}
+	user, err := u.repo.GetUserByID(ctx, claims.UserID)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return ErrTokenRevoked
+		}
+		return fmt.Errorf("get user by id failed: %w", err)
+	}
+	if claims.issuedAt().Before(user.TokensValidAfter) || claims.UserRole() != user.Role {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate token failed: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the form of refresh token kept in the database
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
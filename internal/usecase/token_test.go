@@ -0,0 +1,89 @@
+package usecase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+)
+
+func newTestUserUseCase(t *testing.T) UserUseCase {
+	keys, err := NewKeyring(time.Hour)
+	require.NoError(t, err)
+	return UserUseCase{
+		repo:       storage.NewMemStore(),
+		keys:       keys,
+		tokenTTL:   time.Hour,
+		refreshTTL: time.Hour,
+		bcryptCost: bcrypt.MinCost,
+	}
+}
+
+func TestUserUseCase_RefreshTokens(t *testing.T) {
+	ctx := context.Background()
+	u := newTestUserUseCase(t)
+	require.NoError(t, u.CreateUser(ctx, &models.User{Login: "user1", Password: "qwerty123"}))
+
+	first, err := u.IssueTokens(ctx, models.User{ID: "1"})
+	require.NoError(t, err)
+	second, err := u.RefreshTokens(ctx, first.RefreshToken)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	_, claims, err := u.ParseToken(second.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "1", claims.UserID)
+
+	third, err := u.RefreshTokens(ctx, second.RefreshToken)
+	require.NoError(t, err)
+
+	//the first token is replayed, the whole family is revoked
+	_, err = u.RefreshTokens(ctx, first.RefreshToken)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	_, err = u.RefreshTokens(ctx, third.RefreshToken)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	_, err = u.RefreshTokens(ctx, "unknown")
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	_, err = u.RefreshTokens(ctx, "")
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+}
+
+func TestUserUseCase_Logout(t *testing.T) {
+	ctx := context.Background()
+	u := newTestUserUseCase(t)
+	require.NoError(t, u.CreateUser(ctx, &models.User{Login: "user1", Password: "qwerty123"}))
+	require.NoError(t, u.CreateUser(ctx, &models.User{Login: "user2", Password: "qwerty123"}))
+
+	session, err := u.IssueTokens(ctx, models.User{ID: "1"})
+	require.NoError(t, err)
+	other, err := u.IssueTokens(ctx, models.User{ID: "1"})
+	require.NoError(t, err)
+
+	require.NoError(t, u.Logout(ctx, session.AccessToken, session.RefreshToken))
+
+	_, claims, err := u.ParseToken(session.AccessToken)
+	require.NoError(t, err)
+	assert.ErrorIs(t, u.CheckRevoked(ctx, claims), ErrTokenRevoked)
+	_, err = u.RefreshTokens(ctx, session.RefreshToken)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	//another session of the user is alive
+	_, claims, err = u.ParseToken(other.AccessToken)
+	require.NoError(t, err)
+	assert.NoError(t, u.CheckRevoked(ctx, claims))
+	_, err = u.RefreshTokens(ctx, other.RefreshToken)
+	assert.NoError(t, err)
+
+	//refresh token of another user isn't revoked
+	stranger, err := u.IssueTokens(ctx, models.User{ID: "2"})
+	require.NoError(t, err)
+	require.NoError(t, u.Logout(ctx, other.AccessToken, stranger.RefreshToken))
+	_, err = u.RefreshTokens(ctx, stranger.RefreshToken)
+	assert.NoError(t, err)
+}
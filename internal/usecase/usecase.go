@@ -1,22 +1,98 @@
 package usecase
 
 import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
 	"github.com/OlegMzhelskiy/gophermart/internal/storage"
+	"github.com/OlegMzhelskiy/gophermart/pkg/validate"
 )
 
+const (
+	DefaultWorkers         = 4
+	DefaultPollInterval    = 5 * time.Second
+	DefaultTokenTTL        = 15 * time.Minute
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+	DefaultBcryptCost      = bcrypt.DefaultCost
+)
+
+type Config struct {
+	AccrualAddr     string
+	Workers         int           //size of the pool requesting the accrual system
+	PollInterval    time.Duration //how often due accrual jobs are checked
+	SigningKeys     []SigningKey  //keys for signing tokens, a random key valid until restart is used if it's empty
+	TokenTTL        time.Duration //lifetime of access token
+	RefreshTokenTTL time.Duration
+	LoginPolicy     LoginPolicy   //throttling of failed logins, DefaultLoginPolicy if it's zero
+	IPLoginPolicy   LoginPolicy   //throttling of failed logins from IP address, DefaultIPLoginPolicy if it's zero
+	BcryptCost      int           //cost of password hashes, hashes of other cost are upgraded on login
+	IdempotencyTTL  time.Duration //how long responses to requests with Idempotency-Key are replayed
+	// OrderNumberSchemes are names of accepted check digit schemes of validate.DefaultRegistry,
+	// validate.DefaultOrderNumberSchemes if it's empty
+	OrderNumberSchemes []string
+}
+
 type UseCases struct {
-	User  UserUseCase
-	Order OrderUseCase
+	User        UserUseCase
+	Order       OrderUseCase
+	Idempotency IdempotencyUseCase
+	repo        storage.Repository
 }
 
-func NewUseCases(repo storage.Repository, done chan struct{}, asAdr string) *UseCases {
-	return &UseCases{
-		User:  UserUseCase{repo: repo},
-		Order: NewOrderUseCase(repo, done, asAdr),
+func NewUseCases(repo storage.Repository, done chan struct{}, cfg Config) (*UseCases, error) {
+	if cfg.TokenTTL <= 0 {
+		cfg.TokenTTL = DefaultTokenTTL
+	}
+	if cfg.RefreshTokenTTL <= 0 {
+		cfg.RefreshTokenTTL = DefaultRefreshTokenTTL
+	}
+	if cfg.LoginPolicy == (LoginPolicy{}) {
+		cfg.LoginPolicy = DefaultLoginPolicy
 	}
+	if cfg.IPLoginPolicy == (LoginPolicy{}) {
+		cfg.IPLoginPolicy = DefaultIPLoginPolicy
+	}
+	if cfg.BcryptCost == 0 {
+		cfg.BcryptCost = DefaultBcryptCost
+	}
+	if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	keys, err := NewKeyring(cfg.TokenTTL, cfg.SigningKeys...)
+	if err != nil {
+		return nil, fmt.Errorf("init signing keys failed: %w", err)
+	}
+	orderNumbers, err := validate.DefaultRegistry.OrderNumberPipeline(cfg.OrderNumberSchemes...)
+	if err != nil {
+		return nil, fmt.Errorf("init order number validation failed: %w", err)
+	}
+	order := NewOrderUseCase(repo, done, cfg)
+	order.orderNumbers = orderNumbers
+	return &UseCases{
+		User: UserUseCase{
+			repo:        repo,
+			keys:        keys,
+			tokenTTL:    cfg.TokenTTL,
+			refreshTTL:  cfg.RefreshTokenTTL,
+			loginPolicy: cfg.LoginPolicy,
+			ipPolicy:    cfg.IPLoginPolicy,
+			bcryptCost:  cfg.BcryptCost,
+		},
+		Order:       order,
+		Idempotency: NewIdempotencyUseCase(repo, cfg.IdempotencyTTL),
+		repo:        repo,
+	}, nil
+}
+
+// WaitWorkers waits for the background workers, they stop when done channel is closed
+func (u UseCases) WaitWorkers(ctx context.Context) error {
+	return u.Order.Wait(ctx)
 }
 
+// CloseRepo closes the repository shared by the use cases
 func (u UseCases) CloseRepo() {
-	u.User.repo.Close()
-	u.Order.repo.Close()
+	u.repo.Close()
 }
@@ -1,8 +1,10 @@
 package usecase
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -12,38 +14,60 @@ import (
 	"github.com/OlegMzhelskiy/gophermart/internal/storage"
 )
 
-const (
-	tokenTTL  = 12 * time.Hour
-	secretKey = "dSKklbjNiulfhvsdKmvdjvnuLQhnriludhnbmijlJHADSFodfgok"
-)
-
 var (
 	ErrLoginIsEmpty           = errors.New("login is empty")
 	ErrLoginAlreadyExists     = errors.New("login already exists")
 	ErrInvalidLoginOrPassword = errors.New("invalid login or password")
 	ErrPasswordTooShort       = errors.New("password must be longer than 5 characters")
+	ErrWrongPassword          = errors.New("wrong password")
+	ErrUserNotFound           = errors.New("user not found")
+	ErrUnknownRole            = errors.New("unknown role")
 )
 
 type tokenClaims struct {
 	jwt.StandardClaims
-	UserID string `json:"user_id"`
+	UserID        string      `json:"user_id"`
+	Role          models.Role `json:"role,omitempty"`
+	IssuedAtMicro int64       `json:"iat_us,omitempty"` //iat in microseconds, iat itself has seconds precision
+}
+
+// issuedAt returns the time the token was issued, tokens issued before iat_us was introduced have seconds precision
+func (c tokenClaims) issuedAt() time.Time {
+	if c.IssuedAtMicro != 0 {
+		return time.UnixMicro(c.IssuedAtMicro)
+	}
+	return time.Unix(c.IssuedAt, 0)
+}
+
+// UserRole returns the role of the token, tokens issued before roles were introduced belong to users
+func (c tokenClaims) UserRole() models.Role {
+	if c.Role == "" {
+		return models.RoleUser
+	}
+	return c.Role
 }
 
 type UserUseCase struct {
-	repo storage.Repository
+	repo       storage.Repository
+	keys       *Keyring
+	tokenTTL   time.Duration
+	refreshTTL time.Duration
+
+	loginPolicy LoginPolicy
+	ipPolicy    LoginPolicy
+	bcryptCost  int
 }
 
-func (u UserUseCase) CreateUser(user *models.User) error {
+func (u UserUseCase) CreateUser(ctx context.Context, user *models.User) error {
 	//validate login
 	if len(user.Login) == 0 {
 		return ErrLoginIsEmpty
 	}
-	//validate password
-	if len(user.Password) < 6 {
-		return ErrPasswordTooShort
+	if err := validatePassword(user.Password); err != nil {
+		return err
 	}
 	//exist login
-	userBD, err := u.repo.GetUserByLogin(user.Login)
+	userBD, err := u.repo.GetUserByLogin(ctx, user.Login)
 	if err != nil && err != storage.ErrUserNotFound {
 		return fmt.Errorf("get user by id failed: %w", err)
 	}
@@ -51,36 +75,151 @@ func (u UserUseCase) CreateUser(user *models.User) error {
 		return ErrLoginAlreadyExists
 	}
 	//hashing password
-	encryptedPas, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.MinCost)
+	encryptedPas, err := u.hashPassword(user.Password)
 	if err != nil {
-		return fmt.Errorf("hashing password failed: %w", err)
+		return err
 	}
-	user.ID, err = u.repo.CreateUser(user.Login, string(encryptedPas)) //return userID
+	user.ID, err = u.repo.CreateUser(ctx, user.Login, string(encryptedPas)) //return userID
 	if err != nil {
 		return fmt.Errorf("create user failed: %w", err)
 	}
+	user.Role = models.RoleUser
 	return nil
 }
 
-func (u UserUseCase) AuthUser(user *models.User) error {
-	userBD, err := u.repo.GetUserByLogin(user.Login)
-	if err != nil {
+// AuthUser checks login and password, failed attempts of the login and of the client's IP address are throttled
+func (u UserUseCase) AuthUser(ctx context.Context, user *models.User, ip string) error {
+	if err := u.beginLoginAttempt(ctx, user.Login, ip); err != nil {
+		return err
+	}
+	userBD, err := u.repo.GetUserByLogin(ctx, user.Login)
+	if err != nil && err != storage.ErrUserNotFound {
+		u.releaseLoginAttempts(ctx, u.loginKeys(user.Login, ip))
 		return fmt.Errorf("getting user's password failed: %w", err)
 	}
-	if !comparePassword(userBD.EncryptedPassword, user.Password) {
+	//unknown login is a failure too, so logins can't be enumerated
+	if err == storage.ErrUserNotFound || !comparePassword(userBD.EncryptedPassword, user.Password) {
 		return ErrInvalidLoginOrPassword
 	}
+	if err := u.loginSucceeded(ctx, user.Login, ip); err != nil {
+		return err
+	}
 	user.ID = userBD.ID
+	user.Role = userBD.Role
+	u.upgradePasswordHash(ctx, userBD, user.Password)
+	return nil
+}
+
+// upgradePasswordHash rehashes the password if it was hashed with another cost.
+// The login doesn't fail if it's impossible, the hash is upgraded next time.
+func (u UserUseCase) upgradePasswordHash(ctx context.Context, user models.User, password string) {
+	cost, err := bcrypt.Cost([]byte(user.EncryptedPassword))
+	if err != nil || cost == u.bcryptCost {
+		return
+	}
+	encryptedPas, err := u.hashPassword(password)
+	if err == nil {
+		err = u.repo.UpdateUserPassword(ctx, user.ID, encryptedPas)
+	}
+	if err != nil {
+		log.Printf("upgrade password hash of user %s failed: %s", user.ID, err)
+	}
+}
+
+// ChangePassword sets the new password if the old one is right and invalidates all tokens of the user.
+// Wrong old passwords are throttled like failed logins.
+func (u UserUseCase) ChangePassword(ctx context.Context, userID, oldPassword, newPassword, ip string) error {
+	user, err := u.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("get user by id failed: %w", err)
+	}
+	if err := u.beginLoginAttempt(ctx, user.Login, ip); err != nil {
+		return err
+	}
+	if !comparePassword(user.EncryptedPassword, oldPassword) {
+		return ErrWrongPassword
+	}
+	u.releaseLoginAttempts(ctx, u.loginKeys(user.Login, ip))
+	if err := validatePassword(newPassword); err != nil {
+		return err
+	}
+	encryptedPas, err := u.hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	//the database keeps microseconds, tokens issued before the change are rejected even within the same second
+	validAfter := time.Now().Truncate(time.Microsecond)
+	if err := u.repo.ChangeUserPassword(ctx, userID, encryptedPas, validAfter); err != nil {
+		return fmt.Errorf("change password failed: %w", err)
+	}
+	return nil
+}
+
+// GetUser returns the user by ID
+func (u UserUseCase) GetUser(ctx context.Context, userID string) (models.UserInfo, error) {
+	user, err := u.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return models.UserInfo{}, ErrUserNotFound
+		}
+		return models.UserInfo{}, fmt.Errorf("get user by id failed: %w", err)
+	}
+	return userInfo(user), nil
+}
+
+// FindUser returns the user by login
+func (u UserUseCase) FindUser(ctx context.Context, login string) (models.UserInfo, error) {
+	user, err := u.repo.GetUserByLogin(ctx, login)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return models.UserInfo{}, ErrUserNotFound
+		}
+		return models.UserInfo{}, fmt.Errorf("get user by login failed: %w", err)
+	}
+	return userInfo(user), nil
+}
+
+// SetUserRole grants the role to the user, tokens with the previous role are rejected and have to be refreshed
+func (u UserUseCase) SetUserRole(ctx context.Context, login string, role models.Role) error {
+	if !role.Valid() {
+		return fmt.Errorf("%w: %q", ErrUnknownRole, role)
+	}
+	user, err := u.FindUser(ctx, login)
+	if err != nil {
+		return err
+	}
+	if err := u.repo.SetUserRole(ctx, user.ID, role); err != nil {
+		return fmt.Errorf("set user role failed: %w", err)
+	}
 	return nil
 }
 
-func (u UserUseCase) GetUserBalanceAndWithdrawals(userID string) (models.UserBalance, error) {
+func userInfo(user models.User) models.UserInfo {
+	return models.UserInfo{ID: user.ID, Login: user.Login, Role: user.Role}
+}
+
+func validatePassword(password string) error {
+	if len(password) < 6 {
+		return ErrPasswordTooShort
+	}
+	return nil
+}
+
+func (u UserUseCase) hashPassword(password string) (string, error) {
+	encryptedPas, err := bcrypt.GenerateFromPassword([]byte(password), u.bcryptCost)
+	if err != nil {
+		return "", fmt.Errorf("hashing password failed: %w", err)
+	}
+	return string(encryptedPas), nil
+}
+
+func (u UserUseCase) GetUserBalanceAndWithdrawals(ctx context.Context, userID string) (models.UserBalance, error) {
 	userBal := models.UserBalance{}
-	bal, err := u.repo.GetBalanceByUserID(userID)
+	bal, err := u.repo.GetBalanceByUserID(ctx, userID)
 	if err != nil {
 		return userBal, fmt.Errorf("getting user's balance failed: %w", err)
 	}
-	wd, err := u.repo.GetWithdrawalsByUserID(userID)
+	wd, err := u.repo.GetWithdrawalsByUserID(ctx, userID)
 	if err != nil {
 		return userBal, fmt.Errorf("getting user's withdrawals failed: %w", err)
 	}
@@ -89,19 +228,66 @@ func (u UserUseCase) GetUserBalanceAndWithdrawals(userID string) (models.UserBal
 	return userBal, nil
 }
 
+type journalCursor struct {
+	ID int64 `json:"id"`
+}
+
+// GetBalanceHistory returns the page of accruals, withdrawals and adjustments with the balance after each of them
+func (u UserUseCase) GetBalanceHistory(ctx context.Context, userID string, query models.StatementQuery) (models.Statement, error) {
+	st := models.Statement{}
+	limit, err := pageLimit(query.Limit)
+	if err != nil {
+		return st, err
+	}
+	if err := checkPeriod(query.From, query.To); err != nil {
+		return st, err
+	}
+	cursor := journalCursor{}
+	if err := decodeCursor(query.Cursor, &cursor); err != nil {
+		return st, err
+	}
+	//one more entry tells whether there is the next page
+	entries, err := u.repo.GetJournalPage(ctx, userID, models.JournalFilter{
+		From:    query.From,
+		To:      query.To,
+		AfterID: cursor.ID,
+		Limit:   limit + 1,
+	})
+	if err != nil {
+		return st, fmt.Errorf("getting user's journal failed: %w", err)
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		st.NextCursor = encodeCursor(journalCursor{ID: entries[limit-1].ID})
+	}
+	st.Entries = entries
+	return st, nil
+}
+
 func comparePassword(hashPassword, password string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(hashPassword), []byte(password)) == nil
 }
 
+// GenerateToken returns access token, its jti allows to revoke it
 func (u UserUseCase) GenerateToken(user models.User) (string, error) {
+	key := u.keys.signingKey()
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &tokenClaims{
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(tokenTTL).Unix(),
-			IssuedAt:  time.Now().Unix(),
+			Id:        jti,
+			ExpiresAt: now.Add(u.tokenTTL).Unix(),
+			IssuedAt:  now.Unix(),
 		},
-		UserID: user.ID,
+		UserID:        user.ID,
+		Role:          user.Role,
+		IssuedAtMicro: now.UnixMicro(),
 	})
-	return token.SignedString([]byte(secretKey))
+	token.Header["kid"] = key.ID
+	return token.SignedString([]byte(key.Secret))
 }
 
 func (u UserUseCase) ParseToken(tokenString string) (bool, tokenClaims, error) {
@@ -110,10 +296,16 @@ func (u UserUseCase) ParseToken(tokenString string) (bool, tokenClaims, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(secretKey), nil
+		kid, _ := token.Header["kid"].(string)
+		return u.keys.verificationKey(kid, time.Now())
 	})
 	if err != nil {
 		return false, claims, err
 	}
 	return token.Valid, claims, nil
 }
+
+// ReloadSigningKeys replaces the keys, e.g. after they were rotated in the keys file
+func (u UserUseCase) ReloadSigningKeys(keys []SigningKey) error {
+	return u.keys.Replace(keys)
+}
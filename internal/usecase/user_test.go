@@ -0,0 +1,173 @@
+package usecase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+)
+
+func TestUserUseCase_UpgradePasswordHash(t *testing.T) {
+	ctx := context.Background()
+	u := newTestUserUseCase(t)
+	user := models.User{Login: "user1", Password: "qwerty123"}
+	require.NoError(t, u.CreateUser(ctx, &user))
+
+	u.bcryptCost = bcrypt.MinCost + 1
+	require.NoError(t, u.AuthUser(ctx, &models.User{Login: "user1", Password: "qwerty123"}, ""))
+
+	stored, err := u.repo.GetUserByID(ctx, user.ID)
+	require.NoError(t, err)
+	cost, err := bcrypt.Cost([]byte(stored.EncryptedPassword))
+	require.NoError(t, err)
+	assert.Equal(t, bcrypt.MinCost+1, cost)
+	//the password is the same
+	assert.NoError(t, u.AuthUser(ctx, &models.User{Login: "user1", Password: "qwerty123"}, ""))
+}
+
+func TestUserUseCase_ChangePassword(t *testing.T) {
+	ctx := context.Background()
+	u := newTestUserUseCase(t)
+	user := models.User{Login: "user1", Password: "qwerty123"}
+	require.NoError(t, u.CreateUser(ctx, &user))
+	session, err := u.IssueTokens(ctx, user)
+	require.NoError(t, err)
+	_, stolen, err := u.ParseToken(session.AccessToken)
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, u.ChangePassword(ctx, user.ID, "wrong", "newpassword", ""), ErrWrongPassword)
+	assert.ErrorIs(t, u.ChangePassword(ctx, user.ID, "qwerty123", "short", ""), ErrPasswordTooShort)
+	require.NoError(t, u.ChangePassword(ctx, user.ID, "qwerty123", "newpassword", ""))
+
+	assert.ErrorIs(t, u.AuthUser(ctx, &models.User{Login: "user1", Password: "qwerty123"}, ""), ErrInvalidLoginOrPassword)
+	assert.NoError(t, u.AuthUser(ctx, &models.User{Login: "user1", Password: "newpassword"}, ""))
+
+	//tokens issued before the change are invalid
+	_, err = u.RefreshTokens(ctx, session.RefreshToken)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	//even within the same second
+	assert.ErrorIs(t, u.CheckRevoked(ctx, stolen), ErrTokenRevoked)
+	old := tokenClaims{UserID: user.ID, StandardClaims: jwt.StandardClaims{IssuedAt: time.Now().Add(-time.Minute).Unix()}}
+	assert.ErrorIs(t, u.CheckRevoked(ctx, old), ErrTokenRevoked)
+	//the token without iat_us issued in the second of the change is rejected too
+	legacy := tokenClaims{UserID: user.ID, StandardClaims: jwt.StandardClaims{IssuedAt: stolen.IssuedAt}}
+	assert.ErrorIs(t, u.CheckRevoked(ctx, legacy), ErrTokenRevoked)
+
+	token, err := u.GenerateToken(models.User{ID: user.ID, Role: models.RoleUser})
+	require.NoError(t, err)
+	_, fresh, err := u.ParseToken(token)
+	require.NoError(t, err)
+	assert.NoError(t, u.CheckRevoked(ctx, fresh))
+}
+
+func TestUserUseCase_SetUserRole(t *testing.T) {
+	ctx := context.Background()
+	u := newTestUserUseCase(t)
+	user := models.User{Login: "user1", Password: "qwerty123"}
+	require.NoError(t, u.CreateUser(ctx, &user))
+	session, err := u.IssueTokens(ctx, user)
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, u.SetUserRole(ctx, "user1", "root"), ErrUnknownRole)
+	assert.ErrorIs(t, u.SetUserRole(ctx, "user2", models.RoleAdmin), ErrUserNotFound)
+	require.NoError(t, u.SetUserRole(ctx, "user1", models.RoleAdmin))
+	info, err := u.FindUser(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, models.UserInfo{ID: user.ID, Login: "user1", Role: models.RoleAdmin}, info)
+
+	//the token with the previous role is rejected, the refreshed one has the new role
+	_, claims, err := u.ParseToken(session.AccessToken)
+	require.NoError(t, err)
+	assert.ErrorIs(t, u.CheckRevoked(ctx, claims), ErrTokenRevoked)
+	pair, err := u.RefreshTokens(ctx, session.RefreshToken)
+	require.NoError(t, err)
+	_, claims, err = u.ParseToken(pair.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleAdmin, claims.Role)
+	assert.NoError(t, u.CheckRevoked(ctx, claims))
+}
+
+func TestUserUseCase_AdjustBalance(t *testing.T) {
+	ctx := context.Background()
+	u := newTestUserUseCase(t)
+	user := models.User{Login: "user1", Password: "qwerty123"}
+	require.NoError(t, u.CreateUser(ctx, &user))
+
+	tests := []struct {
+		name string
+		req  models.AdjustmentRequest
+		err  error
+	}{
+		{name: "credit", req: models.AdjustmentRequest{Type: "credit", Sum: models.Points(100), Reason: "compensation"}},
+		{name: "debit", req: models.AdjustmentRequest{Type: "debit", Sum: models.Points(30), Reason: "fraud"}},
+		{name: "debit exceeding balance", req: models.AdjustmentRequest{Type: "debit", Sum: models.Points(100), Reason: "fraud"}, err: ErrNotEnoughFunds},
+		{name: "zero sum", req: models.AdjustmentRequest{Type: "credit", Reason: "goodwill"}, err: ErrInvalidAdjustment},
+		{name: "negative sum", req: models.AdjustmentRequest{Type: "credit", Sum: models.Points(-10), Reason: "goodwill"}, err: ErrInvalidAdjustment},
+		{name: "unknown type", req: models.AdjustmentRequest{Type: "refund", Sum: models.Points(10), Reason: "goodwill"}, err: ErrInvalidAdjustment},
+		{name: "unknown reason", req: models.AdjustmentRequest{Type: "credit", Sum: models.Points(10), Reason: "gift"}, err: ErrUnknownAdjustmentReason},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := u.AdjustBalance(ctx, "2", user.ID, tt.req)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+	_, err := u.AdjustBalance(ctx, "2", "100500", models.AdjustmentRequest{Type: "credit", Sum: models.Points(10), Reason: "goodwill"})
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	bal, err := u.GetUserBalanceAndWithdrawals(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Points(70), bal.Balance)
+	list, err := u.GetAdjustments(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, models.Points(-30), list[1].Amount)
+	assert.Equal(t, "2", list[1].OperatorID)
+}
+
+func TestUserUseCase_GetBalanceHistory(t *testing.T) {
+	ctx := context.Background()
+	u := newTestUserUseCase(t)
+	user := models.User{Login: "user1", Password: "qwerty123"}
+	require.NoError(t, u.CreateUser(ctx, &user))
+	for _, sum := range []models.SumScore{models.Points(100), models.Points(50), models.Points(25)} {
+		_, err := u.AdjustBalance(ctx, "2", user.ID, models.AdjustmentRequest{Type: "credit", Sum: sum, Reason: "goodwill"})
+		require.NoError(t, err)
+	}
+
+	first, err := u.GetBalanceHistory(ctx, user.ID, models.StatementQuery{Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, first.Entries, 2)
+	assert.Equal(t, models.Points(150), first.Entries[1].BalanceAfter)
+	require.NotEmpty(t, first.NextCursor)
+
+	second, err := u.GetBalanceHistory(ctx, user.ID, models.StatementQuery{Limit: 2, Cursor: first.NextCursor})
+	require.NoError(t, err)
+	require.Len(t, second.Entries, 1)
+	assert.Equal(t, models.Points(175), second.Entries[0].BalanceAfter)
+	assert.Empty(t, second.NextCursor)
+
+	now := time.Now()
+	tests := []struct {
+		name  string
+		query models.StatementQuery
+		err   error
+	}{
+		{name: "broken cursor", query: models.StatementQuery{Cursor: "!!!"}, err: ErrInvalidCursor},
+		{name: "negative limit", query: models.StatementQuery{Limit: -1}, err: ErrInvalidPageLimit},
+		{name: "too big limit", query: models.StatementQuery{Limit: MaxPageLimit + 1}, err: ErrInvalidPageLimit},
+		{name: "inverted period", query: models.StatementQuery{From: now, To: now.Add(-time.Hour)}, err: ErrInvalidPeriod},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := u.GetBalanceHistory(ctx, user.ID, tt.query)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
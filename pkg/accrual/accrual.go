@@ -1,21 +1,33 @@
 package accrual
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/OlegMzhelskiy/gophermart/internal/models"
 )
 
+var (
+	// ErrOrderNotRegistered means the accrual system doesn't know the order (204 No Content)
+	ErrOrderNotRegistered = errors.New("order is not registered in accrual system")
+	// ErrNegativeAccrual means the accrual system sent the negative amount, it would debit the user's balance
+	ErrNegativeAccrual = errors.New("accrual must not be negative")
+)
+
 type Accrualer interface {
-	GetOrderStatus(number models.OrderNumber) (AccrualRequest, error)
+	GetOrderStatus(ctx context.Context, number models.OrderNumber) (AccrualRequest, error)
 }
 
 type AccrualSystem struct {
-	addr string
+	addr    string
+	client  *http.Client
+	limiter *rateLimiter
 }
 
 type AccrualRequest struct {
@@ -24,25 +36,89 @@ type AccrualRequest struct {
 	Sum    models.SumScore `json:"accrual"`
 }
 
+// UnmarshalJSON rounds the accrual half to even to minor units. The accrual system sends it as a float,
+// and the strict parsing would fail the order on every poll because of an extra decimal place.
+// The negative accrual is rejected, so the job is retried instead of posting it.
+func (r *AccrualRequest) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Order   string      `json:"order"`
+		Status  string      `json:"status"`
+		Accrual json.Number `json:"accrual"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	r.Order, r.Status, r.Sum = raw.Order, raw.Status, 0
+	if raw.Accrual == "" {
+		return nil
+	}
+	sum, err := models.RoundSumScore(raw.Accrual.String())
+	if err != nil {
+		return err
+	}
+	if sum < 0 {
+		return fmt.Errorf("%w: %s of order %s", ErrNegativeAccrual, raw.Accrual, raw.Order)
+	}
+	if _, err := models.ParseSumScore(raw.Accrual.String()); err != nil {
+		log.Printf("accrual %s of order %s is rounded to %s", raw.Accrual, raw.Order, sum)
+	}
+	r.Sum = sum
+	return nil
+}
+
 func NewSystem(addr string) Accrualer {
-	return &AccrualSystem{addr: addr}
+	return &AccrualSystem{addr: addr, client: &http.Client{}, limiter: &rateLimiter{}}
 }
 
-func (a AccrualSystem) GetOrderStatus(number models.OrderNumber) (AccrualRequest, error) {
+func (a AccrualSystem) GetOrderStatus(ctx context.Context, number models.OrderNumber) (AccrualRequest, error) {
 	request := AccrualRequest{}
-	res, err := http.Get(fmt.Sprintf("%s/api/orders/%s", a.addr, number))
+	if err := a.wait(ctx); err != nil {
+		return request, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/api/orders/%s", a.addr, number), nil)
+	if err != nil {
+		return request, err
+	}
+	res, err := a.client.Do(req)
 	if err != nil {
 		log.Printf("error to request accrual system: %s", err)
 		return request, err
 	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusTooManyRequests {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		now := time.Now()
+		retryAfter := parseRetryAfter(res.Header.Get("Retry-After"), now)
+		limit := parseRequestsPerMinute(string(body))
+		a.limiter.pause(now, retryAfter, limit)
+		return request, &RateLimitError{RetryAfter: retryAfter, Limit: limit}
+	}
+	if res.StatusCode == http.StatusNoContent {
+		return request, ErrOrderNotRegistered
+	}
 	if res.StatusCode != 200 {
 		return request, errors.New("error to request accrual system: " + res.Status)
 	}
 	err = json.NewDecoder(res.Body).Decode(&request)
-	defer res.Body.Close()
 	if err != nil {
 		log.Printf("error to request accrual system: %s", err)
 		return request, err
 	}
 	return request, nil
 }
+
+// wait blocks until the request fits the rate limit
+func (a AccrualSystem) wait(ctx context.Context) error {
+	delay, err := a.limiter.reserve(time.Now())
+	if err != nil || delay <= 0 {
+		return err
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
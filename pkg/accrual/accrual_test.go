@@ -0,0 +1,125 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+	"github.com/OlegMzhelskiy/gophermart/pkg/accrual/stub"
+)
+
+func TestAccrualSystem_GetOrderStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/orders/12345678903", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"order":"12345678903","status":"PROCESSED","accrual":729.98}`))
+	}))
+	defer srv.Close()
+
+	res, err := NewSystem(srv.URL).GetOrderStatus(context.Background(), "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, AccrualRequest{Order: "12345678903", Status: "PROCESSED", Sum: models.SumScore(72998)}, res)
+}
+
+// the accrual is a float in the accrual system, extra decimal places are rounded half to even
+func TestAccrualRequest_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		body    string
+		want    models.SumScore
+		wantErr bool
+	}{
+		{body: `{"order":"1","status":"PROCESSED","accrual":729.98}`, want: 72998},
+		{body: `{"order":"1","status":"PROCESSED","accrual":729.985}`, want: 72998},
+		{body: `{"order":"1","status":"PROCESSED","accrual":729.995}`, want: 73000},
+		{body: `{"order":"1","status":"PROCESSED","accrual":0.1e1}`, want: models.Points(1)},
+		{body: `{"order":"1","status":"PROCESSED","accrual":"500.004"}`, want: models.Points(500)},
+		{body: `{"order":"1","status":"PROCESSING"}`},
+		{body: `{"order":"1","status":"PROCESSED","accrual":null}`},
+		{body: `{"order":"1","status":"PROCESSED","accrual":-0.001}`},
+		{body: `{"order":"1","status":"PROCESSED","accrual":"many"}`, wantErr: true},
+		{body: `{"order":"1","status":"PROCESSED","accrual":1e30}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			var res AccrualRequest
+			err := json.Unmarshal([]byte(tt.body), &res)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "1", res.Order)
+			assert.Equal(t, tt.want, res.Sum)
+		})
+	}
+
+	//the negative accrual would debit the balance
+	for _, body := range []string{`{"order":"1","status":"PROCESSED","accrual":-729.98}`, `{"order":"1","status":"PROCESSED","accrual":"-0.01"}`} {
+		var res AccrualRequest
+		assert.ErrorIs(t, json.Unmarshal([]byte(body), &res), ErrNegativeAccrual, body)
+	}
+}
+
+func TestAccrualSystem_GetOrderStatusCancel(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := NewSystem(srv.URL).GetOrderStatus(ctx, models.OrderNumber("12345678903"))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestAccrualSystem_WithStub(t *testing.T) {
+	st := stub.New(stub.Config{
+		Orders: map[string][]stub.Step{
+			"12345678903": {
+				{Status: models.OrderAccrualStatusRegistered},
+				{Status: models.OrderAccrualStatusProcessing},
+				{Status: models.OrderAccrualStatusProcessed, Accrual: models.Points(500)},
+			},
+		},
+	})
+	srv := httptest.NewServer(st)
+	defer srv.Close()
+	system := NewSystem(srv.URL)
+	ctx := context.Background()
+
+	for _, want := range []AccrualRequest{
+		{Order: "12345678903", Status: models.OrderAccrualStatusRegistered},
+		{Order: "12345678903", Status: models.OrderAccrualStatusProcessing},
+		{Order: "12345678903", Status: models.OrderAccrualStatusProcessed, Sum: models.Points(500)},
+		{Order: "12345678903", Status: models.OrderAccrualStatusProcessed, Sum: models.Points(500)},
+	} {
+		res, err := system.GetOrderStatus(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, want, res)
+	}
+	assert.Equal(t, 4, st.Requests("12345678903"))
+
+	_, err := system.GetOrderStatus(ctx, "79927398713")
+	assert.ErrorIs(t, err, ErrOrderNotRegistered)
+
+	st.FailNext(1)
+	_, err = system.GetOrderStatus(ctx, "12345678903")
+	assert.Error(t, err)
+	_, err = system.GetOrderStatus(ctx, "12345678903")
+	assert.NoError(t, err)
+}
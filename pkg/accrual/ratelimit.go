@@ -0,0 +1,102 @@
+package accrual
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultRetryAfter is used when 429 response has no valid Retry-After header
+const defaultRetryAfter = time.Minute
+
+var ErrRateLimited = errors.New("accrual system rate limit exceeded")
+
+var reRequestsPerMinute = regexp.MustCompile(`No more than (\d+) requests per minute`)
+
+// RateLimitError is returned while calls to the accrual system are paused, it matches ErrRateLimited
+type RateLimitError struct {
+	RetryAfter time.Duration
+	Limit      int //requests per minute, 0 if unknown
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s: retry after %s", ErrRateLimited, e.RetryAfter)
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// rateLimiter is shared by all calls of the client.
+// After 429 it pauses all calls for Retry-After and then spaces them according to the reported limit.
+type rateLimiter struct {
+	mu          sync.Mutex
+	limit       int
+	interval    time.Duration //minimal interval between requests, 0 means unlimited
+	next        time.Time     //the earliest time of the next request
+	pausedUntil time.Time
+}
+
+// reserve returns delay before the request may be sent or RateLimitError if calls are paused
+func (l *rateLimiter) reserve(now time.Time) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Before(l.pausedUntil) {
+		return 0, &RateLimitError{RetryAfter: l.pausedUntil.Sub(now), Limit: l.limit}
+	}
+	at := now
+	if l.next.After(at) {
+		at = l.next
+	}
+	l.next = at.Add(l.interval)
+	return at.Sub(now), nil
+}
+
+// pause stops all calls until retryAfter and adapts the request rate to the limit
+func (l *rateLimiter) pause(now time.Time, retryAfter time.Duration, perMinute int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if perMinute > 0 {
+		l.limit = perMinute
+		l.interval = time.Minute / time.Duration(perMinute)
+	}
+	if until := now.Add(retryAfter); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// parseRetryAfter supports both delay in seconds and HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return defaultRetryAfter
+	}
+	if sec, err := strconv.Atoi(value); err == nil && sec >= 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := date.Sub(now); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return defaultRetryAfter
+}
+
+// parseRequestsPerMinute extracts N from "No more than N requests per minute allowed"
+func parseRequestsPerMinute(body string) int {
+	m := reRequestsPerMinute.FindStringSubmatch(body)
+	if m == nil {
+		return 0
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0
+	}
+	return n
+}
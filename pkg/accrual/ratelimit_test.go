@@ -0,0 +1,78 @@
+package accrual
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{name: "seconds", value: "60", want: time.Minute},
+		{name: "http date", value: "Tue, 01 Nov 2022 12:00:30 GMT", want: 30 * time.Second},
+		{name: "date in the past", value: "Tue, 01 Nov 2022 11:00:00 GMT", want: 0},
+		{name: "empty", value: "", want: defaultRetryAfter},
+		{name: "invalid", value: "soon", want: defaultRetryAfter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseRetryAfter(tt.value, now))
+		})
+	}
+}
+
+func TestParseRequestsPerMinute(t *testing.T) {
+	assert.Equal(t, 10, parseRequestsPerMinute("No more than 10 requests per minute allowed"))
+	assert.Equal(t, 0, parseRequestsPerMinute("Too Many Requests"))
+}
+
+func TestAccrualSystem_RateLimited(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("No more than 600 requests per minute allowed"))
+			return
+		}
+		w.Write([]byte(`{"order":"12345678903","status":"PROCESSING"}`))
+	}))
+	defer srv.Close()
+	system := NewSystem(srv.URL)
+	ctx := context.Background()
+
+	_, err := system.GetOrderStatus(ctx, "12345678903")
+	require.ErrorIs(t, err, ErrRateLimited)
+	var rlErr *RateLimitError
+	require.ErrorAs(t, err, &rlErr)
+	assert.Equal(t, time.Second, rlErr.RetryAfter)
+	assert.Equal(t, 600, rlErr.Limit)
+
+	//calls are paused without requests to the server
+	_, err = system.GetOrderStatus(ctx, "79927398713")
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	time.Sleep(time.Second)
+	_, err = system.GetOrderStatus(ctx, "12345678903")
+	require.NoError(t, err)
+
+	//the next call waits for the interval of 600 requests per minute
+	start := time.Now()
+	_, err = system.GetOrderStatus(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,200 @@
+// Package stub implements a scriptable accrual system for local runs and integration tests.
+//
+// It serves GET /api/orders/{number} like the real accrual system and can be started
+// as cmd/accrual-stub or embedded with httptest.NewServer(stub.New(cfg)).
+package stub
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+)
+
+// Step is a single answer about the order
+type Step struct {
+	Status  string          `json:"status"`
+	Accrual models.SumScore `json:"accrual,omitempty"`
+}
+
+// Config describes behaviour of the stub
+type Config struct {
+	// Orders are scripts of known orders. Each request returns the next step, the last step repeats.
+	Orders map[string][]Step `json:"orders"`
+	// Default is a script for orders missing in Orders, if it's empty the stub answers 204
+	Default []Step `json:"default"`
+	// RateLimit is the number of requests per minute, 0 means unlimited
+	RateLimit int `json:"rate_limit"`
+	// RetryAfter is sent with 429, by default it's the time until the end of the current minute
+	RetryAfter time.Duration `json:"-"`
+	// Latency delays every answer
+	Latency time.Duration `json:"-"`
+	// ErrorRate is the probability of 500 answer
+	ErrorRate float64 `json:"error_rate"`
+}
+
+type orderState struct {
+	steps    []Step
+	pos      int
+	requests int
+}
+
+// Server is http.Handler of the stub, its behaviour may be changed while it's serving
+type Server struct {
+	mu          sync.Mutex
+	cfg         Config
+	orders      map[string]*orderState
+	windowStart time.Time
+	windowCount int
+	failNext    int
+	rnd         *rand.Rand
+	router      *chi.Mux
+}
+
+func New(cfg Config) *Server {
+	s := &Server{
+		cfg:    cfg,
+		orders: make(map[string]*orderState),
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for number, steps := range cfg.Orders {
+		s.orders[number] = &orderState{steps: steps}
+	}
+	s.router = chi.NewRouter()
+	s.router.Get("/api/orders/{number}", s.getOrder)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// SetOrder replaces the script of the order
+func (s *Server) SetOrder(number string, steps ...Step) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orders[number] = &orderState{steps: steps}
+}
+
+// SetRateLimit sets the number of requests per minute, 0 disables the limit
+func (s *Server) SetRateLimit(perMinute int, retryAfter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg.RateLimit = perMinute
+	s.cfg.RetryAfter = retryAfter
+	s.windowStart, s.windowCount = time.Time{}, 0
+}
+
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg.Latency = latency
+}
+
+func (s *Server) SetErrorRate(rate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg.ErrorRate = rate
+}
+
+// FailNext makes the next n requests fail with 500
+func (s *Server) FailNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failNext = n
+}
+
+// Requests returns the number of answered requests about the order
+func (s *Server) Requests(number string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.orders[number]; ok {
+		return st.requests
+	}
+	return 0
+}
+
+func (s *Server) getOrder(w http.ResponseWriter, r *http.Request) {
+	number := chi.URLParam(r, "number")
+
+	s.mu.Lock()
+	latency := s.cfg.Latency
+	s.mu.Unlock()
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if retryAfter, limited := s.rateLimited(time.Now()); limited {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Retry-After", fmt.Sprint(int((retryAfter+time.Second-1)/time.Second)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, "No more than %d requests per minute allowed", s.cfg.RateLimit)
+		return
+	}
+	if s.failNext > 0 || (s.cfg.ErrorRate > 0 && s.rnd.Float64() < s.cfg.ErrorRate) {
+		if s.failNext > 0 {
+			s.failNext--
+		}
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	st, ok := s.orders[number]
+	if !ok {
+		if len(s.cfg.Default) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		st = &orderState{steps: s.cfg.Default}
+		s.orders[number] = st
+	}
+	if len(st.steps) == 0 {
+		st.requests++
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	step := st.steps[st.pos]
+	if st.pos < len(st.steps)-1 {
+		st.pos++
+	}
+	st.requests++
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Order string `json:"order"`
+		Step
+	}{Order: number, Step: step})
+}
+
+// rateLimited counts the request in the current minute window, must be called under lock
+func (s *Server) rateLimited(now time.Time) (time.Duration, bool) {
+	if s.cfg.RateLimit <= 0 {
+		return 0, false
+	}
+	if now.Sub(s.windowStart) >= time.Minute {
+		s.windowStart, s.windowCount = now, 0
+	}
+	s.windowCount++
+	if s.windowCount <= s.cfg.RateLimit {
+		return 0, false
+	}
+	if s.cfg.RetryAfter > 0 {
+		return s.cfg.RetryAfter, true
+	}
+	return s.windowStart.Add(time.Minute).Sub(now), true
+}
@@ -0,0 +1,170 @@
+package stub
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+)
+
+type answer struct {
+	Order   string          `json:"order"`
+	Status  string          `json:"status"`
+	Accrual models.SumScore `json:"accrual"`
+}
+
+func get(t *testing.T, s *Server, number string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/orders/"+number, nil))
+	return rec
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder) answer {
+	t.Helper()
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var a answer
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &a))
+	return a
+}
+
+func TestServer_Scripts(t *testing.T) {
+	s := New(Config{
+		Orders: map[string][]Step{
+			"12345678903": {{Status: "REGISTERED"}, {Status: "PROCESSING"}, {Status: "PROCESSED", Accrual: models.Points(500)}},
+			"2377225624":  {},
+		},
+	})
+
+	//the steps go one by one and the last one repeats
+	for _, want := range []answer{
+		{Order: "12345678903", Status: "REGISTERED"},
+		{Order: "12345678903", Status: "PROCESSING"},
+		{Order: "12345678903", Status: "PROCESSED", Accrual: models.Points(500)},
+		{Order: "12345678903", Status: "PROCESSED", Accrual: models.Points(500)},
+	} {
+		assert.Equal(t, want, decode(t, get(t, s, "12345678903")))
+	}
+	assert.Equal(t, 4, s.Requests("12345678903"))
+
+	//the empty script and unknown orders are answered with 204
+	assert.Equal(t, http.StatusNoContent, get(t, s, "2377225624").Code)
+	assert.Equal(t, 1, s.Requests("2377225624"))
+	assert.Equal(t, http.StatusNoContent, get(t, s, "49927398716").Code)
+	assert.Equal(t, 0, s.Requests("49927398716"))
+
+	s.SetOrder("12345678903", Step{Status: "INVALID"})
+	assert.Equal(t, answer{Order: "12345678903", Status: "INVALID"}, decode(t, get(t, s, "12345678903")))
+	assert.Equal(t, 1, s.Requests("12345678903"))
+}
+
+func TestServer_DefaultScript(t *testing.T) {
+	s := New(Config{Default: []Step{{Status: "PROCESSING"}, {Status: "PROCESSED", Accrual: models.Points(10)}}})
+
+	//every unknown order gets its own copy of the script
+	for _, number := range []string{"12345678903", "2377225624"} {
+		assert.Equal(t, "PROCESSING", decode(t, get(t, s, number)).Status)
+		assert.Equal(t, answer{Order: number, Status: "PROCESSED", Accrual: models.Points(10)}, decode(t, get(t, s, number)))
+		assert.Equal(t, 2, s.Requests(number))
+	}
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	s := New(Config{Default: []Step{{Status: "PROCESSED"}}, RateLimit: 2})
+
+	assert.Equal(t, http.StatusOK, get(t, s, "12345678903").Code)
+	assert.Equal(t, http.StatusOK, get(t, s, "12345678903").Code)
+	rec := get(t, s, "12345678903")
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "No more than 2 requests per minute allowed", rec.Body.String())
+	//by default the client waits until the end of the minute
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.True(t, retryAfter > 0 && retryAfter <= 60, retryAfter)
+	//the limited request isn't answered
+	assert.Equal(t, 2, s.Requests("12345678903"))
+
+	//the new limit starts a new window
+	s.SetRateLimit(1, 5*time.Second)
+	assert.Equal(t, http.StatusOK, get(t, s, "12345678903").Code)
+	rec = get(t, s, "12345678903")
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get("Retry-After"))
+
+	//the window is a minute long
+	s.mu.Lock()
+	s.windowStart = s.windowStart.Add(-time.Minute)
+	s.mu.Unlock()
+	assert.Equal(t, http.StatusOK, get(t, s, "12345678903").Code)
+
+	s.SetRateLimit(0, 0)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, get(t, s, "12345678903").Code)
+	}
+}
+
+func TestServer_Latency(t *testing.T) {
+	s := New(Config{Default: []Step{{Status: "PROCESSED"}}, Latency: 50 * time.Millisecond})
+
+	start := time.Now()
+	assert.Equal(t, http.StatusOK, get(t, s, "12345678903").Code)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	//the canceled request isn't answered
+	s.SetLatency(time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	rec := httptest.NewRecorder()
+	start = time.Now()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/orders/12345678903", nil).WithContext(ctx))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Empty(t, rec.Body.String())
+	assert.Equal(t, 1, s.Requests("12345678903"))
+
+	s.SetLatency(0)
+	start = time.Now()
+	assert.Equal(t, http.StatusOK, get(t, s, "12345678903").Code)
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestServer_Errors(t *testing.T) {
+	s := New(Config{Default: []Step{{Status: "PROCESSED"}}})
+
+	s.FailNext(2)
+	assert.Equal(t, http.StatusInternalServerError, get(t, s, "12345678903").Code)
+	assert.Equal(t, http.StatusInternalServerError, get(t, s, "12345678903").Code)
+	assert.Equal(t, http.StatusOK, get(t, s, "12345678903").Code)
+	assert.Equal(t, 1, s.Requests("12345678903"))
+
+	s.SetErrorRate(1)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusInternalServerError, get(t, s, "12345678903").Code)
+	}
+
+	s.mu.Lock()
+	s.rnd = rand.New(rand.NewSource(1))
+	s.mu.Unlock()
+	s.SetErrorRate(0.5)
+	failed := 0
+	for i := 0; i < 200; i++ {
+		if get(t, s, "12345678903").Code == http.StatusInternalServerError {
+			failed++
+		}
+	}
+	assert.InDelta(t, 100, failed, 30)
+
+	s.SetErrorRate(0)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusOK, get(t, s, "12345678903").Code)
+	}
+}
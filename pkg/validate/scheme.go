@@ -0,0 +1,291 @@
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// names of the check digit schemes of DefaultRegistry
+const (
+	SchemeLuhn     = "luhn"
+	SchemeVerhoeff = "verhoeff"
+	SchemeDamm     = "damm"
+	SchemeEAN      = "ean"
+)
+
+var ErrUnknownScheme = errors.New("unknown order number scheme")
+
+// Validator checks the check digit of a scheme, the digits are ASCII digits and the check digit is the last one
+type Validator interface {
+	Valid(digits string) bool
+	// CheckDigit returns the check digit for the payload, it's appended to the payload
+	CheckDigit(payload string) (byte, error)
+}
+
+// Registry keeps validators by the scheme name
+type Registry struct {
+	mu         sync.RWMutex
+	validators map[string]Validator
+}
+
+func NewRegistry() *Registry {
+	return &Registry{validators: make(map[string]Validator)}
+}
+
+// DefaultRegistry has Luhn, Verhoeff, Damm and EAN schemes
+var DefaultRegistry = func() *Registry {
+	r := NewRegistry()
+	r.Register(SchemeLuhn, LuhnValidator{})
+	r.Register(SchemeVerhoeff, VerhoeffValidator{})
+	r.Register(SchemeDamm, DammValidator{})
+	r.Register(SchemeEAN, EANValidator{})
+	return r
+}()
+
+// DefaultOrderNumberSchemes are accepted if the schemes aren't configured
+var DefaultOrderNumberSchemes = []string{SchemeLuhn}
+
+// Register adds the validator or replaces the validator of the same scheme
+func (r *Registry) Register(scheme string, v Validator) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.validators[strings.ToLower(scheme)] = v
+}
+
+func (r *Registry) Get(scheme string) (Validator, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	v, ok := r.validators[strings.ToLower(strings.TrimSpace(scheme))]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownScheme, scheme)
+	}
+	return v, nil
+}
+
+// Schemes returns the registered scheme names in alphabetical order
+func (r *Registry) Schemes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.validators))
+	for name := range r.validators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OrderNumberPipeline returns the pipeline accepting order numbers valid in any of the schemes,
+// DefaultOrderNumberSchemes are used if schemes are empty
+func (r *Registry) OrderNumberPipeline(schemes ...string) (Pipeline, error) {
+	if len(schemes) == 0 {
+		schemes = DefaultOrderNumberSchemes
+	}
+	validators := make([]Validator, 0, len(schemes))
+	for _, scheme := range schemes {
+		v, err := r.Get(scheme)
+		if err != nil {
+			return nil, err
+		}
+		validators = append(validators, v)
+	}
+	return Pipeline{
+		TrimSpace,
+		StripSeparators,
+		DigitsOnly,
+		Length(MinOrderNumberLen, MaxOrderNumberLen),
+		Checksum(validators...),
+	}, nil
+}
+
+// CheckDigit returns the payload with the check digit of the scheme appended, e.g. for test data
+func (r *Registry) CheckDigit(scheme, payload string) (string, error) {
+	v, err := r.Get(scheme)
+	if err != nil {
+		return "", err
+	}
+	digit, err := v.CheckDigit(payload)
+	if err != nil {
+		return "", err
+	}
+	return payload + string(digit), nil
+}
+
+// Checksum rejects digits which are invalid in all the validators
+func Checksum(validators ...Validator) Step {
+	return func(s string) (string, error) {
+		for _, v := range validators {
+			if v.Valid(s) {
+				return s, nil
+			}
+		}
+		return "", ErrChecksum
+	}
+}
+
+// LuhnValidator is the mod 10 scheme of bank cards
+type LuhnValidator struct{}
+
+func (LuhnValidator) Valid(digits string) bool {
+	return checkLuhn(digits)
+}
+
+func (LuhnValidator) CheckDigit(payload string) (byte, error) {
+	if err := checkPayload(payload); err != nil {
+		return 0, err
+	}
+	sum := 0
+	for i := len(payload) - 1; i >= 0; i-- {
+		n := int(payload[i] - '0')
+		if (len(payload)-i)%2 == 1 {
+			//the check digit will be the first from the right, so the last digit of the payload is doubled
+			n *= 2
+			if n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+	}
+	return byte('0' + (10-sum%10)%10), nil
+}
+
+var (
+	verhoeffD = [10][10]int{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{1, 2, 3, 4, 0, 6, 7, 8, 9, 5},
+		{2, 3, 4, 0, 1, 7, 8, 9, 5, 6},
+		{3, 4, 0, 1, 2, 8, 9, 5, 6, 7},
+		{4, 0, 1, 2, 3, 9, 5, 6, 7, 8},
+		{5, 9, 8, 7, 6, 0, 4, 3, 2, 1},
+		{6, 5, 9, 8, 7, 1, 0, 4, 3, 2},
+		{7, 6, 5, 9, 8, 2, 1, 0, 4, 3},
+		{8, 7, 6, 5, 9, 3, 2, 1, 0, 4},
+		{9, 8, 7, 6, 5, 4, 3, 2, 1, 0},
+	}
+	verhoeffP = [8][10]int{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{1, 5, 7, 6, 2, 8, 3, 0, 9, 4},
+		{5, 8, 0, 3, 7, 9, 6, 1, 4, 2},
+		{8, 9, 1, 6, 0, 4, 3, 5, 2, 7},
+		{9, 4, 5, 3, 1, 2, 6, 8, 7, 0},
+		{4, 2, 8, 6, 5, 7, 3, 9, 0, 1},
+		{2, 7, 9, 3, 8, 0, 6, 4, 1, 5},
+		{7, 0, 4, 6, 9, 1, 3, 2, 5, 8},
+	}
+	verhoeffInv = [10]int{0, 4, 3, 2, 1, 5, 6, 7, 8, 9}
+)
+
+// VerhoeffValidator is the dihedral group scheme, it detects all single digit errors and adjacent transpositions
+type VerhoeffValidator struct{}
+
+func (VerhoeffValidator) Valid(digits string) bool {
+	if digits == "" || !isDigits(digits) {
+		return false
+	}
+	return verhoeff(digits, 0) == 0
+}
+
+func (VerhoeffValidator) CheckDigit(payload string) (byte, error) {
+	if err := checkPayload(payload); err != nil {
+		return 0, err
+	}
+	return byte('0' + verhoeffInv[verhoeff(payload, 1)]), nil
+}
+
+// verhoeff folds the digits from the right, shift is the position of the last digit
+func verhoeff(digits string, shift int) int {
+	c := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		pos := len(digits) - 1 - i + shift
+		c = verhoeffD[c][verhoeffP[pos%8][digits[i]-'0']]
+	}
+	return c
+}
+
+var dammTable = [10][10]int{
+	{0, 3, 1, 7, 5, 9, 8, 6, 4, 2},
+	{7, 0, 9, 2, 1, 5, 4, 8, 6, 3},
+	{4, 2, 0, 6, 8, 7, 1, 3, 5, 9},
+	{1, 7, 5, 0, 9, 8, 3, 4, 2, 6},
+	{6, 1, 2, 3, 0, 4, 5, 9, 7, 8},
+	{3, 6, 7, 4, 2, 0, 9, 5, 8, 1},
+	{5, 8, 6, 9, 7, 2, 0, 1, 3, 4},
+	{8, 9, 4, 5, 3, 6, 2, 0, 1, 7},
+	{9, 4, 3, 8, 6, 1, 7, 2, 0, 5},
+	{2, 5, 8, 1, 4, 3, 6, 7, 9, 0},
+}
+
+// DammValidator is the quasigroup scheme, it detects all single digit errors and adjacent transpositions
+type DammValidator struct{}
+
+func (DammValidator) Valid(digits string) bool {
+	if digits == "" || !isDigits(digits) {
+		return false
+	}
+	return damm(digits) == 0
+}
+
+func (DammValidator) CheckDigit(payload string) (byte, error) {
+	if err := checkPayload(payload); err != nil {
+		return 0, err
+	}
+	return byte('0' + damm(payload)), nil
+}
+
+func damm(digits string) int {
+	interim := 0
+	for i := 0; i < len(digits); i++ {
+		interim = dammTable[interim][digits[i]-'0']
+	}
+	return interim
+}
+
+// EANValidator is the GS1 scheme of EAN-8, UPC-A (12 digits), EAN-13 and GTIN-14 numbers
+type EANValidator struct{}
+
+var eanLengths = map[int]struct{}{8: {}, 12: {}, 13: {}, 14: {}}
+
+func (EANValidator) Valid(digits string) bool {
+	if _, ok := eanLengths[len(digits)]; !ok || !isDigits(digits) {
+		return false
+	}
+	return digits[len(digits)-1] == eanCheckDigit(digits[:len(digits)-1])
+}
+
+func (EANValidator) CheckDigit(payload string) (byte, error) {
+	if err := checkPayload(payload); err != nil {
+		return 0, err
+	}
+	if _, ok := eanLengths[len(payload)+1]; !ok {
+		return 0, fmt.Errorf("%w: EAN payload has %d digits, must be 7, 11, 12 or 13", ErrLength, len(payload))
+	}
+	return eanCheckDigit(payload), nil
+}
+
+// eanCheckDigit weights the digits 3 and 1 alternately starting from the right
+func eanCheckDigit(payload string) byte {
+	sum := 0
+	for i := len(payload) - 1; i >= 0; i-- {
+		n := int(payload[i] - '0')
+		if (len(payload)-i)%2 == 1 {
+			n *= 3
+		}
+		sum += n
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func checkPayload(payload string) error {
+	if payload == "" {
+		return ErrEmpty
+	}
+	_, err := DigitsOnly(payload)
+	return err
+}
+
+func isDigits(s string) bool {
+	_, err := DigitsOnly(s)
+	return err == nil
+}
@@ -0,0 +1,133 @@
+package validate
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidators(t *testing.T) {
+	tests := []struct {
+		scheme  string
+		payload string
+		want    string
+		invalid []string
+	}{
+		{scheme: SchemeLuhn, payload: "7992739871", want: "79927398713", invalid: []string{"79927398710", "97927398713"}},
+		{scheme: SchemeLuhn, payload: "1234567890", want: "12345678903"},
+		{scheme: SchemeVerhoeff, payload: "236", want: "2363", invalid: []string{"2364", "3263"}},
+		{scheme: SchemeVerhoeff, payload: "12345", want: "123451", invalid: []string{"123450", "213451"}},
+		{scheme: SchemeDamm, payload: "572", want: "5724", invalid: []string{"5723", "7524"}},
+		{scheme: SchemeEAN, payload: "400638133393", want: "4006381333931", invalid: []string{"4006381333932", "40063813339"}},
+		{scheme: SchemeEAN, payload: "9638507", want: "96385074", invalid: []string{"96385075"}},
+		{scheme: SchemeEAN, payload: "03600029145", want: "036000291452"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scheme+" "+tt.payload, func(t *testing.T) {
+			v, err := DefaultRegistry.Get(tt.scheme)
+			require.NoError(t, err)
+			got, err := DefaultRegistry.CheckDigit(tt.scheme, tt.payload)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.True(t, v.Valid(tt.want))
+			for _, s := range tt.invalid {
+				assert.False(t, v.Valid(s), s)
+			}
+			assert.False(t, v.Valid(""))
+			assert.False(t, v.Valid("12a4"))
+		})
+	}
+}
+
+func TestValidators_CheckDigitErrors(t *testing.T) {
+	for _, scheme := range DefaultRegistry.Schemes() {
+		_, err := DefaultRegistry.CheckDigit(scheme, "")
+		assert.ErrorIs(t, err, ErrEmpty, scheme)
+		_, err = DefaultRegistry.CheckDigit(scheme, "12a")
+		assert.ErrorIs(t, err, ErrNotDigits, scheme)
+	}
+	_, err := DefaultRegistry.CheckDigit(SchemeEAN, "12345")
+	assert.ErrorIs(t, err, ErrLength)
+	_, err = DefaultRegistry.CheckDigit("isbn", "12345")
+	assert.ErrorIs(t, err, ErrUnknownScheme)
+}
+
+// the generated check digit is valid and every single digit error is detected
+func TestValidators_SingleDigitErrors(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, scheme := range DefaultRegistry.Schemes() {
+		v, err := DefaultRegistry.Get(scheme)
+		require.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			payload := fmt.Sprintf("%012d", rnd.Int63n(1e12))
+			number, err := DefaultRegistry.CheckDigit(scheme, payload)
+			require.NoError(t, err)
+			require.True(t, v.Valid(number), "%s %s", scheme, number)
+
+			pos := rnd.Intn(len(number))
+			wrong := []byte(number)
+			wrong[pos] = '0' + (wrong[pos]-'0'+byte(1+rnd.Intn(9)))%10
+			assert.False(t, v.Valid(string(wrong)), "%s %s", scheme, wrong)
+		}
+	}
+}
+
+func TestRegistry_OrderNumberPipeline(t *testing.T) {
+	pipeline, err := DefaultRegistry.OrderNumberPipeline()
+	require.NoError(t, err)
+	_, err = pipeline.Run("4006381333931")
+	assert.ErrorIs(t, err, ErrChecksum)
+
+	pipeline, err = DefaultRegistry.OrderNumberPipeline(SchemeLuhn, " EAN")
+	require.NoError(t, err)
+	for _, number := range []string{"12345678903", "4006381333931", "4006-3813-3393-1"} {
+		_, err := pipeline.Run(number)
+		assert.NoError(t, err, number)
+	}
+	_, err = pipeline.Run("2363")
+	assert.ErrorIs(t, err, ErrChecksum)
+
+	_, err = DefaultRegistry.OrderNumberPipeline("luhn", "isbn")
+	assert.ErrorIs(t, err, ErrUnknownScheme)
+
+	r := NewRegistry()
+	r.Register("even", evenValidator{})
+	pipeline, err = r.OrderNumberPipeline("even")
+	require.NoError(t, err)
+	got, err := pipeline.Run("1234")
+	require.NoError(t, err)
+	assert.Equal(t, "1234", got)
+	assert.Equal(t, []string{"even"}, r.Schemes())
+}
+
+// evenValidator accepts numbers with even last digit
+type evenValidator struct{}
+
+func (evenValidator) Valid(digits string) bool {
+	return digits != "" && (digits[len(digits)-1]-'0')%2 == 0
+}
+
+func (evenValidator) CheckDigit(string) (byte, error) {
+	return '0', nil
+}
+
+func FuzzCheckDigit(f *testing.F) {
+	f.Add("7992739871")
+	f.Add("400638133393")
+	f.Add("0")
+	f.Fuzz(func(t *testing.T, payload string) {
+		for _, scheme := range DefaultRegistry.Schemes() {
+			v, _ := DefaultRegistry.Get(scheme)
+			number, err := DefaultRegistry.CheckDigit(scheme, payload)
+			if err != nil {
+				continue
+			}
+			if !v.Valid(number) {
+				t.Fatalf("%s: %q with check digit %q is invalid", scheme, payload, number)
+			}
+		}
+	})
+}
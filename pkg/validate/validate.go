@@ -1,29 +1,133 @@
 package validate
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
 	"github.com/OlegMzhelskiy/gophermart/internal/models"
-	"strconv"
 )
 
+const (
+	MinOrderNumberLen = 2 //the check digit and at least one digit of the number
+	MaxOrderNumberLen = 32
+)
+
+var (
+	ErrEmpty     = errors.New("number is empty")
+	ErrNotDigits = errors.New("number must contain only digits")
+	ErrLength    = errors.New("number has invalid length")
+	ErrChecksum  = errors.New("number has invalid check digit")
+)
+
+// Step is a stage of the pipeline, it returns normalized value or error
+type Step func(string) (string, error)
+
+// Pipeline runs the steps in order passing the value of each step to the next one
+type Pipeline []Step
+
+func (p Pipeline) Run(s string) (string, error) {
+	var err error
+	for _, step := range p {
+		if s, err = step(s); err != nil {
+			return "", err
+		}
+	}
+	return s, nil
+}
+
+// OrderNumberPipeline normalizes and validates numbers of orders,
+// e.g. " 1234-5678 903\n" becomes "12345678903"
+var OrderNumberPipeline = Pipeline{
+	TrimSpace,
+	StripSeparators,
+	DigitsOnly,
+	Length(MinOrderNumberLen, MaxOrderNumberLen),
+	Luhn,
+}
+
+// OrderNumber returns the normalized order number, the error tells why the number is invalid
+func OrderNumber(s string) (models.OrderNumber, error) {
+	number, err := OrderNumberPipeline.Run(s)
+	return models.OrderNumber(number), err
+}
+
+// TrimSpace removes leading and trailing white space
+func TrimSpace(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", ErrEmpty
+	}
+	return s, nil
+}
+
+// StripSeparators removes spaces, hyphens and dots separating groups of digits
+func StripSeparators(s string) (string, error) {
+	s = strings.Map(func(r rune) rune {
+		if r == '-' || r == '.' || unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "", ErrEmpty
+	}
+	return s, nil
+}
+
+// DigitsOnly rejects anything but ASCII digits
+func DigitsOnly(s string) (string, error) {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return "", ErrNotDigits
+		}
+	}
+	return s, nil
+}
+
+// Length rejects numbers shorter than min or longer than max digits
+func Length(min, max int) Step {
+	return func(s string) (string, error) {
+		if len(s) < min || len(s) > max {
+			return "", fmt.Errorf("%w: %d digits, must be from %d to %d", ErrLength, len(s), min, max)
+		}
+		return s, nil
+	}
+}
+
+// Luhn rejects digits with invalid Luhn check digit
+func Luhn(s string) (string, error) {
+	if !checkLuhn(s) {
+		return "", ErrChecksum
+	}
+	return s, nil
+}
+
+// CheckLuna reports whether the digits have valid Luhn check digit
 func CheckLuna(num models.OrderNumber) bool {
+	return checkLuhn(string(num))
+}
+
+func checkLuhn(num string) bool {
+	if num == "" {
+		return false
+	}
 	var sum int
-	var n int
-	var err error
-	lenNum := len(num)
-	even := lenNum % 2
-	for i, s := range num {
-		n, err = strconv.Atoi(string(s))
-		if err != nil {
+	double := false
+	for i := len(num) - 1; i >= 0; i-- {
+		n := int(num[i] - '0')
+		if n < 0 || n > 9 {
 			return false
 		}
-		if i%2 == even {
-			n = n * 2
+		if double {
+			n *= 2
 			if n > 9 {
-				n = n - 9
+				n -= 9
 			}
 		}
-		sum = sum + n
+		sum += n
+		double = !double
 	}
-	check := sum % 10
-	return check == 0
+	return sum%10 == 0
 }
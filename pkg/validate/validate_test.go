@@ -0,0 +1,93 @@
+package validate
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/OlegMzhelskiy/gophermart/internal/models"
+)
+
+func TestOrderNumber(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    models.OrderNumber
+		wantErr error
+	}{
+		{name: "valid", in: "12345678903", want: "12345678903"},
+		{name: "spaces around", in: " 79927398713\n", want: "79927398713"},
+		{name: "groups", in: "1234-5678 903", want: "12345678903"},
+		{name: "dots", in: "2377.2256.24", want: "2377225624"},
+		{name: "shortest", in: "18", want: "18"},
+		{name: "empty", in: "", wantErr: ErrEmpty},
+		{name: "spaces only", in: " \t\n", wantErr: ErrEmpty},
+		{name: "separators only", in: "- -", wantErr: ErrEmpty},
+		{name: "letters", in: "1234567890a", wantErr: ErrNotDigits},
+		{name: "sign", in: "+12345678903", wantErr: ErrNotDigits},
+		{name: "non ASCII digits", in: "١٢٣", wantErr: ErrNotDigits},
+		{name: "too short", in: "0", wantErr: ErrLength},
+		{name: "too long", in: strings.Repeat("0", MaxOrderNumberLen+1), wantErr: ErrLength},
+		{name: "longest", in: strings.Repeat("0", MaxOrderNumberLen), want: models.OrderNumber(strings.Repeat("0", MaxOrderNumberLen))},
+		{name: "wrong check digit", in: "12345678904", wantErr: ErrChecksum},
+		{name: "swapped digits", in: "21345678903", wantErr: ErrChecksum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := OrderNumber(tt.in)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Empty(t, got)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCheckLuna(t *testing.T) {
+	tests := map[models.OrderNumber]bool{
+		"12345678903":      true,
+		"79927398713":      true,
+		"4561261212345467": true,
+		"4561261212345464": false,
+		"9278923470":       true,
+		"9278923471":       false,
+		"":                 false,
+		"12a":              false,
+	}
+	for num, want := range tests {
+		assert.Equal(t, want, CheckLuna(num), num)
+	}
+}
+
+func FuzzOrderNumber(f *testing.F) {
+	for _, s := range []string{"12345678903", " 1234-5678 903 ", "2377.2256.24", "", "abc", "0", "١٢٣"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		number, err := OrderNumber(s)
+		if err != nil {
+			if number != "" {
+				t.Fatalf("OrderNumber(%q) = %q with error %s", s, number, err)
+			}
+			return
+		}
+		if _, err := DigitsOnly(string(number)); err != nil {
+			t.Fatalf("OrderNumber(%q) = %q isn't digits", s, number)
+		}
+		if len(number) < MinOrderNumberLen || len(number) > MaxOrderNumberLen {
+			t.Fatalf("OrderNumber(%q) = %q has invalid length", s, number)
+		}
+		if !CheckLuna(number) {
+			t.Fatalf("OrderNumber(%q) = %q has invalid check digit", s, number)
+		}
+		//the normalized number stays the same
+		again, err := OrderNumber(string(number))
+		if err != nil || again != number {
+			t.Fatalf("OrderNumber(%q) = %q, %v", number, again, err)
+		}
+	})
+}